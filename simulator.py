@@ -5,21 +5,69 @@ A minimal OpenAI-compatible API server for testing AI gateways.
 """
 
 import asyncio
+import base64
+import bisect
+import cProfile
+import errno
+import fnmatch
+import gc
+import glob
+import hashlib
+import heapq
+import hmac
+import io
+import ipaddress
+import itertools
 import json
+import logging
+import math
+import os
+import pstats
+import random
+import re
+import sqlite3
+import struct
+import sys
+import threading
 import time
+import traceback
+import tracemalloc
+import typing
+import unicodedata
 import uuid
-from typing import List, Optional, Dict, Any
+from collections import OrderedDict, deque
+from contextvars import ContextVar
+from json.encoder import encode_basestring
+from typing import AsyncIterator, Iterator, List, Optional, Dict, Any, Tuple, Union
 
-from fastapi import FastAPI, HTTPException
-from fastapi.responses import StreamingResponse
-from pydantic import BaseModel, Field
+from fastapi import APIRouter, FastAPI, HTTPException, Request
+from fastapi.responses import HTMLResponse, JSONResponse, PlainTextResponse, Response, StreamingResponse
+from pydantic import BaseModel, Field, ValidationError, model_validator
 import uvicorn
+import yaml
 
 
 # Request/Response Models
 class Message(BaseModel):
     role: str
-    content: str
+    content: Optional[Union[str, List[Dict[str, Any]]]] = None
+    name: Optional[str] = None
+    tool_calls: Optional[List[Dict[str, Any]]] = None
+    tool_call_id: Optional[str] = None
+    function_call: Optional[Dict[str, Any]] = None
+
+
+# Roles accepted in strict mode, in the order OpenAI lists them in its error message
+VALID_ROLES = ("system", "assistant", "user", "function", "tool", "developer")
+
+
+def message_text(msg: Message) -> str:
+    """Text of a message: plain content, or the text parts of multi-part content"""
+    if isinstance(msg.content, str):
+        return msg.content
+    if isinstance(msg.content, list):
+        return " ".join(part.get("text", "") for part in msg.content if part.get("type") == "text")
+    return ""
 
 
 class ChatCompletionRequest(BaseModel):
@@ -29,14 +77,26 @@ class ChatCompletionRequest(BaseModel):
     max_tokens: Optional[int] = None
     stream: Optional[bool] = False
     top_p: Optional[float] = 1.0
-    n: Optional[int] = 1
-    stop: Optional[List[str]] = None
+    n: Optional[int] = Field(1, ge=1, le=128)
+    stop: Optional[Union[str, List[str]]] = None
+    service_tier: Optional[str] = None
+    user: Optional[str] = None
+    tools: Optional[List[Dict[str, Any]]] = None
+    tool_choice: Optional[Union[str, Dict[str, Any]]] = None
+    # Deprecated function calling, still spoken by legacy clients
+    functions: Optional[List[Dict[str, Any]]] = None
+    function_call: Optional[Union[str, Dict[str, Any]]] = None
+    response_format: Optional[Dict[str, Any]] = None
+    stream_options: Optional[Dict[str, Any]] = None  # include_usage: a final chunk with the usage
+    prediction: Optional[Dict[str, Any]] = None  # Predicted Outputs: {"type": "content", "content": ...}
 
 
 class Usage(BaseModel):
     prompt_tokens: int
     completion_tokens: int
     total_tokens: int
+    prompt_tokens_details: Optional[Dict[str, int]] = None
+    completion_tokens_details: Optional[Dict[str, int]] = None
 
 
 class Choice(BaseModel):
@@ -45,6 +105,16 @@ class Choice(BaseModel):
     finish_reason: str
 
 
+class Timings(BaseModel):
+    """llama.cpp-style timing data, included when the x-sim-debug header is set"""
+    prompt_n: int
+    prompt_ms: float
+    prompt_per_second: float
+    predicted_n: int
+    predicted_ms: float
+    predicted_per_second: float
+
+
 class ChatCompletionResponse(BaseModel):
     id: str
     object: str = "chat.completion"
@@ -52,6 +122,8 @@ class ChatCompletionResponse(BaseModel):
     model: str
     choices: List[Choice]
     usage: Usage
+    service_tier: Optional[str] = None
+    timings: Optional[Timings] = None
 
 
 class Model(BaseModel):
@@ -66,186 +138,8350 @@ class ModelList(BaseModel):
     data: List[Model]
 
 
-# Create FastAPI app
-app = FastAPI(
-    title="LLM Behavior Simulator",
-    description="A minimal OpenAI-compatible API server for testing AI gateways",
-    version="1.0.0"
-)
+class TokenizeRequest(BaseModel):
+    """vLLM-style (`prompt` or `messages`) or TGI-style (`inputs`) tokenize request"""
+    model: Optional[str] = None
+    prompt: Optional[str] = None
+    messages: Optional[List[Message]] = None
+    inputs: Optional[str] = None
 
 
-# Available models
-AVAILABLE_MODELS = [
-    "gpt-3.5-turbo",
-    "gpt-4",
-    "gpt-4-turbo",
-    "gpt-4o",
-    "gpt-4o-mini",
+class DetokenizeRequest(BaseModel):
+    model: Optional[str] = None
+    tokens: List[int]
+
+
+class EmbeddingRequest(BaseModel):
+    """OpenAI /v1/embeddings request: input is a string, strings, token ids or lists of token ids"""
+    model: str
+    input: Union[str, List[str], List[int], List[List[int]]]
+    encoding_format: str = "float"
+    dimensions: Optional[int] = None
+    user: Optional[str] = None
+
+
+class CompletionRequest(BaseModel):
+    """Legacy /v1/completions request: prompt is a string, strings, token ids or lists of token ids"""
+    model: str
+    prompt: Union[str, List[str], List[int], List[List[int]]] = "<|endoftext|>"
+    max_tokens: Optional[int] = 16
+    stream: Optional[bool] = False
+    n: Optional[int] = Field(1, ge=1, le=128)
+    stop: Optional[Union[str, List[str]]] = None
+    echo: bool = False
+    user: Optional[str] = None
+
+
+class CountTokensRequest(BaseModel):
+    """Anthropic /v1/messages/count_tokens request (content may be a string or blocks)"""
+    model: str
+    messages: List[Dict[str, Any]]
+    system: Optional[Any] = None
+
+
+# Tokenizers
+class Tokenizer:
+    """
+    Reversible tokenizer interface. Token ids encode their piece's bytes, so any
+    id sequence produced by encode() can be decoded without a vocabulary.
+    """
+    name = "base"
+
+    def pieces(self, text: str) -> List[bytes]:
+        raise NotImplementedError
+
+    def encode(self, text: str) -> List[int]:
+        # A leading 0x01 byte keeps pieces that start with NUL distinguishable
+        return [int.from_bytes(b"\x01" + piece, "big") for piece in self.pieces(text)]
+
+    def decode(self, tokens: List[int]) -> str:
+        data = b"".join(t.to_bytes((t.bit_length() + 7) // 8, "big")[1:] for t in tokens)
+        return data.decode("utf-8", errors="replace")
+
+    def count(self, text: str) -> int:
+        return len(self.pieces(text))
+
+
+class ApproxTokenizer(Tokenizer):
+    """
+    GPT-like approximation: text is pre-split into words, numbers and punctuation
+    (keeping a leading space), then ASCII pieces are cut every 6 bytes and
+    non-ASCII pieces every 2 bytes, so CJK and emoji cost more than Latin text.
+    """
+    name = "approx"
+    PRETOKEN_RE = re.compile(r" ?[A-Za-z]+| ?[0-9]{1,3}| ?[^\sA-Za-z0-9]+|\s+")
+
+    def pieces(self, text: str) -> List[bytes]:
+        out: List[bytes] = []
+        for match in self.PRETOKEN_RE.finditer(text):
+            data = match.group().encode("utf-8")
+            size = 6 if data.isascii() else 2
+            out.extend(data[i:i + size] for i in range(0, len(data), size))
+        return out
+
+
+class ByteTokenizer(Tokenizer):
+    """One token per UTF-8 byte, like byte-level models"""
+    name = "bytes"
+
+    def pieces(self, text: str) -> List[bytes]:
+        data = text.encode("utf-8")
+        return [data[i:i + 1] for i in range(len(data))]
+
+
+TOKENIZERS: Dict[str, Tokenizer] = {t.name: t for t in (ApproxTokenizer(), ByteTokenizer())}
+
+# Context length reported by /tokenize (vLLM's max_model_len)
+MAX_MODEL_LEN = 128000
+
+
+# Generator profiles: sentence pools used instead of the echo response.
+# They exercise non-Latin scripts, right-to-left text and multi-codepoint emoji.
+GENERATOR_PROFILES: Dict[str, List[str]] = {
+    "chinese": [
+        "你好，我是一个模拟的语言模型。",
+        "这是用于测试网关的示例回复。",
+        "今天的天气很好，适合出去散步。",
+        "请注意，这段文字不是真正的模型输出。",
+    ],
+    "japanese": [
+        "こんにちは、私はシミュレーターです。",
+        "これはゲートウェイのテスト用の応答です。",
+        "東京は今日も晴れています。",
+        "カタカナとひらがなと漢字が混ざっています。",
+    ],
+    "korean": [
+        "안녕하세요, 저는 시뮬레이터입니다.",
+        "이것은 게이트웨이 테스트를 위한 응답입니다.",
+        "오늘 서울의 날씨는 맑습니다.",
+        "한국어 문장은 띄어쓰기를 사용합니다.",
+    ],
+    "arabic": [
+        "مرحبًا، أنا نموذج لغوي مُحاكى.",
+        "هذه استجابة تجريبية لاختبار البوابة.",
+        "الطقس جميل اليوم في القاهرة.",
+        "يُكتب هذا النص من اليمين إلى اليسار.",
+    ],
+    "hebrew": [
+        "שלום, אני סימולטור של מודל שפה.",
+        "זוהי תשובה לדוגמה לבדיקת השער.",
+        "מזג האוויר היום נעים בתל אביב.",
+        "הטקסט הזה נכתב מימין לשמאל.",
+    ],
+    "emoji": [
+        "Hello 👋🏽 from the simulator 🤖✨",
+        "Family time 👨‍👩‍👧‍👦 and flags 🇯🇵🇫🇷🇧🇷",
+        "Keycaps 1️⃣2️⃣3️⃣ and hearts ❤️‍🔥💖",
+        "Weather: ☀️🌧️⛈️ — mood: 😀😂🥲",
+    ],
+}
+GENERATOR_PROFILES["cjk"] = GENERATOR_PROFILES["chinese"] + GENERATOR_PROFILES["japanese"] + GENERATOR_PROFILES["korean"]
+GENERATOR_PROFILES["rtl"] = GENERATOR_PROFILES["arabic"] + GENERATOR_PROFILES["hebrew"]
+
+# All generator names accepted in config; "markov" is trained from --corpus files and
+# "sequence" answers with numbered watermark markers
+GENERATORS = set(GENERATOR_PROFILES) | {"markov", "sequence"}
+
+
+# Language detection heuristics, checked in order: first by script, then by
+# common function words for Latin-script languages.
+LANGUAGE_SCRIPTS = [
+    ("ja", re.compile(r"[\u3040-\u30ff]")),
+    ("ko", re.compile(r"[\uac00-\ud7af\u1100-\u11ff]")),
+    ("zh", re.compile(r"[\u4e00-\u9fff]")),
+    ("ar", re.compile(r"[\u0600-\u06ff]")),
+    ("he", re.compile(r"[\u0590-\u05ff]")),
+    ("ru", re.compile(r"[\u0400-\u04ff]")),
 ]
+LANGUAGE_WORDS = {
+    "es": {"el", "la", "los", "las", "que", "es", "por", "para", "hola", "cómo", "estás", "gracias"},
+    "fr": {"le", "la", "les", "est", "et", "une", "je", "vous", "bonjour", "merci", "pour", "pas"},
+    "de": {"der", "die", "das", "und", "ist", "ich", "nicht", "ein", "eine", "hallo", "danke", "wie"},
+    "pt": {"o", "os", "não", "você", "olá", "obrigado", "como", "está", "uma", "para", "com"},
+    "it": {"il", "lo", "gli", "che", "è", "ciao", "grazie", "sono", "come", "stai", "per"},
+}
+
+# Localized echo templates; {model} and {message} are filled in
+ECHO_TEMPLATES = {
+    "en": "[Simulator Response] Model: {model}, Message received: '{message}'",
+    "zh": "[模拟器回复] 模型：{model}，收到的消息：「{message}」",
+    "ja": "[シミュレーター応答] モデル：{model}、受信したメッセージ：「{message}」",
+    "ko": "[시뮬레이터 응답] 모델: {model}, 받은 메시지: '{message}'",
+    "ar": "[رد المحاكي] النموذج: {model}، الرسالة المستلمة: '{message}'",
+    "he": "[תגובת הסימולטור] מודל: {model}, הודעה שהתקבלה: '{message}'",
+    "ru": "[Ответ симулятора] Модель: {model}, получено сообщение: '{message}'",
+    "es": "[Respuesta del simulador] Modelo: {model}, mensaje recibido: '{message}'",
+    "fr": "[Réponse du simulateur] Modèle : {model}, message reçu : '{message}'",
+    "de": "[Simulator-Antwort] Modell: {model}, empfangene Nachricht: '{message}'",
+    "pt": "[Resposta do simulador] Modelo: {model}, mensagem recebida: '{message}'",
+    "it": "[Risposta del simulatore] Modello: {model}, messaggio ricevuto: '{message}'",
+}
+
+# Generator profile to use for a detected language when a generator is active
+LANGUAGE_PROFILES = {"zh": "chinese", "ja": "japanese", "ko": "korean", "ar": "arabic", "he": "hebrew"}
+
+
+# Simulation Config Models
+class ResponseVariant(BaseModel):
+    """One weighted answer of an A/B split"""
+    name: str
+    percent: float = Field(ge=0, le=100)
+    content: str
 
 
-def generate_response_text(messages: List[Message], model: str) -> str:
+class RuleMatch(BaseModel):
     """
-    Generate a simple response based on the input messages.
-    This is a minimal simulator, so we just echo back information about the request.
+    Conditions a request must satisfy for a rule to apply (all optional, ANDed).
+    `contains`/`regex` look at the last user message; `last_role` matches the
+    role of the final message (e.g. "tool" for the follow-up leg of an agent loop);
+    `response_format` matches the type of the requested format ("text" when none is).
     """
-    last_message = messages[-1].content if messages else "No message"
-    truncated_message = last_message[:50]
-    ellipsis = "..." if len(last_message) > 50 else ""
-    response = f"[Simulator Response] Model: {model}, Message received: '{truncated_message}{ellipsis}'"
-    return response
+    model: Optional[str] = None
+    contains: Optional[str] = None
+    regex: Optional[str] = None
+    last_role: Optional[str] = None
+    response_format: Optional[str] = None  # e.g. json_object or json_schema
 
+    @model_validator(mode="after")
+    def check_match(self):
+        if self.regex is not None:
+            try:
+                re.compile(self.regex)
+            except re.error as e:
+                raise ValueError(f"invalid regex {self.regex!r}: {e}")
+        if self.last_role is not None and self.last_role not in VALID_ROLES:
+            raise ValueError(f"unknown last_role '{self.last_role}', expected one of {list(VALID_ROLES)}")
+        return self
 
-def estimate_tokens(text: str) -> int:
-    """Simple token estimation (roughly 4 characters per token)"""
-    return len(text) // 4
 
+class StreamCorruption(BaseModel):
+    """
+    Deliberate stream defects for negative testing of client reassembly.
+    Each value is the probability (0-1) that a content chunk gets that defect.
+    """
+    duplicate_content: float = Field(0.0, ge=0, le=1)
+    out_of_order_index: float = Field(0.0, ge=0, le=1)
+    duplicate_role: float = Field(0.0, ge=0, le=1)
+    reorder: float = Field(0.0, ge=0, le=1)
 
-@app.get("/")
-async def root():
-    """Root endpoint with API information"""
-    return {
-        "name": "LLM Behavior Simulator",
-        "version": "1.0.0",
-        "description": "OpenAI-compatible API for testing AI gateways",
-        "endpoints": [
-            "/v1/chat/completions",
-            "/v1/models"
-        ]
-    }
+    @property
+    def active(self) -> bool:
+        return any((self.duplicate_content, self.out_of_order_index, self.duplicate_role, self.reorder))
 
 
-@app.get("/health")
-async def health():
-    """Health check endpoint"""
-    return {"status": "healthy"}
+STREAM_RETRY_MODES = ("error", "close")
 
 
-@app.get("/v1/models")
-async def list_models() -> ModelList:
-    """List available models"""
-    models = [
-        Model(
-            id=model_id,
-            created=int(time.time()),
-            owned_by="simulator"
-        )
-        for model_id in AVAILABLE_MODELS
-    ]
-    return ModelList(data=models)
+class StreamRetry(BaseModel):
+    """
+    Fail-then-succeed streaming: the first `failures` attempts of a request are cut
+    after `after_events` events, and the next attempt is served in full. Attempts are
+    matched by the idempotency key header, else by the request's fingerprint.
+    """
+    failures: int = Field(1, ge=1)
+    after_events: int = Field(3, ge=0)
+    mode: str = "error"  # error: the dialect's SSE error event, then the end; close: just the end
+    status: int = Field(500, ge=400, le=599)  # of the error event
+    key_header: str = "idempotency-key"
 
+    @model_validator(mode="after")
+    def check_mode(self):
+        if self.mode not in STREAM_RETRY_MODES:
+            raise ValueError(f"unknown stream_retry mode '{self.mode}', expected one of {list(STREAM_RETRY_MODES)}")
+        return self
 
-async def generate_stream(request: ChatCompletionRequest):
-    """Generate streaming response"""
-    response_text = generate_response_text(request.messages, request.model)
-    request_id = f"chatcmpl-{uuid.uuid4().hex[:24]}"
-    created = int(time.time())
-    
-    # Split response into chunks
-    words = response_text.split()
-    
-    for i, word in enumerate(words):
-        chunk = {
-            "id": request_id,
-            "object": "chat.completion.chunk",
-            "created": created,
-            "model": request.model,
-            "choices": [
-                {
-                    "index": 0,
-                    "delta": {"content": word + " "} if i > 0 else {"role": "assistant", "content": word + " "},
-                    "finish_reason": None
-                }
-            ]
+
+FINISH_REASONS = ("stop", "length", "tool_calls", "content_filter", "function_call")
+
+NOISE_KINDS = ("typo", "swap", "drop")
+
+
+class NoiseConfig(BaseModel):
+    """
+    Imperfect-output simulation: each word is altered with probability `rate`
+    by one of the enabled kinds (keyboard typo, swapped characters, dropped word)
+    """
+    rate: float = Field(0.0, ge=0, le=1)
+    kinds: List[str] = list(NOISE_KINDS)
+
+    @model_validator(mode="after")
+    def check_kinds(self):
+        unknown = [k for k in self.kinds if k not in NOISE_KINDS]
+        if unknown or not self.kinds:
+            raise ValueError(f"noise kinds must be a non-empty subset of {list(NOISE_KINDS)}, got {self.kinds}")
+        return self
+
+
+class WatermarkConfig(BaseModel):
+    """
+    Numbered markers for checking stream reassembly end to end: with `enabled` (or
+    x-sim-watermark) each word of a text response is tagged w1:, w2:, ... in order,
+    and the `sequence` generator answers with `length` bare markers, w1 w2 w3 ...
+    """
+    enabled: bool = False
+    length: int = Field(100, ge=1)
+
+
+class PostProcessing(BaseModel):
+    """
+    Decorations applied after generation, as gateways add them: `template` wraps
+    the text ({content} marks where it goes), `append` adds e.g. a disclaimer, and
+    `fields` are merged into the top level of non-streaming response bodies
+    """
+    template: Optional[str] = None
+    append: Optional[str] = None
+    fields: Dict[str, Any] = {}
+
+    @model_validator(mode="after")
+    def check_template(self):
+        if self.template is not None and "{content}" not in self.template:
+            raise ValueError(f"post_processing template {self.template!r} has no {{content}} placeholder")
+        return self
+
+    def apply(self, text: str) -> str:
+        if self.template is not None:
+            text = self.template.replace("{content}", text)
+        if self.append is not None:
+            text += self.append
+        return text
+
+
+class ToolCalls(BaseModel):
+    """
+    When a request offers tools with `tool_choice` unset or "auto" (or legacy functions with
+    `function_call` unset or "auto"), call the first one if `call_on_auto` is set, otherwise
+    answer with text as a model choosing not to would. "required" and a named function always call
+    """
+    call_on_auto: bool = False
+
+
+class ToolLoop(BaseModel):
+    """
+    Answer requests that end in tool results with `template` instead of the default
+    response, so agent loops get a final answer built from what the tools returned:
+    {result} is the output (several joined by newlines, cut at max_result_chars),
+    {name} the function called and {arguments} the arguments it was called with
+    """
+    enabled: bool = False
+    template: str = "Based on the {name} result: {result}"
+    max_result_chars: int = Field(500, ge=1)
+
+    def render(self, results: List[Tuple[str, str, str]]) -> str:
+        output = "\n".join(result for _, _, result in results)
+        if len(output) > self.max_result_chars:
+            output = output[:self.max_result_chars] + "…"
+        values = {
+            "result": output,
+            "name": ", ".join(dict.fromkeys(name for name, _, _ in results)),
+            "arguments": "\n".join(arguments for _, arguments, _ in results),
         }
-        yield f"data: {json.dumps(chunk)}\n\n"
-        await asyncio.sleep(0.05)  # Simulate processing delay
-    
-    # Send final chunk
-    final_chunk = {
-        "id": request_id,
-        "object": "chat.completion.chunk",
-        "created": created,
-        "model": request.model,
-        "choices": [
-            {
-                "index": 0,
-                "delta": {},
-                "finish_reason": "stop"
-            }
-        ]
-    }
-    yield f"data: {json.dumps(final_chunk)}\n\n"
-    yield "data: [DONE]\n\n"
+        # One pass, so placeholders inside tool output are left alone
+        return re.sub(r"\{(result|name|arguments)\}", lambda m: values[m.group(1)], self.template)
 
 
-@app.post("/v1/chat/completions")
-async def create_chat_completion(request: ChatCompletionRequest):
-    """Create a chat completion"""
-    
-    # Validate model
-    if request.model not in AVAILABLE_MODELS:
-        raise HTTPException(
-            status_code=400,
-            detail=f"Model {request.model} not found. Available models: {AVAILABLE_MODELS}"
-        )
-    
-    # Handle streaming
-    if request.stream:
-        return StreamingResponse(
-            generate_stream(request),
-            media_type="text/event-stream"
-        )
-    
-    # Non-streaming response
-    response_text = generate_response_text(request.messages, request.model)
-    
-    # Calculate token usage
-    prompt_text = " ".join([msg.content for msg in request.messages])
-    prompt_tokens = estimate_tokens(prompt_text)
-    completion_tokens = estimate_tokens(response_text)
-    
-    response = ChatCompletionResponse(
-        id=f"chatcmpl-{uuid.uuid4().hex[:24]}",
-        created=int(time.time()),
-        model=request.model,
-        choices=[
-            Choice(
-                index=0,
-                message=Message(role="assistant", content=response_text),
-                finish_reason="stop"
-            )
-        ],
-        usage=Usage(
-            prompt_tokens=prompt_tokens,
-            completion_tokens=completion_tokens,
-            total_tokens=prompt_tokens + completion_tokens
-        )
-    )
-    
-    return response
+# Azure OpenAI content filter: the categories every prompt and completion is annotated with, and
+# their severities from least to most severe
+AZURE_FILTER_CATEGORIES = ("hate", "self_harm", "sexual", "violence")
+AZURE_SEVERITIES = ("safe", "low", "medium", "high")
 
 
-def main():
-    """Run the simulator server"""
-    import argparse
-    
-    parser = argparse.ArgumentParser(description="LLM Behavior Simulator")
-    parser.add_argument("--host", default="0.0.0.0", help="Host to bind to")
-    parser.add_argument("--port", type=int, default=8000, help="Port to bind to")
-    parser.add_argument("--reload", action="store_true", help="Enable auto-reload")
-    
-    args = parser.parse_args()
-    
-    print(f"Starting LLM Behavior Simulator on {args.host}:{args.port}")
-    print(f"OpenAI-compatible API available at http://{args.host}:{args.port}/v1")
-    
-    uvicorn.run(
-        "simulator:app",
-        host=args.host,
-        port=args.port,
-        reload=args.reload
-    )
+class AzureConfig(BaseModel):
+    """
+    Azure OpenAI deployments (name -> model; unlisted names must be models) and the
+    content filter severities annotated on responses, per category (default safe).
+    Categories at or above `filter_threshold` are reported as filtered.
+    """
+    deployments: Dict[str, str] = {}
+    severities: Dict[str, str] = {}
+    filter_threshold: str = "medium"
+
+    @model_validator(mode="after")
+    def check_severities(self):
+        for category, severity in self.severities.items():
+            if category not in AZURE_FILTER_CATEGORIES:
+                raise ValueError(f"unknown azure content filter category '{category}', "
+                                 f"available: {list(AZURE_FILTER_CATEGORIES)}")
+            if severity not in AZURE_SEVERITIES:
+                raise ValueError(f"unknown severity '{severity}' for '{category}', available: {list(AZURE_SEVERITIES)}")
+        if self.filter_threshold not in AZURE_SEVERITIES:
+            raise ValueError(f"unknown filter_threshold '{self.filter_threshold}', available: {list(AZURE_SEVERITIES)}")
+        return self
+
+    def filter_results(self) -> Dict[str, Dict[str, Any]]:
+        """content_filter_results for one prompt or choice"""
+        threshold = AZURE_SEVERITIES.index(self.filter_threshold)
+        results = {}
+        for category in AZURE_FILTER_CATEGORIES:
+            severity = self.severities.get(category, "safe")
+            results[category] = {"filtered": severity != "safe" and AZURE_SEVERITIES.index(severity) >= threshold,
+                                 "severity": severity}
+        return results
+
+
+# OpenRouter model id vendors (the part before the slash) and the provider names they're served by
+OPENROUTER_VENDORS = {"openai": "OpenAI", "anthropic": "Anthropic", "google": "Google", "meta-llama": "Meta",
+                      "mistralai": "Mistral", "x-ai": "xAI"}
+
+
+class OpenRouterConfig(BaseModel):
+    """
+    OpenRouter stand-in under /api/v1: model ids are `vendor/model`, and responses
+    name the provider that served them (`providers`, else the vendor's own)
+    """
+    providers: Dict[str, str] = {}  # model -> provider name reported when the request has no preference
+    context_length: int = Field(128000, ge=1)  # listed for models without capabilities.max_context
+
+
+class Refusal(BaseModel):
+    """How the model declines a moderation category: the message ({category} is replaced) and finish reason"""
+    template: str
+    finish_reason: str = "stop"
+
+    @model_validator(mode="after")
+    def check_finish_reason(self):
+        if self.finish_reason not in FINISH_REASONS:
+            raise ValueError(f"refusal has invalid finish_reason '{self.finish_reason}'")
+        return self
+
+
+# API dialects the simulator speaks, reported by /version
+DIALECTS = ("openai", "anthropic", "gemini")
+
+# Path prefixes of the provider APIs (OpenAI-style /v1, Gemini /v1beta, Azure OpenAI /openai, OpenRouter /api/v1)
+API_PATH_PREFIXES = ("/v1/", "/v1beta/", "/openai/", "/api/v1/")
+
+# How a request's dialect is decided: by path alone, or (auto) also by the SDK's headers
+DIALECT_DETECTION = ("path", "auto")
+
+
+# Provider-specific errors selectable by name instead of a bare status: (status, body)
+ERROR_KINDS: Dict[str, Tuple[int, Dict[str, Any]]] = {
+    "anthropic_overloaded": (529, {
+        "type": "error",
+        "error": {"type": "overloaded_error", "message": "Overloaded"},
+    }),
+    "gemini_overloaded": (503, {
+        "error": {"code": 503, "message": "The model is overloaded. Please try again later.", "status": "UNAVAILABLE"},
+    }),
+    "gemini_resource_exhausted": (429, {
+        "error": {"code": 429, "message": "Resource has been exhausted (e.g. check quota).",
+                  "status": "RESOURCE_EXHAUSTED"},
+    }),
+    "openai_engine_overloaded": (503, {
+        "error": {
+            "message": "The engine is currently overloaded, please try again later",
+            "type": "server_error",
+            "param": None,
+            "code": "engine_overloaded",
+        },
+    }),
+}
+
+
+class ErrorInjection(BaseModel):
+    """
+    Probability (0-1) of failing a request, and the HTTP status to fail with.
+    `kind` selects a provider-specific error (status and body) from ERROR_KINDS instead.
+    """
+    rate: float = Field(0.0, ge=0, le=1)
+    status: int = Field(500, ge=400, le=599)
+    kind: Optional[str] = None
+
+    @model_validator(mode="after")
+    def check_kind(self):
+        if self.kind is not None and self.kind not in ERROR_KINDS:
+            raise ValueError(f"unknown error kind '{self.kind}', available: {sorted(ERROR_KINDS)}")
+        return self
+
+    @property
+    def status_code(self) -> int:
+        return ERROR_KINDS[self.kind][0] if self.kind is not None else self.status
+
+    def response(self, dialect: str = "openai") -> JSONResponse:
+        """The error to inject: the kind's exact body, else `status` in the dialect's schema"""
+        if self.kind is not None:
+            status, body = ERROR_KINDS[self.kind]
+            return JSONResponse(status_code=status, content=body)
+        return provider_error(dialect, self.status)
+
+
+class Fault(BaseModel):
+    """
+    A fault armed through POST /admin/fault: the next `count` requests to paths
+    matching `path` fail with `status` (or the `kind`'s own error), then it disarms
+    """
+    path: str = "/v1/chat/completions"  # glob, e.g. /v1/*
+    status: int = Field(500, ge=400, le=599)
+    kind: Optional[str] = None
+    message: Optional[str] = None
+    count: int = Field(1, ge=1)
+    retry_after_seconds: Optional[float] = Field(None, ge=0)
+
+    @model_validator(mode="after")
+    def check_kind(self):
+        if self.kind is not None and self.kind not in ERROR_KINDS:
+            raise ValueError(f"unknown error kind '{self.kind}', available: {sorted(ERROR_KINDS)}")
+        return self
+
+    def response(self, dialect: str) -> JSONResponse:
+        headers = retry_after_headers(self.retry_after_seconds) if self.retry_after_seconds is not None else {}
+        if self.kind is not None:
+            status, body = ERROR_KINDS[self.kind]
+            return JSONResponse(status_code=status, content=body, headers=headers)
+        return provider_error(dialect, self.status, self.message, headers=headers)
+
+
+STREAM_ABORT_MODES = ("clean", "abrupt")
+
+
+class StreamAbort(BaseModel):
+    """
+    An in-flight chat stream ended early through POST /admin/streams/{id}/abort:
+    cleanly with a finish chunk and [DONE], or abruptly with the body just ending
+    """
+    mode: str = "clean"
+    finish_reason: str = "stop"  # clean: of the choice being streamed
+    after_chunks: Optional[int] = Field(None, ge=0)  # once the stream has sent this many chunks, else right away
+
+    @model_validator(mode="after")
+    def check_mode(self):
+        if self.mode not in STREAM_ABORT_MODES:
+            raise ValueError(f"unknown abort mode '{self.mode}', expected one of {list(STREAM_ABORT_MODES)}")
+        if self.finish_reason not in FINISH_REASONS:
+            raise ValueError(f"unknown finish_reason '{self.finish_reason}', expected one of {list(FINISH_REASONS)}")
+        return self
+
+
+class AuthErrorInjection(BaseModel):
+    """
+    Independent probabilities (0-1) of auth failures on API endpoints, rolled before
+    server errors so key-rotation fallback can be tested separately from 5xx retries
+    """
+    invalid_api_key: float = Field(0.0, ge=0, le=1)
+    permission_denied: float = Field(0.0, ge=0, le=1)
+
+
+class ErrorConfig(ErrorInjection):
+    """
+    Global error injection for API endpoints (/v1/*), with per-endpoint overrides
+    keyed by path, e.g. {"/v1/chat/completions": {"rate": 0.1, "status": 503}}
+    """
+    endpoints: Dict[str, ErrorInjection] = {}
+    auth: AuthErrorInjection = Field(default_factory=AuthErrorInjection)
+
+
+# CDN-layer failures, as Cloudflare describes them on its HTML error pages
+CDN_ERRORS = {
+    520: "Web server is returning an unknown error",
+    522: "Connection timed out",
+    524: "A timeout occurred",
+}
+
+
+class CdnConfig(BaseModel):
+    """
+    The API as seen through a CDN: proxy headers on every API response, and
+    `error_rate` of API requests failing at the edge with a 52x HTML page (not JSON)
+    """
+    headers: bool = False  # Via, CF-Ray, CF-Cache-Status and X-Forwarded-*
+    error_rate: float = Field(0.0, ge=0, le=1)
+    statuses: List[int] = list(CDN_ERRORS)  # picked uniformly per failed request
+    colo: str = "SJC"  # data center code ending CF-Ray ids
+
+    @model_validator(mode="after")
+    def check_statuses(self):
+        unknown = [status for status in self.statuses if status not in CDN_ERRORS]
+        if unknown or not self.statuses:
+            raise ValueError(f"cdn.statuses must be among {sorted(CDN_ERRORS)}, got {self.statuses}")
+        return self
+
+
+# Built-in internal dependencies: (status, message) they fail requests with
+DEPENDENCY_ERRORS = {
+    "tokenizer": (500, "The server had an error while tokenizing your request (tokenizer unavailable, simulated)"),
+    "gpu_pool": (503, "No GPU capacity is available to serve your request right now (gpu_pool exhausted, simulated)"),
+    "safety_filter": (502, "The safety filter did not respond in time (safety_filter unavailable, simulated)"),
+}
+
+
+class DependencyOutage(BaseModel):
+    """
+    An internal dependency failing on its own schedule: healthy spells and outages
+    alternate with exponentially distributed lengths (means in seconds), and during
+    an outage `failure_rate` of the requests on `paths` (prefixes; default all API
+    paths) fail with the dependency's status and message
+    """
+    mean_uptime_seconds: float = Field(600.0, gt=0)
+    mean_outage_seconds: float = Field(30.0, gt=0)
+    failure_rate: float = Field(1.0, ge=0, le=1)
+    status: Optional[int] = Field(None, ge=400, le=599)  # default from DEPENDENCY_ERRORS
+    message: Optional[str] = None
+    paths: List[str] = []
+
+
+class RegionProfile(BaseModel):
+    """A region's latency: network round trip added to every API request, and a scale on generation delays"""
+    rtt_ms: float = Field(0.0, ge=0)
+    latency_multiplier: float = Field(1.0, ge=0)
+
+
+class RegionConfig(BaseModel):
+    """
+    The region this listener answers as, reported in `x-sim-region`. Requests can
+    pick another region from `profiles` with `header`, as a geo-router would.
+    """
+    name: Optional[str] = None
+    header: str = "x-sim-region"
+    profiles: Dict[str, RegionProfile] = {}
+
+
+class TimeoutConfig(BaseModel):
+    """
+    Server-side limits, as provider gateways enforce them: receiving the request
+    body (408), processing an API request (504, or the stream is cut once it has
+    started), each write to a client that stopped reading (the connection is
+    dropped), and idle keep-alive connections
+    """
+    read_seconds: Optional[float] = Field(None, gt=0)
+    request_seconds: Optional[float] = Field(None, gt=0)
+    write_seconds: Optional[float] = Field(None, gt=0)
+    keep_alive_seconds: float = Field(5.0, gt=0)
+
+
+class ConnectionConfig(BaseModel):
+    """
+    How the API listener treats connections, to test client pooling: HTTP/1.1 only
+    (uvicorn, the default) or also cleartext HTTP/2 (h2c, served by Hypercorn), a cap
+    on concurrent connections, and whether connections are kept alive at all
+    """
+    http2: bool = False
+    max_connections: Optional[int] = Field(None, ge=1)  # beyond this, new requests get 503
+    keep_alive: bool = True  # false answers every HTTP/1.1 request with `Connection: close`
+    # Recycle kept-alive connections: close after this many requests, give or take the jitter,
+    # and close after any response with probability close_rate
+    max_requests: Optional[int] = Field(None, ge=1)
+    max_requests_jitter: int = Field(0, ge=0)
+    close_rate: float = Field(0.0, ge=0, le=1)
+    bytes_per_second: Optional[int] = Field(None, ge=1)  # cap on response bytes per connection
+    upload_bytes_per_second: Optional[int] = Field(None, ge=1)  # cap on request body bytes per connection
+    # `Expect: 100-continue`: wait this long before the interim 100, or refuse the body with this status
+    continue_delay_ms: float = Field(0.0, ge=0)
+    continue_reject_status: Optional[int] = Field(None, ge=400, le=599)
+
+
+class StreamResumeConfig(BaseModel):
+    """
+    Chat streams generated to the end even if the client disconnects and kept for
+    `ttl_seconds` after finishing, resumable by completion id and event index
+    """
+    enabled: bool = False
+    ttl_seconds: float = Field(300.0, gt=0)
+    max_streams: int = Field(1000, ge=1)
+
+
+QUEUE_SCHEMES = ("nats", "redis", "rediss")
+
+
+class QueueConfig(BaseModel):
+    """
+    Async inference over a message queue (off unless `url` is set): jobs taken from a
+    NATS subject or Redis list are answered like HTTP requests, and the responses
+    published back. The backend is the url's scheme
+    """
+    url: Optional[str] = None  # nats://localhost:4222 or redis://localhost:6379/0
+    requests: str = "llm.requests"  # NATS subject or Redis list jobs arrive on
+    responses: str = "llm.responses"  # where responses go unless the job names a reply_to
+    group: str = "llm-simulator"  # NATS queue group, so several simulators share the jobs
+    concurrency: int = Field(16, ge=1)  # jobs answered at once
+
+    @model_validator(mode="after")
+    def check_url(self):
+        if self.url is not None and self.url.partition("://")[0] not in QUEUE_SCHEMES:
+            raise ValueError(f"queue.url must start with one of {[f'{s}://' for s in QUEUE_SCHEMES]}, got '{self.url}'")
+        return self
+
+
+class QueueJob(BaseModel):
+    """A request taken from the queue, answered as if sent over HTTP"""
+    id: str = Field(default_factory=lambda: f"job_{uuid.uuid4().hex[:12]}")
+    method: str = "POST"
+    path: str = "/v1/chat/completions"
+    body: Dict[str, Any] = {}
+    headers: Dict[str, str] = {}  # e.g. x-sim-* controls
+    reply_to: Optional[str] = None  # subject or list for the response, in place of queue.responses
+
+
+SSE_FLUSH_MODES = ("default", "strict", "batched")
+
+
+class SSEFlushing(BaseModel):
+    """
+    How stream events are written to the client: as the handler yields them
+    (undelayed events batched, see SSE_BATCH_CHARS), each event on its own, or held
+    until `events` of them can be written together, as buffering proxies do
+    """
+    mode: str = "default"  # default, strict or batched
+    events: int = Field(4, ge=1)  # batched: events per write
+
+    @model_validator(mode="after")
+    def check_mode(self):
+        if self.mode not in SSE_FLUSH_MODES:
+            raise ValueError(f"unknown sse_flush mode '{self.mode}', expected one of {list(SSE_FLUSH_MODES)}")
+        return self
+
+
+class LatencyConfig(BaseModel):
+    """
+    Simulated response timing. Non-streaming responses wait first_token_ms plus
+    per_token_ms per completion token; streams wait first_token_ms before the
+    first chunk and chunk_delay_ms between chunks.
+    """
+    first_token_ms: float = Field(0.0, ge=0)
+    per_token_ms: float = Field(0.0, ge=0)
+    chunk_delay_ms: float = Field(50.0, ge=0)
+    timer_resolution_ms: float = Field(0.0, ge=0)  # >0: round delays up to shared ticks this far apart
+    # (in-flight requests, latency multiplier) points, interpolated linearly and flat past the ends
+    load_curve: List[Tuple[int, float]] = []
+
+    @model_validator(mode="after")
+    def check_load_curve(self):
+        counts = [count for count, _ in self.load_curve]
+        if any(b <= a for a, b in zip(counts, counts[1:])) or any(m < 0 for _, m in self.load_curve):
+            raise ValueError("latency.load_curve needs increasing in-flight counts and non-negative multipliers")
+        return self
+
+
+class RuleChoice(BaseModel):
+    """
+    How one choice of an n > 1 response differs from the rule's answer: its own
+    text, finish reason, or a max_tokens that cuts it short (finish_reason "length")
+    """
+    response: Optional[str] = None
+    finish_reason: Optional[str] = None
+    max_tokens: Optional[int] = Field(None, ge=0)
+
+
+class ResponseRule(BaseModel):
+    """Maps matching requests to a fixed response or a set of weighted variants"""
+    name: str
+    match: RuleMatch = Field(default_factory=RuleMatch)
+    response: Optional[str] = None
+    variants: List[ResponseVariant] = []
+    generator: Optional[str] = None
+    finish_reason: Optional[str] = None
+    noise: Optional[NoiseConfig] = None
+    stream_corruption: Optional[StreamCorruption] = None
+    stream_retry: Optional[StreamRetry] = None  # streams fail partway until retried enough
+    headers: Dict[str, str] = {}  # extra response headers, on top of the global ones
+    post_processing: Optional[PostProcessing] = None
+    category: Optional[str] = None  # moderation category: answer with its refusal from `refusals`
+    latency: Optional[LatencyConfig] = None  # only the fields given replace the global ones
+    errors: Optional[ErrorInjection] = None  # replaces the endpoint's error injection
+    choices: List[RuleChoice] = []  # by choice index; choices past the list answer like choice 0
+
+    @model_validator(mode="after")
+    def check_variants(self):
+        if self.response is None and not self.variants and self.generator is None and self.category is None:
+            raise ValueError(f"rule '{self.name}' needs one of 'response', 'variants', 'generator' or 'category'")
+        if self.generator is not None and self.generator not in GENERATORS:
+            raise ValueError(f"rule '{self.name}' uses unknown generator '{self.generator}'")
+        if self.finish_reason is not None and self.finish_reason not in FINISH_REASONS:
+            raise ValueError(f"rule '{self.name}' has invalid finish_reason '{self.finish_reason}'")
+        for i, choice in enumerate(self.choices):
+            if choice.finish_reason is not None and choice.finish_reason not in FINISH_REASONS:
+                raise ValueError(f"rule '{self.name}' choice {i} has invalid finish_reason '{choice.finish_reason}'")
+        if self.latency is not None and self.latency.model_fields_set & {"timer_resolution_ms", "load_curve"}:
+            raise ValueError(f"rule '{self.name}' latency can only set first_token_ms, per_token_ms and chunk_delay_ms")
+        if self.variants:
+            total = sum(v.percent for v in self.variants)
+            if abs(total - 100) > 1e-6:
+                raise ValueError(f"rule '{self.name}' variant percentages sum to {total}, expected 100")
+        return self
+
+
+class ServiceTier(BaseModel):
+    """Queue rank (lower is served first) and latency scaling for a service tier"""
+    rank: int = 1
+    latency_multiplier: float = Field(1.0, ge=0)
+
+
+def default_service_tiers() -> Dict[str, ServiceTier]:
+    return {
+        "priority": ServiceTier(rank=0, latency_multiplier=0.5),
+        "default": ServiceTier(rank=1, latency_multiplier=1.0),
+        "flex": ServiceTier(rank=2, latency_multiplier=2.0),
+    }
+
+
+class SchedulingConfig(BaseModel):
+    """
+    Simulated capacity: at most max_concurrency requests generate at once (0 means
+    unlimited) and the rest wait in a queue ordered by service tier rank. The
+    tier comes from the priority header if present, else the `service_tier` field.
+    """
+    max_concurrency: int = Field(0, ge=0)
+    priority_header: str = "x-priority"
+    tiers: Dict[str, ServiceTier] = Field(default_factory=default_service_tiers)
+
+
+class BodyLogging(BaseModel):
+    """
+    Request/response body logging for /v1/* (off by default). `redact` entries are
+    dotted paths where `*` matches any key or list index (e.g. "messages.*.content");
+    a bare name redacts that key at any depth.
+    """
+    enabled: bool = False
+    sample_rate: float = Field(1.0, ge=0, le=1)
+    include_response: bool = True
+    redact: List[str] = ["messages.*.content", "choices.*.message.content", "api_key"]
+    redact_headers: List[str] = ["authorization", "x-api-key", "api-key"]
+
+
+class HistoryConfig(BaseModel):
+    """Persistent copy of captured requests in SQLite (off unless `path` is set)"""
+    path: Optional[str] = None
+
+
+class SchemaDrift(BaseModel):
+    """
+    The fields (and short values) of API request bodies, tracked per path (off by
+    default) and compared with a baseline run to report what clients started or
+    stopped sending
+    """
+    enabled: bool = False
+    baseline: Optional[str] = None  # JSON file: loaded at startup, written by POST /admin/schema/baseline
+    max_values: int = Field(20, ge=0)  # distinct values kept per field; a field with more is free-form
+
+
+class DuplicateDetection(BaseModel):
+    """
+    Fingerprints of API request bodies (off by default): a body received again within
+    `window_seconds` of its last sighting counts as a duplicate in /admin/stats
+    """
+    enabled: bool = False
+    window_seconds: float = Field(60.0, gt=0)
+    max_fingerprints: int = Field(10000, ge=1)  # least recently seen ones are forgotten first
+
+
+class ResponseCacheConfig(BaseModel):
+    """
+    Gateway-style response cache (off by default): a successful API response is kept
+    under its request's fingerprint, controls and API key for `ttl_seconds` and replayed
+    verbatim to identical requests, each response marked `x-sim-cache: hit` or `miss`
+    """
+    enabled: bool = False
+    ttl_seconds: float = Field(300.0, gt=0)
+    max_entries: int = Field(1000, ge=1)  # least recently stored ones are dropped first
+    header: str = "x-sim-cache"
+
+
+class UserLimits(BaseModel):
+    """Per-user limits keyed on the request's `user` field (0 means unlimited)"""
+    requests_per_minute: int = Field(0, ge=0)
+
+
+class TokenBucket(BaseModel):
+    """`burst` requests can be sent at once; afterwards they are admitted at `refill_per_second`"""
+    burst: int = Field(..., ge=1)
+    refill_per_second: float = Field(..., gt=0)
+
+
+class StreamLimits(BaseModel):
+    """
+    Caps on the streams each API key may hold open at once, past which a new stream
+    gets a 429. `keys` sets a key's own cap; the rest share `per_key`.
+    """
+    per_key: Optional[int] = Field(None, ge=1)
+    keys: Dict[str, int] = {}
+
+
+class RateLimits(BaseModel):
+    """
+    Token-bucket request limits, one bucket per API key and one per model. `per_key`
+    applies to every key (and to requests without one) unless `keys` lists it.
+    """
+    per_key: Optional[TokenBucket] = None
+    keys: Dict[str, TokenBucket] = {}
+    models: Dict[str, TokenBucket] = {}
+    streams: StreamLimits = Field(default_factory=StreamLimits)
+
+
+class AccessConfig(BaseModel):
+    """Source-address allowlists (empty means any address may connect)"""
+    allow_cidrs: List[str] = []        # API endpoints
+    admin_allow_cidrs: List[str] = []  # /admin/* endpoints
+
+    @model_validator(mode="after")
+    def check_cidrs(self):
+        for cidr in self.allow_cidrs + self.admin_allow_cidrs:
+            ipaddress.ip_network(cidr, strict=False)  # ValueError is reported as a validation error
+        return self
+
+    def networks(self, admin: bool) -> list:
+        return [ipaddress.ip_network(c, strict=False) for c in (self.admin_allow_cidrs if admin else self.allow_cidrs)]
+
+
+class AdminConfig(BaseModel):
+    """Control-plane listener; keeps /admin/* off the API port when `port` is set"""
+    port: Optional[int] = Field(None, ge=1, le=65535)
+    token: Optional[str] = None  # bearer token required on /admin/* when set
+    debug: bool = False  # expose /admin/debug/* profiling and runtime diagnostics
+
+
+class MarkovConfig(BaseModel):
+    """Markov-chain generator trained on text files (order = words of context)"""
+    corpus: List[str] = []
+    order: int = Field(2, ge=1, le=5)
+    length: int = Field(50, ge=1)
+
+
+class EmbeddingModel(BaseModel):
+    """
+    An embedding model's native vector size, whether requests may shorten it with
+    `dimensions` (text-embedding-3 can, ada-002 can't) and whether vectors are unit length
+    """
+    dimensions: int = Field(..., ge=1)
+    shortenable: bool = True
+    normalize: bool = True
+
+
+EMBEDDING_MODELS = {
+    "text-embedding-3-small": EmbeddingModel(dimensions=1536),
+    "text-embedding-3-large": EmbeddingModel(dimensions=3072),
+    "text-embedding-ada-002": EmbeddingModel(dimensions=1536, shortenable=False),
+}
+
+
+VENDOR_ERROR_FORMATS = ("openai", "xai")
+
+
+class VendorQuirks(BaseModel):
+    """How an "OpenAI-compatible" vendor's chat completions differ from OpenAI's"""
+    x_groq: bool = False  # `x_groq` with the request id; in streams also on the last chunk, with the usage
+    usage_timings: bool = False  # queue_time, prompt_time, completion_time and total_time (seconds) in usage
+    system_fingerprint: Optional[str] = None
+    done_marker: bool = True  # end streams with `data: [DONE]`
+    error_format: str = "openai"  # openai: {"error": {...}}; xai: {"code": <status description>, "error": <message>}
+
+    @model_validator(mode="after")
+    def check_error_format(self):
+        if self.error_format not in VENDOR_ERROR_FORMATS:
+            raise ValueError(f"unknown error_format '{self.error_format}', expected one of {list(VENDOR_ERROR_FORMATS)}")
+        return self
+
+
+# Built-in vendor quirks, selected with `vendor` or a model's `vendor`; `vendors` adds or replaces entries
+VENDOR_QUIRKS = {
+    "groq": VendorQuirks(x_groq=True, usage_timings=True, system_fingerprint="fp_sim_groq"),
+    "xai": VendorQuirks(system_fingerprint="fp_sim_xai", error_format="xai"),
+}
+
+# xAI's error `code`: the gRPC status description of the HTTP status
+XAI_ERROR_CODES = {
+    400: "Client specified an invalid argument",
+    401: "The caller does not have permission to execute the specified operation",
+    403: "The caller does not have permission to execute the specified operation",
+    404: "Some requested entity was not found",
+    429: "Some resource has been exhausted",
+    500: "Internal error",
+    503: "The service is currently unavailable",
+}
+
+
+class MessageFormat(BaseModel):
+    """
+    Tokens a chat format adds around the messages, counted in prompt tokens the way
+    OpenAI's cookbook counts them: per message (plus its role), per `name`, and once
+    for priming the reply
+    """
+    per_message: int = 3
+    per_name: int = 1
+    reply: int = 3
+
+
+# Model name prefix -> chat format overhead; the longest matching prefix wins, and
+# models matching none (claude*, gemini*) count their message text only
+MESSAGE_FORMATS = {
+    "gpt-": MessageFormat(),
+    "gpt-3.5-turbo-0301": MessageFormat(per_message=4, per_name=-1),
+    "chatgpt-": MessageFormat(),
+    "o1": MessageFormat(),
+    "o3": MessageFormat(),
+    "o4": MessageFormat(),
+}
+
+
+class ModelCapabilities(BaseModel):
+    """What a model supports; requests using anything else get the provider's 400"""
+    tools: bool = True  # tools/tool_choice and legacy functions/function_call
+    vision: bool = True  # image_url content parts
+    json_mode: bool = True  # response_format json_object / json_schema
+    max_context: Optional[int] = Field(None, ge=1)  # prompt plus max_tokens
+    max_output: Optional[int] = Field(None, ge=1)  # largest accepted max_tokens
+    response: Optional[str] = None  # always answer with this, e.g. a sentinel for routing tests
+    vendor: Optional[str] = None  # answer with this vendor's quirks instead of the listener's `vendor`
+
+
+class ModelPricing(BaseModel):
+    """Token prices in USD per million tokens"""
+    input: float = Field(0.0, ge=0)
+    output: float = Field(0.0, ge=0)
+
+
+class PromptCaching(BaseModel):
+    """
+    Share of each prompt reported as read from the provider's prompt cache, in whole
+    blocks and only for prompts of at least min_tokens, as OpenAI reports it
+    """
+    cached_fraction: float = Field(0.0, ge=0, le=1)
+    min_tokens: int = Field(1024, ge=0)
+    block_tokens: int = Field(128, ge=1)
+
+    def cached(self, prompt_tokens: int) -> int:
+        if prompt_tokens < self.min_tokens:
+            return 0
+        return int(prompt_tokens * self.cached_fraction) // self.block_tokens * self.block_tokens
+
+
+class PricingConfig(BaseModel):
+    """
+    Simulated cost of each response from its usage and the model's prices, counted in
+    /admin/stats and /admin/usage and, with `header`, sent as `x-sim-cost` (USD)
+    """
+    models: Dict[str, ModelPricing] = {}
+    header: bool = False
+
+    def cost(self, model: str, prompt_tokens: int, completion_tokens: int) -> Optional[float]:
+        """USD for this usage, or None when the model has no price"""
+        price = self.models.get(model)
+        if price is None:
+            return None
+        return (prompt_tokens * price.input + completion_tokens * price.output) / 1_000_000
+
+
+FIXTURE_MATCH_MODES = ("exact", "normalized", "hash")
+
+
+class FixtureConfig(BaseModel):
+    """JSONL prompt -> response pairs answered ahead of the generator (after rules)"""
+    files: List[str] = []
+    match: str = "normalized"  # exact, normalized (case/whitespace/punctuation), or hash (nearest prompt)
+    min_similarity: float = Field(0.5, ge=0, le=1)  # hash mode: weakest match still answered
+
+    @model_validator(mode="after")
+    def check_match(self):
+        if self.match not in FIXTURE_MATCH_MODES:
+            raise ValueError(f"unknown fixture match '{self.match}', expected one of {list(FIXTURE_MATCH_MODES)}")
+        return self
+
+
+TRANSCRIPT_PACING = ("original", "scaled", "fixed")
+
+
+class TranscriptPacing(BaseModel):
+    """How fast recorded responses are played back"""
+    pacing: str = "fixed"  # original (recorded timing), scaled (recorded timing / speed), fixed (chunk_delay_ms)
+    speed: float = Field(1.0, gt=0)  # scaled: 2 plays twice as fast
+    chunk_delay_ms: float = Field(0.0, ge=0)  # fixed: pause between recorded SSE chunks
+
+    @model_validator(mode="after")
+    def check_pacing(self):
+        if self.pacing not in TRANSCRIPT_PACING:
+            raise ValueError(f"unknown transcript pacing '{self.pacing}', expected one of {list(TRANSCRIPT_PACING)}")
+        return self
+
+    def schedule(self, recorded: Dict[str, Any]) -> Tuple[float, List[float]]:
+        """
+        Seconds before a body response, and when each chunk is due (seconds after
+        the first); recordings without timing fall back to the fixed delay
+        """
+        speed = self.speed if self.pacing == "scaled" else 1.0
+        if self.pacing != "fixed" and "chunks" in recorded and recorded.get("offsets_ms"):
+            offsets = recorded["offsets_ms"]
+            return offsets[0] / 1000 / speed, [(at - offsets[0]) / 1000 / speed for at in offsets]
+        chunks = recorded.get("chunks", [])
+        if self.pacing != "fixed" and "duration_ms" in recorded:
+            return recorded["duration_ms"] / 1000 / speed, [0.0] * len(chunks)
+        return 0.0, [i * self.chunk_delay_ms / 1000 for i in range(len(chunks))]
+
+
+class TranscriptConfig(TranscriptPacing):
+    """Recorded provider responses served instead of simulated ones, paced as configured"""
+    enabled: bool = False
+    dir: Optional[str] = None  # default: the bundled transcripts/ next to simulator.py
+    header: str = "x-sim-transcript"  # request header naming one transcript, e.g. openai/chat_stream
+    scenarios: Dict[str, TranscriptPacing] = {}  # pacing for requests tagged x-sim-scenario: <name>
+
+
+class InteractiveConfig(BaseModel):
+    """Operator-typed responses from the terminal (off by default)"""
+    enabled: bool = False
+    timeout_seconds: float = Field(30, gt=0)  # then the configured response is sent
+
+
+def request_field(body: Dict[str, Any], path: str) -> Tuple[bool, Any]:
+    """
+    (found, value) of a dotted path into a request body, e.g. `tools[0].function.name`
+    or `messages[-1].role`. `system` is the system prompt in any dialect, as one string.
+    """
+    if path == "system":
+        texts = []
+        for message in body.get("messages") or []:
+            if isinstance(message, dict) and message.get("role") in ("system", "developer"):
+                texts.append(anthropic_content_text(message.get("content")))
+        if body.get("system") is not None:  # Anthropic
+            texts.append(anthropic_content_text(body["system"]))
+        instruction = body.get("systemInstruction") or body.get("system_instruction")  # Gemini
+        if isinstance(instruction, dict):
+            texts.append(anthropic_content_text(instruction.get("parts")))
+        return bool(texts), "\n".join(texts)
+    value: Any = body
+    for token in re.findall(r"[^.\[\]]+|\[-?\d+\]", path):
+        if token.startswith("["):
+            index = int(token[1:-1])
+            if not isinstance(value, list) or not -len(value) <= index < len(value):
+                return False, None
+            value = value[index]
+        elif isinstance(value, dict) and token in value:
+            value = value[token]
+        else:
+            return False, None
+    return True, value
+
+
+# Conditions a RequestCheck can set; `equals` counts when given, even as null
+REQUEST_CHECK_CONDITIONS = ("exists", "equals", "one_of", "min", "max", "contains", "matches")
+
+
+class RequestCheck(BaseModel):
+    """One expectation about a field of the request body; every condition given must hold"""
+    field: str  # dotted path (see request_field), or `system`
+    exists: Optional[bool] = None
+    optional: bool = False  # a missing field passes the other conditions
+    equals: Any = None
+    one_of: Optional[List[Any]] = None
+    min: Optional[float] = None
+    max: Optional[float] = None
+    contains: Optional[Any] = None  # substring of a string, element of a list, key of a mapping
+    matches: Optional[str] = None  # regex searched in the string form of the value
+
+    def given(self, *conditions: str) -> bool:
+        """Whether any of these conditions is set"""
+        return any(getattr(self, c) is not None or (c == "equals" and c in self.model_fields_set) for c in conditions)
+
+    @model_validator(mode="after")
+    def check_conditions(self):
+        if not self.given(*REQUEST_CHECK_CONDITIONS):
+            raise ValueError(f"check of '{self.field}' needs a condition: exists, equals, one_of, min, max, "
+                             f"contains or matches")
+        if self.matches is not None:
+            try:
+                re.compile(self.matches)
+            except re.error as e:
+                raise ValueError(f"invalid regex {self.matches!r}: {e}")
+        return self
+
+    def failure(self, body: Dict[str, Any]) -> Optional[str]:
+        """Why the request violates this check, or None"""
+        found, value = request_field(body, self.field)
+        if self.exists is not None and found != self.exists:
+            return (f"{self.field} is {'present' if found else 'missing'}, "
+                    f"expected it {'present' if self.exists else 'absent'}")
+        if not found:
+            if self.optional or not self.given(*REQUEST_CHECK_CONDITIONS[1:]):
+                return None
+            return f"{self.field} is missing"
+        shown = json.dumps(value)[:200]
+        if self.given("equals") and value != self.equals:
+            return f"{self.field} is {shown}, expected {json.dumps(self.equals)}"
+        if self.one_of is not None and value not in self.one_of:
+            return f"{self.field} is {shown}, expected one of {json.dumps(self.one_of)}"
+        if self.min is not None or self.max is not None:
+            if not isinstance(value, (int, float)) or isinstance(value, bool):
+                return f"{self.field} is {shown}, expected a number"
+            if self.min is not None and value < self.min:
+                return f"{self.field} is {shown}, expected >= {self.min:g}"
+            if self.max is not None and value > self.max:
+                return f"{self.field} is {shown}, expected <= {self.max:g}"
+        if self.contains is not None:
+            if isinstance(value, str):
+                held = isinstance(self.contains, str) and self.contains in value
+            else:
+                held = isinstance(value, (list, dict)) and self.contains in value
+            if not held:
+                return f"{self.field} is {shown}, expected it to contain {json.dumps(self.contains)}"
+        if self.matches is not None:
+            text = value if isinstance(value, str) else json.dumps(value)
+            if not re.search(self.matches, text):
+                return f"{self.field} is {shown}, expected it to match {self.matches!r}"
+        return None
+
+
+class RequestAssertion(BaseModel):
+    """Expectations about the requests a client sends, checked before they are answered"""
+    name: str
+    scenario: Optional[str] = None  # only requests tagged `x-sim-scenario: <scenario>`
+    endpoint: Optional[str] = None  # only paths matching this glob, e.g. /v1/chat/completions
+    model: Optional[str] = None  # only requests for this model
+    expect: List[RequestCheck]
+    reject: bool = True  # false records violations but still answers the request
+
+    def applies(self, path: str, scenario: Optional[str], body: Dict[str, Any]) -> bool:
+        return ((self.scenario is None or self.scenario == scenario)
+                and (self.endpoint is None or fnmatch.fnmatchcase(path, self.endpoint))
+                and (self.model is None or body.get("model") == self.model))
+
+
+class SimulatorConfig(BaseModel):
+    rules: List[ResponseRule] = []
+    models: Dict[str, ModelCapabilities] = {}  # capabilities per model; new names are added to /v1/models
+    generator: Optional[str] = None
+    match_language: bool = False
+    stream_corruption: StreamCorruption = Field(default_factory=StreamCorruption)
+    errors: ErrorConfig = Field(default_factory=ErrorConfig)
+    latency: LatencyConfig = Field(default_factory=LatencyConfig)
+    scheduling: SchedulingConfig = Field(default_factory=SchedulingConfig)
+    user_limits: UserLimits = Field(default_factory=UserLimits)
+    rate_limits: RateLimits = Field(default_factory=RateLimits)
+    access: AccessConfig = Field(default_factory=AccessConfig)
+    body_logging: BodyLogging = Field(default_factory=BodyLogging)
+    history: HistoryConfig = Field(default_factory=HistoryConfig)
+    duplicates: DuplicateDetection = Field(default_factory=DuplicateDetection)
+    response_cache: ResponseCacheConfig = Field(default_factory=ResponseCacheConfig)
+    schema_drift: SchemaDrift = Field(default_factory=SchemaDrift)
+    admin: AdminConfig = Field(default_factory=AdminConfig)
+    capture_size: int = Field(1000, ge=0)
+    markov: MarkovConfig = Field(default_factory=MarkovConfig)
+    fixtures: FixtureConfig = Field(default_factory=FixtureConfig)
+    transcripts: TranscriptConfig = Field(default_factory=TranscriptConfig)
+    interactive: InteractiveConfig = Field(default_factory=InteractiveConfig)
+    noise: NoiseConfig = Field(default_factory=NoiseConfig)
+    watermark: WatermarkConfig = Field(default_factory=WatermarkConfig)
+    seed: Optional[int] = None  # makes errors, variants and generated text repeatable (see SeededRandom)
+    seeds: Dict[str, int] = {}  # x-sim-scenario name -> seed, in place of `seed`
+    tokenizer: str = "approx"
+    message_formats: Dict[str, MessageFormat] = {}  # added to, or replacing, MESSAGE_FORMATS
+    strict: bool = False
+    pricing: PricingConfig = Field(default_factory=PricingConfig)
+    prompt_caching: PromptCaching = Field(default_factory=PromptCaching)
+    self_test: bool = False  # send a chat completion and a stream through the app before serving
+    dialect_detection: str = "path"
+    dialect_prefixes: Dict[str, str] = {}  # path prefix -> dialect served under it, e.g. /anthropic: anthropic
+    headers: Dict[str, str] = {}  # extra headers sent on every completion response
+    post_processing: PostProcessing = Field(default_factory=PostProcessing)
+    tool_calls: ToolCalls = Field(default_factory=ToolCalls)
+    tool_loop: ToolLoop = Field(default_factory=ToolLoop)
+    azure: AzureConfig = Field(default_factory=AzureConfig)
+    openrouter: OpenRouterConfig = Field(default_factory=OpenRouterConfig)
+    vendor: Optional[str] = None  # chat completions behave like this vendor's (see VENDOR_QUIRKS)
+    vendors: Dict[str, VendorQuirks] = {}  # added to, or replacing, VENDOR_QUIRKS
+    embedding_models: Dict[str, EmbeddingModel] = {}  # added to, or replacing, EMBEDDING_MODELS
+    refusals: Dict[str, Refusal] = {}  # moderation category -> how rules with that category refuse
+    assertions: List[RequestAssertion] = []  # contract checks on incoming requests
+    dependencies: Dict[str, DependencyOutage] = {}
+    cdn: CdnConfig = Field(default_factory=CdnConfig)
+    shutdown_delay_seconds: float = Field(0.0, ge=0)  # keep serving, unready, this long after SIGTERM
+    region: RegionConfig = Field(default_factory=RegionConfig)
+    timeouts: TimeoutConfig = Field(default_factory=TimeoutConfig)
+    connections: ConnectionConfig = Field(default_factory=ConnectionConfig)
+    stream_event_ids: bool = False  # `id: <completion id>:<n>` on chat SSE events, with Last-Event-ID replay
+    stream_resume: StreamResumeConfig = Field(default_factory=StreamResumeConfig)
+    sse_flush: SSEFlushing = Field(default_factory=SSEFlushing)
+    queue: QueueConfig = Field(default_factory=QueueConfig)
+
+    @model_validator(mode="after")
+    def check_generator(self):
+        if self.generator is not None and self.generator not in GENERATORS:
+            raise ValueError(f"unknown generator '{self.generator}', available: {sorted(GENERATORS)}")
+        if self.tokenizer not in TOKENIZERS:
+            raise ValueError(f"unknown tokenizer '{self.tokenizer}', available: {sorted(TOKENIZERS)}")
+        if self.dialect_detection not in DIALECT_DETECTION:
+            raise ValueError(f"unknown dialect_detection '{self.dialect_detection}', "
+                             f"available: {list(DIALECT_DETECTION)}")
+        if self.connections.http2 and self.connections.max_connections is not None:
+            raise ValueError("connections.max_connections is only enforced by the HTTP/1.1 server, "
+                             "not with connections.http2")
+        for rule in self.rules:
+            if rule.category is not None and rule.category not in self.refusals:
+                raise ValueError(f"rule '{rule.name}' uses category '{rule.category}', which has no entry "
+                                 f"in refusals (configured: {sorted(self.refusals)})")
+        for name, dependency in self.dependencies.items():
+            if dependency.status is None and name not in DEPENDENCY_ERRORS:
+                raise ValueError(f"dependency '{name}' needs a status (built-in ones: {sorted(DEPENDENCY_ERRORS)})")
+        vendors = {**VENDOR_QUIRKS, **self.vendors}
+        chosen = [("vendor", self.vendor)] + [(f"models.{m}.vendor", caps.vendor) for m, caps in self.models.items()]
+        for where, vendor in chosen:
+            if vendor is not None and vendor not in vendors:
+                raise ValueError(f"{where}: unknown vendor '{vendor}', available: {sorted(vendors)}")
+        for prefix, dialect in self.dialect_prefixes.items():
+            if dialect not in DIALECTS:
+                raise ValueError(f"dialect_prefixes: unknown dialect '{dialect}' for '{prefix}', "
+                                 f"available: {list(DIALECTS)}")
+            if not prefix.startswith("/") or prefix.endswith("/"):
+                raise ValueError(f"dialect_prefixes: '{prefix}' must start with '/' and not end with one")
+            # Stripping it would take apart API paths served unprefixed, such as Azure's /openai/deployments
+            clashing = [api for api in API_PATH_PREFIXES
+                        if api.startswith(prefix + "/") or (prefix + "/").startswith(api)]
+            if clashing:
+                raise ValueError(f"dialect_prefixes: '{prefix}' overlaps the API path prefix '{clashing[0]}'")
+        uses_markov = self.generator == "markov" or any(r.generator == "markov" for r in self.rules)
+        if uses_markov and not self.markov.corpus:
+            raise ValueError("the 'markov' generator needs at least one file in markov.corpus")
+        return self
+
+
+def deep_merge(base: Any, override: Any) -> Any:
+    """override on top of base: mappings merge key by key, anything else (lists too) is replaced"""
+    if not isinstance(base, dict) or not isinstance(override, dict):
+        return override
+    merged = dict(base)
+    for key, value in override.items():
+        merged[key] = deep_merge(merged[key], value) if key in merged else value
+    return merged
+
+
+# Ready-made configs shipped with the simulator, named `builtin:<file name without .yaml>`
+SCENARIOS_DIR = os.path.join(os.path.dirname(os.path.abspath(__file__)), "scenarios")
+BUILTIN_PREFIX = "builtin:"
+
+
+def builtin_scenarios() -> List[str]:
+    return sorted(os.path.splitext(os.path.basename(path))[0] for path in glob.glob(os.path.join(SCENARIOS_DIR, "*.yaml")))
+
+
+def scenario_path(spec: str, relative_to: str = ".") -> str:
+    """The file a scenario or `extends` entry names: `builtin:NAME`, else a path relative to `relative_to`"""
+    if not spec.startswith(BUILTIN_PREFIX):
+        return os.path.join(relative_to, spec)
+    name = spec[len(BUILTIN_PREFIX):]
+    if name not in builtin_scenarios():
+        raise ValueError(f"unknown built-in scenario '{name}', available: {', '.join(builtin_scenarios())}")
+    return os.path.join(SCENARIOS_DIR, f"{name}.yaml")
+
+
+def read_config_file(path: str, chain: Tuple[str, ...] = ()) -> Dict[str, Any]:
+    """
+    A YAML or JSON file's data, on top of the files its `extends` names (a path or
+    a list, relative to the file or `builtin:NAME`, merged in order), so shared defaults live once
+    """
+    path = os.path.abspath(path)
+    if path in chain:
+        raise ValueError(f"circular extends: {' -> '.join(chain + (path,))}")
+    with open(path, "r", encoding="utf-8") as f:
+        data = json.load(f) if path.endswith(".json") else yaml.safe_load(f)
+    data = data or {}
+    if not isinstance(data, dict):
+        raise ValueError(f"{path}: expected a mapping at the top level, got {type(data).__name__}")
+    parents = data.pop("extends", [])
+    if isinstance(parents, str):
+        parents = [parents]
+    if not isinstance(parents, list) or not all(isinstance(parent, str) for parent in parents):
+        raise ValueError(f"{path}: extends must be a file path or a list of them")
+    merged: Dict[str, Any] = {}
+    for parent in parents:
+        merged = deep_merge(merged, read_config_file(scenario_path(parent, os.path.dirname(path)), chain + (path,)))
+    return deep_merge(merged, data)
+
+
+def with_scenarios(data: Dict[str, Any], scenarios: List[str]) -> Dict[str, Any]:
+    """
+    Config data on top of scenarios (built-in names or files), merged in order. Unlike
+    `extends`, rules add up: the config's own come first, so they win, then each scenario's.
+    """
+    merged: Dict[str, Any] = {}
+    rules = list(data.get("rules", []))
+    for spec in scenarios:
+        scenario = read_config_file(scenario_path(spec))
+        rules += scenario.pop("rules", [])
+        merged = deep_merge(merged, scenario)
+    merged = deep_merge(merged, data)
+    if rules:
+        merged["rules"] = rules
+    return merged
+
+
+def load_config(path: Optional[str], overrides: Optional[Dict[str, Any]] = None,
+                scenarios: Optional[List[str]] = None) -> SimulatorConfig:
+    """
+    Load the simulator config from a YAML or JSON file (empty config if no path), on
+    top of any scenarios and with overrides deep-merged over it
+    """
+    data = with_scenarios(read_config_file(scenario_path(path)) if path else {}, scenarios or [])
+    return SimulatorConfig.model_validate(deep_merge(data, overrides or {}))
+
+
+def load_startup_config() -> SimulatorConfig:
+    """
+    Config for this process: main() hands over the config it resolved from the
+    file and command-line flags via LLM_SIM_RESOLVED_CONFIG; otherwise (e.g. when
+    run as `uvicorn simulator:app`) the file named by LLM_SIM_CONFIG is loaded.
+    """
+    resolved = os.getenv("LLM_SIM_RESOLVED_CONFIG")
+    if resolved:
+        return SimulatorConfig.model_validate_json(resolved)
+    return load_config(os.getenv("LLM_SIM_CONFIG"))
+
+
+# Upper bounds (ms) of the histogram of delivered minus configured delay, per scenario
+LATENCY_SKEW_BUCKETS_MS = (1, 2, 5, 10, 25, 50, 100, 250, 500, 1000)
+
+
+class SimulatorStats:
+    """In-memory counters exposed via /admin/stats"""
+
+    def __init__(self):
+        self.reset()
+
+    def reset(self):
+        self.started = int(time.time())
+        self.total_requests = 0
+        self.requests_by_model: Dict[str, int] = {}
+        self.rules: Dict[str, Dict[str, Any]] = {}
+        self.injected_errors: Dict[str, Dict[str, int]] = {}
+        self.throughput_by_model: Dict[str, Dict[str, float]] = {}
+        self.recent_streams: deque = deque(maxlen=100)
+        self.users: Dict[str, Dict[str, int]] = {}
+        self.fixtures = {"matched": 0, "missed": 0}
+        self.fixture_hits: Dict[str, int] = {}  # per fixture source (file:line)
+        self.transcripts: Dict[str, int] = {}  # verbatim responses served per transcript name
+        self.fingerprints: OrderedDict = OrderedDict()  # request body fingerprint -> sightings, oldest first
+        self.latency: Dict[str, Dict[str, Any]] = {}  # per scenario: configured vs delivered delays
+        self.assertions: Dict[str, Dict[str, Any]] = {}  # per request assertion: outcomes and recent failures
+        self.usage: Dict[str, Dict[str, Any]] = {}  # per model: tokens billed and their simulated cost
+        self.stream_retries: Dict[str, Dict[str, int]] = {}  # per rule: streams cut partway and served in full
+        self.cache: Dict[str, Dict[str, int]] = {}  # per path: response cache hits and misses
+
+    def record_request(self, model: str):
+        self.total_requests += 1
+        self.requests_by_model[model] = self.requests_by_model.get(model, 0) + 1
+
+    def record_rule(self, rule: str, variant: Optional[str] = None):
+        entry = self.rules.setdefault(rule, {"matched": 0, "variants": {}})
+        entry["matched"] += 1
+        if variant is not None:
+            entry["variants"][variant] = entry["variants"].get(variant, 0) + 1
+
+    def record_fixture(self, matched: bool, source: Optional[str] = None):
+        self.fixtures["matched" if matched else "missed"] += 1
+        if source is not None:
+            self.fixture_hits[source] = self.fixture_hits.get(source, 0) + 1
+
+    def record_transcript(self, name: str):
+        self.transcripts[name] = self.transcripts.get(name, 0) + 1
+
+    def record_latency(self, scenario: str, simulated: float, actual: float):
+        """Account one response's configured delay and the time its sleeps actually took"""
+        entry = self.latency.setdefault(scenario, {
+            "requests": 0, "simulated_seconds": 0.0, "actual_seconds": 0.0, "max_skew_ms": 0.0,
+            "skew_buckets": [0] * (len(LATENCY_SKEW_BUCKETS_MS) + 1),
+        })
+        skew_ms = max(actual - simulated, 0.0) * 1000
+        entry["requests"] += 1
+        entry["simulated_seconds"] += simulated
+        entry["actual_seconds"] += actual
+        entry["max_skew_ms"] = max(entry["max_skew_ms"], skew_ms)
+        entry["skew_buckets"][bisect.bisect_left(LATENCY_SKEW_BUCKETS_MS, skew_ms)] += 1
+
+    def latency_snapshot(self) -> Dict[str, Any]:
+        labels = [f"<={bound}ms" for bound in LATENCY_SKEW_BUCKETS_MS] + [f">{LATENCY_SKEW_BUCKETS_MS[-1]}ms"]
+        snapshot = {}
+        for scenario, e in self.latency.items():
+            requests = e["requests"]
+            snapshot[scenario] = {
+                "requests": requests,
+                "simulated_ms_avg": round(e["simulated_seconds"] / requests * 1000, 3),
+                "actual_ms_avg": round(e["actual_seconds"] / requests * 1000, 3),
+                "skew_ms_avg": round((e["actual_seconds"] - e["simulated_seconds"]) / requests * 1000, 3),
+                "max_skew_ms": round(e["max_skew_ms"], 3),
+                "actual_to_simulated": round(e["actual_seconds"] / e["simulated_seconds"], 4)
+                if e["simulated_seconds"] > 0 else None,
+                "skew_histogram": dict(zip(labels, e["skew_buckets"])),
+            }
+        return snapshot
+
+    def record_assertion(self, name: str, path: str, failures: List[str]):
+        entry = self.assertions.setdefault(name, {"passed": 0, "failed": 0, "recent_failures": []})
+        if not failures:
+            entry["passed"] += 1
+            return
+        entry["failed"] += 1
+        entry["recent_failures"] = (entry["recent_failures"] + [
+            {"timestamp": time.time(), "path": path, "failures": failures}])[-20:]
+
+    def record_fingerprint(self, fingerprint: str, path: str, model: Optional[str], status: int,
+                           settings: DuplicateDetection):
+        """Count a request body; it is a duplicate if seen within the window before"""
+        now = time.time()
+        entry = self.fingerprints.pop(fingerprint, None)
+        if entry is None or now - entry["last_seen"] > settings.window_seconds:
+            entry = {"path": path, "model": model, "requests": 0, "duplicates": 0,
+                     "statuses": {}, "first_seen": now, "last_seen": now}
+        else:
+            entry["duplicates"] += 1
+        entry["requests"] += 1
+        entry["statuses"][str(status)] = entry["statuses"].get(str(status), 0) + 1
+        entry["last_seen"] = now
+        self.fingerprints[fingerprint] = entry
+        while len(self.fingerprints) > settings.max_fingerprints:
+            self.fingerprints.popitem(last=False)
+
+    def duplicates_snapshot(self, limit: int = 50) -> Dict[str, Any]:
+        """Fingerprints received more than once, most duplicated first"""
+        repeated = sorted(((fp, e) for fp, e in self.fingerprints.items() if e["duplicates"]),
+                          key=lambda item: item[1]["duplicates"], reverse=True)
+        return {
+            "duplicate_requests": sum(e["duplicates"] for _, e in repeated),
+            "by_fingerprint": {fp: {**e, "statuses": dict(e["statuses"])} for fp, e in repeated[:limit]},
+        }
+
+    def record_injected_error(self, path: str, status: int):
+        by_status = self.injected_errors.setdefault(path, {})
+        by_status[str(status)] = by_status.get(str(status), 0) + 1
+
+    def _user(self, user: str) -> Dict[str, int]:
+        return self.users.setdefault(user, {
+            "requests": 0, "rate_limited": 0, "prompt_tokens": 0, "completion_tokens": 0,
+        })
+
+    def record_user_request(self, user: str, rate_limited: bool = False):
+        entry = self._user(user)
+        entry["requests"] += 1
+        if rate_limited:
+            entry["rate_limited"] += 1
+
+    def record_user_usage(self, user: Optional[str], prompt_tokens: int, completion_tokens: int):
+        if user is None:
+            return
+        entry = self._user(user)
+        entry["prompt_tokens"] += prompt_tokens
+        entry["completion_tokens"] += completion_tokens
+
+    def record_usage(self, model: str, user: Optional[str], prompt_tokens: int, completion_tokens: int):
+        """Tokens billed for one response, priced with the model's `pricing` entry if it has one"""
+        cost = config.pricing.cost(model, prompt_tokens, completion_tokens)
+        entry = self.usage.setdefault(model, {"requests": 0, "prompt_tokens": 0, "completion_tokens": 0,
+                                              "cost_usd": None})
+        entry["requests"] += 1
+        entry["prompt_tokens"] += prompt_tokens
+        entry["completion_tokens"] += completion_tokens
+        if cost is not None:
+            entry["cost_usd"] = (entry["cost_usd"] or 0.0) + cost
+        self.record_user_usage(user, prompt_tokens, completion_tokens)
+        if user is not None and cost is not None:
+            self.users[user]["cost_usd"] = self.users[user].get("cost_usd", 0.0) + cost
+
+    def usage_snapshot(self) -> Dict[str, Any]:
+        priced = [e["cost_usd"] for e in self.usage.values() if e["cost_usd"] is not None]
+        return {
+            "prompt_tokens": sum(e["prompt_tokens"] for e in self.usage.values()),
+            "completion_tokens": sum(e["completion_tokens"] for e in self.usage.values()),
+            "cost_usd": round(sum(priced), 6) if priced else None,
+            "by_model": {model: {**e, "cost_usd": round(e["cost_usd"], 6) if e["cost_usd"] is not None else None}
+                         for model, e in self.usage.items()},
+        }
+
+    def record_throughput(self, model: str, tokens: int, seconds: float, stream_id: Optional[str] = None):
+        """Account completion tokens served and the time spent serving them"""
+        entry = self.throughput_by_model.setdefault(model, {"completion_tokens": 0, "serving_seconds": 0.0})
+        entry["completion_tokens"] += tokens
+        entry["serving_seconds"] += seconds
+        if stream_id is not None:
+            self.recent_streams.append({
+                "id": stream_id,
+                "model": model,
+                "completion_tokens": tokens,
+                "seconds": round(seconds, 4),
+                "tokens_per_second": round(tokens / seconds, 2) if seconds > 0 else None,
+            })
+
+    def throughput_snapshot(self) -> Dict[str, Any]:
+        uptime = max(time.time() - self.started, 1e-9)
+        total_tokens = sum(e["completion_tokens"] for e in self.throughput_by_model.values())
+        return {
+            "completion_tokens": total_tokens,
+            "tokens_per_second_since_start": round(total_tokens / uptime, 2),
+            "by_model": {
+                model: {
+                    "completion_tokens": e["completion_tokens"],
+                    "serving_seconds": round(e["serving_seconds"], 4),
+                    "tokens_per_second": round(e["completion_tokens"] / e["serving_seconds"], 2)
+                    if e["serving_seconds"] > 0 else None,
+                }
+                for model, e in self.throughput_by_model.items()
+            },
+            "recent_streams": list(self.recent_streams),
+        }
+
+    def record_stream_retry(self, rule: str, failed: bool):
+        entry = self.stream_retries.setdefault(rule, {"failed": 0, "served": 0})
+        entry["failed" if failed else "served"] += 1
+
+    def record_cache(self, path: str, hit: bool):
+        entry = self.cache.setdefault(path, {"hits": 0, "misses": 0})
+        entry["hits" if hit else "misses"] += 1
+
+    def export_state(self) -> Dict[str, Any]:
+        """Raw counters for a state snapshot (see restore_state)"""
+        return {
+            "started": self.started,
+            "total_requests": self.total_requests,
+            "requests_by_model": self.requests_by_model,
+            "rules": self.rules,
+            "injected_errors": self.injected_errors,
+            "throughput_by_model": self.throughput_by_model,
+            "recent_streams": list(self.recent_streams),
+            "users": self.users,
+            "fixtures": self.fixtures,
+            "fixture_hits": self.fixture_hits,
+            "transcripts": self.transcripts,
+            "fingerprints": dict(self.fingerprints),
+            "latency": self.latency,
+            "assertions": self.assertions,
+            "usage": self.usage,
+            "stream_retries": self.stream_retries,
+            "cache": self.cache,
+        }
+
+    def restore_state(self, data: Dict[str, Any]):
+        self.reset()
+        self.started = data.get("started", self.started)
+        self.total_requests = data.get("total_requests", 0)
+        self.requests_by_model = dict(data.get("requests_by_model", {}))
+        self.rules = dict(data.get("rules", {}))
+        self.injected_errors = dict(data.get("injected_errors", {}))
+        self.throughput_by_model = dict(data.get("throughput_by_model", {}))
+        self.recent_streams.extend(data.get("recent_streams", []))
+        self.users = dict(data.get("users", {}))
+        self.fixtures.update(data.get("fixtures", {}))
+        self.fixture_hits = dict(data.get("fixture_hits", {}))
+        self.transcripts = dict(data.get("transcripts", {}))
+        self.fingerprints = OrderedDict(data.get("fingerprints", {}))
+        self.latency = dict(data.get("latency", {}))
+        self.assertions = dict(data.get("assertions", {}))
+        self.usage = dict(data.get("usage", {}))
+        self.stream_retries = dict(data.get("stream_retries", {}))
+        self.cache = dict(data.get("cache", {}))
+
+    def snapshot(self) -> Dict[str, Any]:
+        return {
+            "started": self.started,
+            "total_requests": self.total_requests,
+            "requests_by_model": dict(self.requests_by_model),
+            "rules": {name: {"matched": e["matched"], "variants": dict(e["variants"])}
+                      for name, e in self.rules.items()},
+            "injected_errors": {path: dict(c) for path, c in self.injected_errors.items()},
+            "throughput": self.throughput_snapshot(),
+            "users": {user: dict(e) for user, e in self.users.items()},
+            "fixtures": dict(self.fixtures),
+            "transcripts": dict(self.transcripts),
+            "duplicates": self.duplicates_snapshot(),
+            "latency": self.latency_snapshot(),
+            "assertions": {name: {"passed": e["passed"], "failed": e["failed"]} for name, e in self.assertions.items()},
+            "usage": self.usage_snapshot(),
+            "stream_retries": {rule: dict(e) for rule, e in self.stream_retries.items()},
+            "cache": {path: dict(e) for path, e in self.cache.items()},
+        }
+
+
+class PriorityGate:
+    """
+    Concurrency limiter whose waiters are admitted by rank (lowest first) and
+    then arrival order, so higher-priority requests jump the simulated queue.
+    """
+
+    def __init__(self):
+        self.active = 0
+        self._waiters: List[Tuple[int, int, asyncio.Future]] = []
+        self._seq = itertools.count()
+
+    @property
+    def queued(self) -> int:
+        return len(self._waiters)
+
+    async def acquire(self, rank: int):
+        limit = config.scheduling.max_concurrency
+        if limit == 0 or (self.active < limit and not self._waiters):
+            self.active += 1
+            return
+        future = asyncio.get_running_loop().create_future()
+        entry = (rank, next(self._seq), future)
+        heapq.heappush(self._waiters, entry)
+        try:
+            await future
+        except asyncio.CancelledError:
+            if entry in self._waiters:
+                self._waiters.remove(entry)
+                heapq.heapify(self._waiters)
+            elif future.done() and not future.cancelled():
+                self.release()  # slot was handed over just as we were cancelled
+            raise
+
+    def release(self):
+        while self._waiters:
+            _, _, future = heapq.heappop(self._waiters)
+            if not future.done():
+                future.set_result(None)  # hand the slot over; active count unchanged
+                return
+        self.active -= 1
+
+
+class TimerWheel:
+    """
+    Coalesced sleeps: a delay is rounded up to the next tick and everything due on
+    that tick waits on one Event, so the event loop holds one timer per tick
+    rather than one per sleeping response
+    """
+
+    def __init__(self):
+        self._slots: Dict[int, asyncio.Event] = {}
+        self.waiting = 0
+
+    @property
+    def slots(self) -> int:
+        return len(self._slots)
+
+    async def sleep(self, seconds: float, resolution: float):
+        if seconds <= 0:
+            await asyncio.sleep(0)
+            return
+        loop = asyncio.get_running_loop()
+        tick = math.ceil((loop.time() + seconds) / resolution)
+        slot = self._slots.get(tick)
+        if slot is None:
+            slot = self._slots[tick] = asyncio.Event()
+            loop.call_at(tick * resolution, self._fire, tick)
+        self.waiting += 1
+        try:
+            await slot.wait()
+        finally:
+            self.waiting -= 1
+
+    def _fire(self, tick: int):
+        self._slots.pop(tick).set()
+
+
+class FixedWindowLimiter:
+    """Counts hits per key in fixed windows aligned to the window length"""
+
+    def __init__(self, window_seconds: float = 60.0):
+        self.window_seconds = window_seconds
+        self._windows: Dict[str, Tuple[float, int]] = {}
+
+    def _current(self, key: str, now: float) -> Tuple[float, int]:
+        """(start, hits) of the key's window containing `now`; an older window has reset"""
+        window_start = now - (now % self.window_seconds)
+        start, count = self._windows.get(key, (window_start, 0))
+        if start != window_start:
+            return window_start, 0
+        return start, count
+
+    def hit(self, key: str, limit: int) -> Optional[float]:
+        """Record a hit; returns seconds until the window resets if the limit is exceeded"""
+        now = time.time()
+        start, count = self._current(key, now)
+        if count >= limit:
+            return start + self.window_seconds - now
+        self._windows[key] = (start, count + 1)
+        return None
+
+    def usage(self, key: str, limit: int) -> Tuple[int, float]:
+        """(hits left, seconds until the window resets) for a key, as of now"""
+        now = time.time()
+        start, count = self._current(key, now)
+        return max(limit - count, 0), start + self.window_seconds - now
+
+    def reset(self):
+        self._windows.clear()
+
+    def export_state(self) -> Dict[str, List[float]]:
+        return {key: [start, count] for key, (start, count) in self._windows.items()}
+
+    def restore_state(self, data: Dict[str, List[float]]):
+        self._windows = {key: (start, int(count)) for key, (start, count) in data.items()}
+
+
+class TokenBucketLimiter:
+    """Token buckets per id, filled lazily from the time they were last touched"""
+
+    def __init__(self):
+        self._buckets: Dict[str, Tuple[float, float]] = {}  # id -> (tokens, updated at)
+
+    def _level(self, bucket_id: str, bucket: TokenBucket, now: float) -> float:
+        tokens, updated = self._buckets.get(bucket_id, (bucket.burst, now))
+        return min(bucket.burst, tokens + (now - updated) * bucket.refill_per_second)
+
+    def wait(self, bucket_id: str, bucket: TokenBucket) -> Optional[float]:
+        """Seconds until the bucket has a token to take, or None if it has one now; takes nothing"""
+        tokens = self._level(bucket_id, bucket, time.time())
+        return None if tokens >= 1 else (1 - tokens) / bucket.refill_per_second
+
+    def take(self, bucket_id: str, bucket: TokenBucket) -> Tuple[Optional[float], int, float]:
+        """
+        Take a token. Returns seconds until one is available if the bucket is empty
+        (else None), whole tokens left, and seconds until the bucket is full again.
+        """
+        now = time.time()
+        tokens = self._level(bucket_id, bucket, now)
+        wait = None
+        if tokens >= 1:
+            tokens -= 1
+        else:
+            wait = (1 - tokens) / bucket.refill_per_second
+        self._buckets[bucket_id] = (tokens, now)
+        return wait, int(tokens), (bucket.burst - tokens) / bucket.refill_per_second
+
+    def export_state(self) -> Dict[str, List[float]]:
+        return {bucket_id: [tokens, updated] for bucket_id, (tokens, updated) in self._buckets.items()}
+
+    def restore_state(self, data: Dict[str, List[float]]):
+        self._buckets = {bucket_id: (tokens, updated) for bucket_id, (tokens, updated) in data.items()}
+
+
+class FaultBoard:
+    """Faults armed through /admin/fault, checked in arming order, each dropped once fired `count` times"""
+
+    def __init__(self):
+        self.armed: List[Dict[str, Any]] = []
+
+    def arm(self, fault: Fault) -> Dict[str, Any]:
+        entry = {"id": f"fault_{uuid.uuid4().hex[:12]}", "armed_at": time.time(), "remaining": fault.count,
+                 "fault": fault}
+        self.armed.append(entry)
+        return entry
+
+    def take(self, path: str) -> Optional[Fault]:
+        """The first armed fault for a path, counting it as fired"""
+        for entry in self.armed:
+            if fnmatch.fnmatchcase(path, entry["fault"].path):
+                entry["remaining"] -= 1
+                if entry["remaining"] == 0:
+                    self.armed.remove(entry)
+                return entry["fault"]
+        return None
+
+    def disarm(self, fault_id: Optional[str] = None) -> int:
+        """Drop one armed fault (or all); how many were dropped"""
+        before = len(self.armed)
+        self.armed = [e for e in self.armed if fault_id is not None and e["id"] != fault_id]
+        return before - len(self.armed)
+
+    def snapshot(self) -> List[Dict[str, Any]]:
+        return [{"id": e["id"], "armed_at": e["armed_at"], "remaining": e["remaining"],
+                 **e["fault"].model_dump(exclude_none=True)} for e in self.armed]
+
+
+# Values longer than this are never kept for drift reports; the field is free-form
+SCHEMA_VALUE_MAX_CHARS = 64
+
+
+def json_type(value: Any) -> str:
+    if isinstance(value, bool):
+        return "boolean"
+    if isinstance(value, (int, float)):
+        return "number"
+    return {str: "string", dict: "object", list: "array", type(None): "null"}[type(value)]
+
+
+class SchemaTracker:
+    """
+    Request body fields seen per API path in this run, as dotted paths with `[]` for
+    list items (`messages[].role`), each with its JSON types and, while few and short,
+    its values; plus a baseline run to compare against
+    """
+
+    def __init__(self, baseline_path: Optional[str] = None):
+        self.current: Dict[str, Dict[str, Dict[str, Any]]] = {}
+        self.baseline: Optional[Dict[str, Any]] = None  # {"saved_at": ..., "paths": ...}
+        self.baseline_path = baseline_path
+        if baseline_path is not None and os.path.exists(baseline_path):
+            with open(baseline_path, "r", encoding="utf-8") as f:
+                self.baseline = json.load(f)
+
+    def observe(self, path: str, body: Any, max_values: int):
+        fields = self.current.setdefault(path, {})
+        present = set()
+
+        def walk(value: Any, name: str):
+            if name:
+                entry = fields.setdefault(name, {"types": [], "values": [], "requests": 0})
+                present.add(name)
+                if json_type(value) not in entry["types"]:
+                    entry["types"].append(json_type(value))
+                if entry["values"] is not None and isinstance(value, (str, bool, int, float)):
+                    if isinstance(value, str) and len(value) > SCHEMA_VALUE_MAX_CHARS:
+                        entry["values"] = None
+                    elif value not in entry["values"]:
+                        entry["values"] = entry["values"] + [value] if len(entry["values"]) < max_values else None
+            if isinstance(value, dict):
+                for key, item in value.items():
+                    walk(item, f"{name}.{key}" if name else str(key))
+            elif isinstance(value, list):
+                for item in value:
+                    walk(item, f"{name}[]")
+
+        walk(body, "")
+        for name in present:  # once per request, however often the field appears in it
+            fields[name]["requests"] += 1
+
+    def promote(self) -> Dict[str, Any]:
+        """Make this run the baseline, and start a new run"""
+        baseline = {"saved_at": time.time(), "paths": self.current}
+        if self.baseline_path is not None:
+            with open(self.baseline_path, "w", encoding="utf-8") as f:
+                json.dump(baseline, f, indent=2)
+        self.baseline, self.current = baseline, {}
+        return baseline
+
+    def drift(self) -> Dict[str, Any]:
+        """Per path: fields and values this run added or stopped sending, and fields whose type changed"""
+        base = (self.baseline or {}).get("paths", {})
+        report = {}
+        for path in sorted(set(base) | set(self.current)):
+            before, now = base.get(path, {}), self.current.get(path, {})
+            changes = {
+                "added_fields": sorted(set(now) - set(before)),
+                "removed_fields": sorted(set(before) - set(now)),
+                "changed_types": {name: {"baseline": before[name]["types"], "current": now[name]["types"]}
+                                  for name in sorted(set(before) & set(now))
+                                  if set(before[name]["types"]) != set(now[name]["types"])},
+                "new_values": {}, "missing_values": {},
+            }
+            for name in sorted(set(before) & set(now)):
+                if before[name]["values"] is None or now[name]["values"] is None:
+                    continue
+                added = [v for v in now[name]["values"] if v not in before[name]["values"]]
+                gone = [v for v in before[name]["values"] if v not in now[name]["values"]]
+                if added:
+                    changes["new_values"][name] = added
+                if gone:
+                    changes["missing_values"][name] = gone
+            if any(changes.values()):
+                report[path] = changes
+        return {"baseline_saved_at": (self.baseline or {}).get("saved_at"), "drift": bool(report), "paths": report}
+
+
+class ResponseCache:
+    """Responses stored by cache key (see cache_key) for response_cache, oldest first"""
+
+    def __init__(self):
+        self.entries: "OrderedDict[str, Dict[str, Any]]" = OrderedDict()
+
+    def get(self, key: str) -> Optional[Dict[str, Any]]:
+        """A stored response younger than ttl_seconds, else None"""
+        entry = self.entries.get(key)
+        if entry is not None and time.time() - entry["stored_at"] >= config.response_cache.ttl_seconds:
+            del self.entries[key]
+            entry = None
+        return entry
+
+    def put(self, key: str, status: int, headers: Dict[str, str], chunks: List[bytes], stream: bool):
+        self.entries.pop(key, None)
+        self.entries[key] = {"stored_at": time.time(), "status": status, "headers": headers,
+                             "chunks": chunks, "stream": stream}
+        while len(self.entries) > config.response_cache.max_entries:
+            self.entries.popitem(last=False)
+
+    def clear(self) -> int:
+        count = len(self.entries)
+        self.entries.clear()
+        return count
+
+
+class StreamAborts:
+    """In-flight chat streams by completion id, with the chunks each has sent and any abort requested for it"""
+
+    def __init__(self, size: int = 1000):
+        self.live: Dict[str, Dict[str, Any]] = {}
+        self.size = size
+        self.cut: "OrderedDict[str, None]" = OrderedDict()  # the last `size` streams an abort ended
+
+    def start(self, stream_id: str, model: str):
+        self.live[stream_id] = {"model": model, "started_at": time.time(), "chunks": 0, "abort": None}
+
+    def finish(self, stream_id: str):
+        self.live.pop(stream_id, None)
+
+    def request(self, stream_id: str, abort: StreamAbort) -> bool:
+        """Ask a stream to end; False if no such stream is in flight"""
+        entry = self.live.get(stream_id)
+        if entry is None:
+            return False
+        entry["abort"] = abort
+        return True
+
+    def step(self, stream_id: str) -> Optional[StreamAbort]:
+        """The abort due before the stream's next chunk, else None and the chunk is counted"""
+        entry = self.live.get(stream_id)
+        if entry is None:
+            return None
+        abort = entry["abort"]
+        if abort is not None and (abort.after_chunks is None or entry["chunks"] >= abort.after_chunks):
+            self.cut[stream_id] = None
+            while len(self.cut) > self.size:
+                self.cut.popitem(last=False)
+            return abort
+        entry["chunks"] += 1
+        return None
+
+    def was_cut(self, stream_id: Optional[str]) -> bool:
+        return stream_id in self.cut
+
+    def snapshot(self) -> List[Dict[str, Any]]:
+        return [{"id": stream_id, "model": e["model"], "started_at": e["started_at"], "chunks": e["chunks"],
+                 "abort": e["abort"].model_dump(exclude_none=True) if e["abort"] is not None else None}
+                for stream_id, e in self.live.items()]
+
+
+class SeededRandom:
+    """
+    Random generators for requests of seeded scenarios. Each request gets its own,
+    seeded from the scenario's seed, the request's fingerprint and how often that
+    request was seen before, so a run repeats even when its requests overlap, and
+    a retry is rolled afresh
+    """
+
+    def __init__(self, size: int = 100000):
+        self.size = size
+        self.seen: "OrderedDict[Tuple[str, str], int]" = OrderedDict()
+
+    def for_request(self, scenario: str, seed: int, fingerprint: str) -> random.Random:
+        key = (scenario, fingerprint)
+        count = self.seen.pop(key, 0)
+        self.seen[key] = count + 1
+        while len(self.seen) > self.size:
+            self.seen.popitem(last=False)
+        return random.Random(f"{seed}:{scenario}:{fingerprint}:{count}")
+
+    def reset(self, scenario: Optional[str] = None):
+        """Start a scenario's runs (or every one's) over from their first request"""
+        for key in [key for key in self.seen if scenario is None or key[0] == scenario]:
+            del self.seen[key]
+
+
+# The current request's generator when its scenario is seeded; otherwise the random module's
+request_random: ContextVar[Optional[random.Random]] = ContextVar("request_random", default=None)
+
+
+def rng() -> Any:
+    """Source of a request's randomness: errors, variants, generated text, noise and corruption"""
+    return request_random.get() or random
+
+
+# Spells an outage timeline replays one by one when catching up; after a longer idle gap it jumps ahead
+OUTAGE_CATCH_UP_SPELLS = 100
+
+
+class OutageSchedule:
+    """Independent up/down timelines for the configured dependencies, advanced lazily"""
+
+    def __init__(self):
+        self._timelines: Dict[str, Tuple[bool, float]] = {}  # name -> (down, until)
+        self.outages: Dict[str, int] = {}
+
+    def down(self, name: str, dependency: DependencyOutage) -> bool:
+        """Whether the dependency is in an outage now"""
+        now = time.monotonic()
+        if name not in self._timelines:
+            self._timelines[name] = (False, now + rng().expovariate(1 / dependency.mean_uptime_seconds))
+        down, until = self._timelines[name]
+        for _ in range(OUTAGE_CATCH_UP_SPELLS):
+            if until > now:
+                break
+            down = not down
+            mean = dependency.mean_outage_seconds if down else dependency.mean_uptime_seconds
+            until += rng().expovariate(1 / mean)
+            if down:
+                self.outages[name] = self.outages.get(name, 0) + 1
+        else:
+            if until <= now:
+                down, until = self._jump(name, dependency, now - until, now)
+        self._timelines[name] = (down, until)
+        return down
+
+    def _jump(self, name: str, dependency: DependencyOutage, gap: float, now: float) -> Tuple[bool, float]:
+        """
+        The state after an idle gap too long to replay: spells are memoryless, so the
+        phase is drawn from the long-run share of downtime and the outages missed are
+        counted at the long-run rate
+        """
+        cycle = dependency.mean_uptime_seconds + dependency.mean_outage_seconds
+        down = rng().random() < dependency.mean_outage_seconds / cycle
+        missed = int(gap / cycle) + (1 if down else 0)
+        self.outages[name] = self.outages.get(name, 0) + missed
+        mean = dependency.mean_outage_seconds if down else dependency.mean_uptime_seconds
+        return down, now + rng().expovariate(1 / mean)
+
+    def failing(self, path: str) -> Optional[Tuple[str, DependencyOutage]]:
+        """The first dependency that fails a request on this path right now, if any"""
+        for name, dependency in config.dependencies.items():
+            covered = path.startswith(tuple(dependency.paths)) if dependency.paths else is_api_path(path)
+            if covered and self.down(name, dependency) and rng().random() < dependency.failure_rate:
+                return name, dependency
+        return None
+
+    def snapshot(self) -> Dict[str, Dict[str, Any]]:
+        return {
+            name: {"down": self.down(name, dependency), "outages": self.outages.get(name, 0)}
+            for name, dependency in config.dependencies.items()
+        }
+
+
+# Idle time after which /admin/requests/stream sends a comment, so proxies keep the connection open
+CAPTURE_KEEPALIVE_SECONDS = 15.0
+
+
+class RequestCapture:
+    """Ring buffer of recent API requests (summary plus parsed body) for inspection, and live followers"""
+
+    def __init__(self, size: int = 1000):
+        self.entries: deque = deque(maxlen=size)
+        self.followers: List[asyncio.Queue] = []
+
+    def record(self, entry: Dict[str, Any]):
+        self.entries.append(entry)
+        for queue in self.followers:
+            if not queue.full():  # a follower this far behind misses entries rather than holding memory
+                queue.put_nowait(entry)
+
+    async def follow(self) -> AsyncIterator[Optional[Dict[str, Any]]]:
+        """Entries as they are recorded, with None after every `CAPTURE_KEEPALIVE_SECONDS` of quiet"""
+        queue: asyncio.Queue = asyncio.Queue(maxsize=1000)
+        self.followers.append(queue)
+        try:
+            while True:
+                try:
+                    yield await asyncio.wait_for(queue.get(), CAPTURE_KEEPALIVE_SECONDS)
+                except asyncio.TimeoutError:
+                    yield None
+        finally:
+            self.followers.remove(queue)
+
+    def recent(self, limit: Optional[int] = None) -> List[Dict[str, Any]]:
+        entries = list(self.entries)
+        return entries[-limit:] if limit else entries
+
+    def clear(self):
+        self.entries.clear()
+
+    def resize(self, size: int):
+        """Keep at most `size` entries from now on, dropping the oldest if there are more"""
+        if self.entries.maxlen != size:
+            self.entries = deque(self.entries, maxlen=size)
+
+
+class StreamRecording:
+    """One stream's SSE events as they are sent (index, or None for comments, and text)"""
+
+    def __init__(self):
+        self.events: List[Tuple[Optional[int], str]] = []
+        self.finished_at: Optional[float] = None
+        self._changed = asyncio.Event()
+
+    def append(self, index: Optional[int], text: str):
+        self.events.append((index, text))
+        self._notify()
+
+    def finish(self):
+        self.finished_at = time.monotonic()
+        self._notify()
+
+    def _notify(self):
+        self._changed.set()
+        self._changed = asyncio.Event()
+
+    async def tail(self, after: int = -1) -> AsyncIterator[str]:
+        """Events after index `after`, following a stream still being generated until it ends"""
+        position = 0
+        while True:
+            changed = self._changed
+            while position < len(self.events):
+                index, text = self.events[position]
+                position += 1
+                if index is None or index > after:
+                    yield text
+            if self.finished_at is not None:
+                return
+            await changed.wait()
+
+
+class StreamRecorder:
+    """
+    Recent streams by id, for Last-Event-ID replays and resumption. Finished
+    streams are dropped after `ttl_seconds` (if set) or once `size` newer ones exist
+    """
+
+    def __init__(self, size: int = 100):
+        self.size = size
+        self.streams: "OrderedDict[str, StreamRecording]" = OrderedDict()
+
+    def start(self, stream_id: str) -> StreamRecording:
+        self.prune()
+        recording = self.streams[stream_id] = StreamRecording()
+        while len(self.streams) > self.size:
+            self.streams.popitem(last=False)
+        return recording
+
+    def get(self, stream_id: str) -> Optional[StreamRecording]:
+        self.prune()
+        return self.streams.get(stream_id)
+
+    def after(self, last_event_id: str) -> Optional[AsyncIterator[str]]:
+        """Events after the one with this id (`<stream id>:<n>`), or None if unknown"""
+        stream_id, _, index = last_event_id.strip().rpartition(":")
+        recording = self.get(stream_id)
+        if recording is None or not index.isdigit():
+            return None
+        return recording.tail(int(index))
+
+    def prune(self):
+        resume = config.stream_resume
+        if not resume.enabled:
+            return
+        expired = time.monotonic() - resume.ttl_seconds
+        for stream_id in [sid for sid, r in self.streams.items()
+                          if r.finished_at is not None and r.finished_at < expired]:
+            del self.streams[stream_id]
+
+
+class StreamRetryTracker:
+    """
+    Failed attempts per request key for stream_retry rules. A key is forgotten once
+    its request is served in full, so the next run of the same request fails again
+    """
+
+    def __init__(self, size: int = 10000):
+        self.size = size
+        self.failed: "OrderedDict[str, int]" = OrderedDict()
+
+    def should_fail(self, key: str, failures: int) -> bool:
+        """Whether this attempt fails, counting it if so"""
+        count = self.failed.pop(key, 0)
+        if count >= failures:
+            return False
+        self.failed[key] = count + 1
+        while len(self.failed) > self.size:
+            self.failed.popitem(last=False)
+        return True
+
+
+FIXTURE_HASH_DIMENSIONS = 1024
+
+
+def normalize_prompt(text: str) -> str:
+    """Lowercase, punctuation dropped, whitespace collapsed"""
+    return " ".join(re.sub(r"[^\w\s]", " ", text.lower()).split())
+
+
+def hash_embedding(text: str) -> Dict[int, float]:
+    """Sparse unit vector of hashed words and word bigrams; similar prompts get close vectors"""
+    words = normalize_prompt(text).split()
+    features = words + [f"{a} {b}" for a, b in zip(words, words[1:])]
+    vector: Dict[int, float] = {}
+    for feature in features:
+        bucket = int(hashlib.md5(feature.encode("utf-8")).hexdigest()[:8], 16) % FIXTURE_HASH_DIMENSIONS
+        vector[bucket] = vector.get(bucket, 0.0) + 1.0
+    norm = math.sqrt(sum(v * v for v in vector.values())) or 1.0
+    return {k: v / norm for k, v in vector.items()}
+
+
+class FixtureStore:
+    """Prompt -> response pairs loaded from JSONL fixture files"""
+
+    def __init__(self):
+        self.prompts: List[str] = []
+        self.responses: List[str] = []
+        self.sources: List[str] = []
+        self.exact: Dict[str, int] = {}
+        self.normalized: Dict[str, int] = {}
+        self.embeddings: List[Dict[int, float]] = []
+
+    @classmethod
+    def from_files(cls, paths: List[str]) -> "FixtureStore":
+        """Each line is {"prompt": ..., "response": ...} or a fine-tuning {"messages": [...]} example"""
+        store = cls()
+        for path in paths:
+            with open(path, "r", encoding="utf-8") as f:
+                for number, line in enumerate(f, 1):
+                    if not line.strip():
+                        continue
+                    try:
+                        pair = fixture_pair(json.loads(line))
+                    except ValueError as e:
+                        raise ValueError(f"{path}:{number}: {e}")
+                    if pair is not None:
+                        store.add(pair[0], pair[1], f"{path}:{number}")
+        return store
+
+    def add(self, prompt: str, response: str, source: str):
+        index = len(self.prompts)
+        self.prompts.append(prompt)
+        self.responses.append(response)
+        self.sources.append(source)
+        self.exact.setdefault(prompt, index)  # the first fixture for a prompt wins
+        self.normalized.setdefault(normalize_prompt(prompt), index)
+        self.embeddings.append(hash_embedding(prompt))
+
+    def __len__(self) -> int:
+        return len(self.prompts)
+
+    def find(self, prompt: str, match: str = "normalized", min_similarity: float = 0.5) -> Optional[int]:
+        """Index of the fixture answering `prompt`, trying exact, then normalized, then hash matching"""
+        if prompt in self.exact:
+            return self.exact[prompt]
+        if match == "exact":
+            return None
+        normalized = self.normalized.get(normalize_prompt(prompt))
+        if normalized is not None or match == "normalized":
+            return normalized
+        query = hash_embedding(prompt)
+        best, best_score = None, min_similarity
+        for index, embedding in enumerate(self.embeddings):
+            score = sum(v * embedding.get(k, 0.0) for k, v in query.items())
+            if score >= best_score and (best is None or score > best_score):
+                best, best_score = index, score
+        return best
+
+
+def fixture_pair(data: Any) -> Optional[Tuple[str, str]]:
+    """(prompt, response) from one fixture line; None for conversations without a text reply"""
+    if not isinstance(data, dict):
+        raise ValueError("expected a JSON object")
+    if "prompt" in data or "response" in data:
+        if not isinstance(data.get("prompt"), str) or not isinstance(data.get("response"), str):
+            raise ValueError("'prompt' and 'response' must both be strings")
+        return data["prompt"], data["response"]
+    messages = data.get("messages")
+    if not isinstance(messages, list):
+        raise ValueError("expected 'prompt'/'response' or a 'messages' list")
+    # Pair the final assistant reply with the user turn before it
+    for i in range(len(messages) - 1, 0, -1):
+        if isinstance(messages[i], dict) and messages[i].get("role") == "assistant":
+            prompts = [m for m in messages[:i] if isinstance(m, dict) and m.get("role") == "user"]
+            reply = messages[i].get("content")
+            if prompts and isinstance(prompts[-1].get("content"), str) and isinstance(reply, str):
+                return prompts[-1]["content"], reply
+            return None
+    return None
+
+
+TRANSCRIPTS_DIR = os.path.join(os.path.dirname(os.path.abspath(__file__)), "transcripts")
+
+# Recomputed by the server for the bytes actually sent, or added by it anyway
+TRANSCRIPT_SKIPPED_HEADERS = {"content-length", "transfer-encoding", "content-encoding", "connection", "date",
+                              "server", "set-cookie"}
+
+
+class Transcript(BaseModel):
+    """One recorded exchange: what the request looked like and the provider's response"""
+    name: str = ""  # provider/feature, from the file's place under the transcripts directory
+    description: str = ""
+    recorded: Optional[str] = None
+    by_name_only: bool = False  # only served when requested through the transcript header
+    request: Dict[str, Any]  # method, path (glob), optional stream and tools flags, and the body for reference
+    # status, headers, then body (JSON or text) or chunks (raw SSE text, in order); timing as recorded
+    # in duration_ms (body) or offsets_ms (ms after the request at which each chunk arrived)
+    response: Dict[str, Any]
+
+    @model_validator(mode="after")
+    def check_shape(self):
+        if not isinstance(self.request.get("path"), str):
+            raise ValueError("request.path must be a string")
+        if ("body" in self.response) == ("chunks" in self.response):
+            raise ValueError("response needs exactly one of 'body' or 'chunks'")
+        if "chunks" in self.response and not all(isinstance(c, str) for c in self.response["chunks"]):
+            raise ValueError("response.chunks must be strings")
+        offsets = self.response.get("offsets_ms")
+        if offsets is not None and (
+                len(offsets) != len(self.response.get("chunks", []))
+                or any(not isinstance(at, (int, float)) for at in offsets)
+                or any(b < a for a, b in zip(offsets, offsets[1:]))):
+            raise ValueError("response.offsets_ms needs one non-decreasing time per chunk")
+        return self
+
+    def matches(self, method: str, path: str, body: Dict[str, Any]) -> bool:
+        if self.request.get("method", "POST").upper() != method or not fnmatch.fnmatchcase(path, self.request["path"]):
+            return False
+        if "stream" in self.request and self.request["stream"] != bool(body.get("stream")):
+            return False
+        has_tools = bool(body.get("tools") or body.get("functions"))
+        return self.request.get("tools", False) == has_tools
+
+    def headers(self) -> Dict[str, str]:
+        return {k: str(v) for k, v in self.response.get("headers", {}).items()
+                if k.lower() not in TRANSCRIPT_SKIPPED_HEADERS}
+
+
+class TranscriptStore:
+    """Transcripts loaded from <dir>/<provider>/<feature>.json, by name"""
+
+    def __init__(self):
+        self.transcripts: Dict[str, Transcript] = {}
+
+    @classmethod
+    def from_config(cls, settings: TranscriptConfig) -> "TranscriptStore":
+        store = cls()
+        if not settings.enabled:
+            return store
+        root = settings.dir or TRANSCRIPTS_DIR
+        if not os.path.isdir(root):
+            raise OSError(errno.ENOENT, "no such transcripts directory", root)
+        for path in sorted(glob.glob(os.path.join(root, "*", "*.json"))):
+            name = f"{os.path.basename(os.path.dirname(path))}/{os.path.splitext(os.path.basename(path))[0]}"
+            try:
+                with open(path, "r", encoding="utf-8") as f:
+                    store.transcripts[name] = Transcript.model_validate({**json.load(f), "name": name})
+            except (ValueError, ValidationError) as e:
+                raise ValueError(f"{path}: {e}")
+        return store
+
+    def __len__(self) -> int:
+        return len(self.transcripts)
+
+    def find(self, method: str, path: str, body: Dict[str, Any]) -> Optional[Transcript]:
+        """The first transcript, by name, recorded for a request like this one"""
+        for transcript in self.transcripts.values():
+            if not transcript.by_name_only and transcript.matches(method, path, body):
+                return transcript
+        return None
+
+
+HISTORY_COLUMNS = ("id", "timestamp", "method", "path", "status", "duration_ms", "model", "user", "stream", "body",
+                   "response")
+
+
+def parse_since(value: str, now: Optional[float] = None) -> float:
+    """Epoch seconds for '90s', '15m', '1h', '2d', an epoch number or an ISO 8601 time"""
+    from datetime import datetime
+
+    now = time.time() if now is None else now
+    units = {"s": 1, "m": 60, "h": 3600, "d": 86400}
+    match = re.fullmatch(r"(\d+(?:\.\d+)?)([smhd])", value.strip())
+    if match:
+        return now - float(match.group(1)) * units[match.group(2)]
+    try:
+        return float(value)
+    except ValueError:
+        pass
+    try:
+        return datetime.fromisoformat(value.replace("Z", "+00:00")).timestamp()
+    except ValueError:
+        raise ValueError(f"invalid time '{value}', expected e.g. 30m, 1h, 2d, an epoch or an ISO 8601 time")
+
+
+class RequestHistory:
+    """Captured requests persisted to SQLite, so long soak tests keep everything"""
+
+    def __init__(self, path: str):
+        self.path = path
+        self.lock = threading.Lock()
+        self.db = sqlite3.connect(path, check_same_thread=False)
+        self.db.execute("PRAGMA journal_mode=WAL")
+        self.db.execute(
+            "CREATE TABLE IF NOT EXISTS requests (id TEXT PRIMARY KEY, timestamp REAL, method TEXT, path TEXT, "
+            "status INTEGER, duration_ms REAL, model TEXT, user TEXT, stream INTEGER, body TEXT, response TEXT)"
+        )
+        columns = [row[1] for row in self.db.execute("PRAGMA table_info(requests)")]
+        if "response" not in columns:
+            self.db.execute("ALTER TABLE requests ADD COLUMN response TEXT")
+        for column in ("timestamp", "model", "status"):
+            self.db.execute(f"CREATE INDEX IF NOT EXISTS requests_{column} ON requests({column})")
+        self.db.commit()
+
+    def record(self, entry: Dict[str, Any]):
+        row = [entry.get(c) for c in HISTORY_COLUMNS]
+        row[-3] = int(bool(row[-3]))
+        for i in (-2, -1):
+            row[i] = json.dumps(row[i], ensure_ascii=False) if row[i] is not None else None
+        with self.lock:
+            self.db.execute(f"INSERT OR REPLACE INTO requests VALUES ({', '.join('?' * len(row))})", row)
+            self.db.commit()
+
+    def query(self, model: Optional[str] = None, status: Optional[int] = None, path: Optional[str] = None,
+              user: Optional[str] = None, since: Optional[float] = None, until: Optional[float] = None,
+              limit: Optional[int] = 100) -> List[Dict[str, Any]]:
+        """Matching requests, oldest first (the most recent `limit` of them)"""
+        filters = [("model = ?", model), ("status = ?", status), ("path = ?", path), ("user = ?", user),
+                   ("timestamp >= ?", since), ("timestamp < ?", until)]
+        where = [clause for clause, value in filters if value is not None]
+        params: List[Any] = [value for _, value in filters if value is not None]
+        sql = "SELECT * FROM requests" + (" WHERE " + " AND ".join(where) if where else "")
+        sql += " ORDER BY timestamp DESC"
+        if limit:
+            sql += " LIMIT ?"
+            params.append(limit)
+        with self.lock:
+            rows = self.db.execute(sql, params).fetchall()
+        entries = []
+        for row in reversed(rows):
+            entry = dict(zip(HISTORY_COLUMNS, row))
+            entry["stream"] = bool(entry["stream"])
+            for key in ("body", "response"):
+                entry[key] = json.loads(entry[key]) if entry[key] is not None else None
+            entries.append(entry)
+        return entries
+
+    def count(self) -> int:
+        with self.lock:
+            return self.db.execute("SELECT COUNT(*) FROM requests").fetchone()[0]
+
+
+def finetune_examples(entries: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+    """OpenAI fine-tuning examples (`messages`, plus `tools`/`functions` when sent) from captured chat requests.
+
+    Only successful chat completions that recorded the assistant reply are converted.
+    """
+    examples = []
+    for entry in entries:
+        body, reply = entry.get("body"), entry.get("response")
+        if entry.get("path") != "/v1/chat/completions" or entry.get("status") != 200 or not body or not reply:
+            continue
+        example: Dict[str, Any] = {"messages": body["messages"] + [reply]}
+        for key in ("tools", "functions"):
+            if body.get(key):
+                example[key] = body[key]
+        examples.append(example)
+    return examples
+
+
+class MarkovChain:
+    """Word-level Markov model for domain-flavored filler text"""
+
+    def __init__(self, order: int = 2):
+        self.order = order
+        self.transitions: Dict[Tuple[str, ...], List[str]] = {}
+        self.starts: List[Tuple[str, ...]] = []
+
+    @classmethod
+    def from_files(cls, paths: List[str], order: int = 2) -> "MarkovChain":
+        chain = cls(order)
+        for path in paths:
+            with open(path, "r", encoding="utf-8") as f:
+                chain.train(f.read())
+        return chain
+
+    def train(self, text: str):
+        words = text.split()
+        for i in range(len(words) - self.order):
+            state = tuple(words[i:i + self.order])
+            self.transitions.setdefault(state, []).append(words[i + self.order])
+            if i == 0 or words[i - 1][-1:] in ".!?":
+                self.starts.append(state)
+
+    def generate(self, length: int) -> str:
+        """About `length` words, extended (briefly) to end on a sentence boundary"""
+        if not self.transitions:
+            return ""
+        state = rng().choice(self.starts or list(self.transitions))
+        words = list(state)
+        while len(words) < length + 20:
+            if len(words) >= length and words[-1][-1:] in ".!?":
+                break
+            followers = self.transitions.get(tuple(words[-self.order:]))
+            if not followers:
+                state = rng().choice(self.starts or list(self.transitions))
+                words.extend(state)
+                continue
+            words.append(rng().choice(followers))
+        return " ".join(words)
+
+
+# Loaded at import time so the config survives uvicorn's module re-import (and --reload)
+config = load_startup_config()
+markov = MarkovChain.from_files(config.markov.corpus, config.markov.order)
+fixtures = FixtureStore.from_files(config.fixtures.files)
+transcripts = TranscriptStore.from_config(config.transcripts)
+stats = SimulatorStats()
+gate = PriorityGate()
+timers = TimerWheel()
+user_limiter = FixedWindowLimiter()
+bucket_limiter = TokenBucketLimiter()
+outages = OutageSchedule()
+faults = FaultBoard()
+seeded_random = SeededRandom()
+capture = RequestCapture(config.capture_size)
+stream_recorder = StreamRecorder(config.stream_resume.max_streams if config.stream_resume.enabled else 100)
+stream_retries = StreamRetryTracker()
+stream_aborts = StreamAborts()
+response_cache = ResponseCache()
+open_streams: Dict[str, int] = {}  # hashed API key -> streams open, for rate_limits.streams
+schema_tracker = SchemaTracker(config.schema_drift.baseline)
+background_tasks: set = set()  # strong references to fire-and-forget tasks
+history = RequestHistory(config.history.path) if config.history.path else None
+
+STATE_SNAPSHOT_VERSION = 1
+
+
+def export_state() -> Dict[str, Any]:
+    """Everything needed to reproduce the simulator's current behavior elsewhere"""
+    return {
+        "version": STATE_SNAPSHOT_VERSION,
+        "exported_at": int(time.time()),
+        "config": config.model_dump(exclude={"admin"}),  # never leak the admin token
+        "stats": stats.export_state(),
+        "user_limits": user_limiter.export_state(),
+        "rate_limits": bucket_limiter.export_state(),
+        "captured_requests": capture.recent(),
+    }
+
+
+def install_config(new_config: SimulatorConfig):
+    """Make new_config the running config, loading the Markov corpus, fixtures and transcripts it names"""
+    global config, markov, fixtures, transcripts
+    try:
+        new_markov = MarkovChain.from_files(new_config.markov.corpus, new_config.markov.order)
+    except OSError as e:
+        raise ValueError(f"cannot load Markov corpus: {e}")
+    try:
+        new_fixtures = FixtureStore.from_files(new_config.fixtures.files)
+    except OSError as e:
+        raise ValueError(f"cannot load fixtures: {e}")
+    try:
+        new_transcripts = TranscriptStore.from_config(new_config.transcripts)
+    except OSError as e:
+        raise ValueError(f"cannot load transcripts: {e}")
+    config, markov, fixtures, transcripts = new_config, new_markov, new_fixtures, new_transcripts
+    capture.resize(new_config.capture_size)
+
+
+def restore_state(data: Dict[str, Any]):
+    """Replace config, counters, quota windows and captured requests from a snapshot"""
+    if data.get("version") != STATE_SNAPSHOT_VERSION:
+        raise ValueError(f"unsupported snapshot version {data.get('version')!r}, expected {STATE_SNAPSHOT_VERSION}")
+    # The admin listener belongs to the deployment, not the snapshot
+    install_config(SimulatorConfig.model_validate({**data.get("config", {}), "admin": config.admin.model_dump()}))
+    stats.restore_state(data.get("stats", {}))
+    user_limiter.restore_state(data.get("user_limits", {}))
+    bucket_limiter.restore_state(data.get("rate_limits", {}))
+    # Sized by the restored capture_size; history, not news for live followers
+    capture.entries = deque(data.get("captured_requests", []), maxlen=config.capture_size)
+
+
+def load_state_file(path: str):
+    with open(path, "r", encoding="utf-8") as f:
+        restore_state(json.load(f))
+
+
+if os.getenv("LLM_SIM_RESTORE_STATE"):
+    load_state_file(os.environ["LLM_SIM_RESTORE_STATE"])
+
+
+VERSION = "1.0.0"
+
+
+build_commit: Optional[str] = None  # resolved on first use, so importing never runs git
+
+
+def git_commit() -> str:
+    """Commit of this build: baked in by the image build, else read from a git checkout"""
+    global build_commit
+    if build_commit is None:
+        build_commit = os.getenv("LLM_SIM_GIT_COMMIT") or checkout_commit()
+    return build_commit
+
+
+def checkout_commit() -> str:
+    import subprocess
+    try:
+        out = subprocess.run(["git", "rev-parse", "--short", "HEAD"], capture_output=True, text=True, timeout=2,
+                             cwd=os.path.dirname(os.path.abspath(__file__)))
+    except (OSError, subprocess.SubprocessError):
+        return "unknown"
+    return out.stdout.strip() if out.returncode == 0 and out.stdout.strip() else "unknown"
+
+
+BUILD_DATE = os.getenv("LLM_SIM_BUILD_DATE", "unknown")
+
+
+def build_info(active: Optional["SimulatorConfig"] = None) -> Dict[str, Any]:
+    """Version, build and enabled features, for /version and `version`"""
+    active = active or config
+    return {
+        "version": VERSION,
+        "git_commit": git_commit(),
+        "build_date": BUILD_DATE,
+        "python": sys.version.split()[0],
+        "features": {
+            "dialects": list(DIALECTS),
+            "tokenizer": active.tokenizer,
+            "generator": active.generator or "echo",
+            "strict": active.strict,
+            "rules": len(active.rules),
+            "separate_admin_port": active.admin.port is not None,
+            "debug_endpoints": active.admin.debug,
+            "transcripts": active.transcripts.enabled,
+        },
+    }
+
+
+def version_line() -> str:
+    return f"llm-simulator {VERSION} (commit {git_commit()}, built {BUILD_DATE})"
+
+
+# Create FastAPI app
+app = FastAPI(
+    title="LLM Behavior Simulator",
+    description="A minimal OpenAI-compatible API server for testing AI gateways",
+    version=VERSION
+)
+
+# Control-plane endpoints, served by `app` or, with `admin.port`, by `admin_app` alone
+admin_router = APIRouter()
+admin_app = FastAPI(
+    title="LLM Behavior Simulator admin",
+    description="Stats, captured requests and state snapshots for the simulator",
+    version=VERSION
+)
+
+
+# Available models
+AVAILABLE_MODELS = [
+    "gpt-3.5-turbo",
+    "gpt-4",
+    "gpt-4-turbo",
+    "gpt-4o",
+    "gpt-4o-mini",
+]
+
+
+def available_models() -> List[str]:
+    """
+    Built-in models plus extra ones declared under `models` (claude* and gemini*
+    ones are served by the Anthropic and Gemini APIs instead)
+    """
+    return AVAILABLE_MODELS + [m for m in config.models
+                               if m not in AVAILABLE_MODELS and not m.startswith(("claude", "gemini"))]
+
+
+def generate_response_text(messages: List[Message], model: str, language: str = "en") -> str:
+    """
+    Generate a simple response based on the input messages.
+    This is a minimal simulator, so we just echo back information about the request.
+    """
+    last_message = message_text(messages[-1]) if messages else "No message"
+    truncated_message = last_message[:50]
+    ellipsis = "..." if len(last_message) > 50 else ""
+    if messages and messages[-1].role == "tool":
+        return (f"[Simulator Response] Model: {model}, Tool result received for call "
+                f"{messages[-1].tool_call_id}: '{truncated_message}{ellipsis}'")
+    if messages and messages[-1].role == "function":
+        return (f"[Simulator Response] Model: {model}, Function result received from "
+                f"{messages[-1].name}: '{truncated_message}{ellipsis}'")
+    template = ECHO_TEMPLATES.get(language, ECHO_TEMPLATES["en"])
+    response = template.format(model=model, message=f"{truncated_message}{ellipsis}")
+    return response
+
+
+def detect_language(text: str) -> str:
+    """Guess the language of a message from its script, falling back to common words (default 'en')"""
+    for language, pattern in LANGUAGE_SCRIPTS:
+        if pattern.search(text):
+            return language
+    words = set(re.findall(r"\w+", text.lower()))
+    best, best_hits = "en", 0
+    for language, vocabulary in LANGUAGE_WORDS.items():
+        hits = len(words & vocabulary)
+        if hits > best_hits:
+            best, best_hits = language, hits
+    return best
+
+
+def generate_profile_text(profile: str, sentences: int = 3) -> str:
+    """Build a response from random sentences of a generator profile (or the Markov model)"""
+    if profile == "markov":
+        return markov.generate(config.markov.length)
+    if profile == "sequence":
+        return " ".join(f"w{i}" for i in range(1, config.watermark.length + 1))
+    pool = GENERATOR_PROFILES[profile]
+    joiner = "" if profile in ("chinese", "japanese") else " "
+    return joiner.join(rng().choice(pool) for _ in range(sentences))
+
+
+def last_user_content(messages: List[Message]) -> str:
+    """Content of the most recent user message, or empty string"""
+    for msg in reversed(messages):
+        if msg.role == "user":
+            return message_text(msg)
+    return ""
+
+
+def rule_matches(rule: ResponseRule, request: ChatCompletionRequest) -> bool:
+    """Check whether all of a rule's match conditions hold for the request"""
+    m = rule.match
+    if m.model is not None and m.model != request.model:
+        return False
+    if m.last_role is not None and (not request.messages or request.messages[-1].role != m.last_role):
+        return False
+    if m.response_format is not None and (request.response_format or {}).get("type", "text") != m.response_format:
+        return False
+    text = last_user_content(request.messages)
+    if m.contains is not None and m.contains.lower() not in text.lower():
+        return False
+    if m.regex is not None and not re.search(m.regex, text):
+        return False
+    return True
+
+
+def pick_variant(variants: List[ResponseVariant]) -> ResponseVariant:
+    """Pick a variant with probability proportional to its percentage"""
+    roll = rng().uniform(0, 100)
+    cumulative = 0.0
+    for variant in variants:
+        cumulative += variant.percent
+        if roll < cumulative:
+            return variant
+    return variants[-1]
+
+
+class PlannedFunctionCall(BaseModel):
+    """A function the simulated model decided to call instead of answering"""
+    id: str
+    name: str
+    arguments: str
+    legacy: bool = False  # answer with `function_call` instead of `tool_calls`
+
+    def tool_call(self) -> Dict[str, Any]:
+        return {"id": self.id, "type": "function", "function": {"name": self.name, "arguments": self.arguments}}
+
+
+class ResolvedResponse(BaseModel):
+    """Outcome of rule matching for one request"""
+    content: str
+    rule: Optional[ResponseRule] = None
+    variant: Optional[str] = None
+    finish_reason: str = "stop"
+    function_call: Optional[PlannedFunctionCall] = None
+    fixture: Optional[str] = None  # file:line of the fixture that answered
+    pinned: bool = False  # the model's configured response, which rules, tools and noise never change
+    stop_sequence: Optional[str] = None  # the request's stop sequence the content was cut at
+    scenario: str = "default"  # latency stats label: x-sim-scenario, else the rule's name
+    others: List["ResolvedResponse"] = []  # choices 1 to n-1 when the request asks for n > 1
+
+    @property
+    def choices(self) -> List["ResolvedResponse"]:
+        return [self, *self.others]
+
+    @property
+    def stream_corruption(self) -> StreamCorruption:
+        if self.rule is not None and self.rule.stream_corruption is not None:
+            return self.rule.stream_corruption
+        return config.stream_corruption
+
+    @property
+    def latency(self) -> LatencyConfig:
+        """The global latency, with the fields the rule sets replaced"""
+        if self.rule is None or self.rule.latency is None:
+            return config.latency
+        own = self.rule.latency
+        return config.latency.model_copy(update={name: getattr(own, name) for name in own.model_fields_set})
+
+    @property
+    def headers(self) -> Dict[str, str]:
+        """Extra response headers: global ones, overridden by the rule's"""
+        if self.rule is None:
+            return dict(config.headers)
+        return {**config.headers, **self.rule.headers}
+
+    @property
+    def post_processing(self) -> PostProcessing:
+        if self.rule is not None and self.rule.post_processing is not None:
+            return self.rule.post_processing
+        return config.post_processing
+
+    def decorate(self, body: Dict[str, Any]) -> Dict[str, Any]:
+        """A response body with the post-processing fields merged in"""
+        return {**body, **self.post_processing.fields}
+
+
+def sim_controls(http_request: Request) -> Dict[str, str]:
+    """Per-request simulator controls from `x-sim-*` headers, keyed without the prefix"""
+    return {
+        name[len("x-sim-"):]: value
+        for name, value in http_request.headers.items()
+        if name.lower().startswith("x-sim-")
+    }
+
+
+def finish_reason_error(dialect: str, controls: Dict[str, str]) -> Optional[JSONResponse]:
+    """The 400 for an unknown x-sim-finish-reason control, in the dialect's schema, else None"""
+    forced = controls.get("finish-reason")
+    if forced is None or forced in FINISH_REASONS:
+        return None
+    return provider_error(dialect, 400,
+                          f"Invalid x-sim-finish-reason '{forced}'. Valid values: {list(FINISH_REASONS)}",
+                          param="x-sim-finish-reason", code="invalid_value")
+
+
+# Neighbouring keys on a QWERTY keyboard, for realistic typos
+KEYBOARD_NEIGHBOURS = {
+    "q": "wa", "w": "qes", "e": "wrd", "r": "etf", "t": "ryg", "y": "tuh", "u": "yij", "i": "uok",
+    "o": "ipl", "p": "ol", "a": "qsz", "s": "awdx", "d": "sefc", "f": "drgv", "g": "fthb",
+    "h": "gyjn", "j": "hukm", "k": "jil", "l": "kop", "z": "asx", "x": "zsdc", "c": "xdfv",
+    "v": "cfgb", "b": "vghn", "n": "bhjm", "m": "njk",
+}
+
+
+def add_noise(text: str, noise: NoiseConfig) -> str:
+    """Inject typos, swapped characters and dropped words into text"""
+    if noise.rate <= 0:
+        return text
+    parts = re.split(r"(\s+)", text)
+    out: List[str] = []
+    for part in parts:
+        if not part or part.isspace() or rng().random() >= noise.rate:
+            out.append(part)
+            continue
+        kind = rng().choice(noise.kinds)
+        chars = split_graphemes(part)
+        if kind == "drop":
+            if out and out[-1].isspace():
+                out.pop()  # avoid leaving a double space behind
+            continue
+        if kind == "typo":
+            positions = [i for i, ch in enumerate(chars) if ch.lower() in KEYBOARD_NEIGHBOURS]
+            if positions:
+                i = rng().choice(positions)
+                typo = rng().choice(KEYBOARD_NEIGHBOURS[chars[i].lower()])
+                chars[i] = typo.upper() if chars[i].isupper() else typo
+                out.append("".join(chars))
+                continue
+            kind = "swap"  # no letters to mistype, fall back to swapping
+        if kind == "swap" and len(chars) >= 2:
+            i = rng().randrange(len(chars) - 1)
+            chars[i], chars[i + 1] = chars[i + 1], chars[i]
+        out.append("".join(chars))
+    return "".join(out)
+
+
+# A watermark marker, bare (w12) or tagging a word (w12:word)
+WATERMARK_MARKER = re.compile(r"(?<!\S)w(\d+)(?=:|\s|$)")
+
+
+def add_watermark(text: str) -> str:
+    """Tag each word of text with its position, w1:, w2:, ..."""
+    parts = re.split(r"(\s+)", text)
+    count = 0
+    for i, part in enumerate(parts):
+        if part and not part.isspace():
+            count += 1
+            parts[i] = f"w{count}:{part}"
+    return "".join(parts)
+
+
+def verify_watermark(text: str, expected: Optional[int] = None) -> Dict[str, Any]:
+    """
+    Check reassembled text's markers: which positions are missing (up to `expected`,
+    else the highest seen), duplicated, or arrived after a later one
+    """
+    numbers = [int(m.group(1)) for m in WATERMARK_MARKER.finditer(text)]
+    seen, duplicated = set(), set()
+    for n in numbers:
+        if n in seen:
+            duplicated.add(n)
+        seen.add(n)
+    last = max(expected or 0, max(numbers, default=0))
+    out_of_order = [n for prev, n in zip(numbers, numbers[1:]) if n < prev]
+    missing = [n for n in range(1, last + 1) if n not in seen]
+    return {
+        "ok": not (missing or duplicated or out_of_order),
+        "markers": len(numbers),
+        "expected": last,
+        "missing": missing,
+        "duplicated": sorted(duplicated),
+        "out_of_order": out_of_order,
+    }
+
+
+# Example values for JSON Schema string formats
+STRING_FORMATS = {
+    "date-time": lambda: time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime(time.time() - rng().randrange(86400 * 365))),
+    "date": lambda: time.strftime("%Y-%m-%d", time.gmtime(time.time() - rng().randrange(86400 * 365))),
+    "time": lambda: f"{rng().randrange(24):02d}:{rng().randrange(60):02d}:00",
+    "email": lambda: f"user{rng().randrange(1000)}@example.com",
+    "uri": lambda: f"https://example.com/{uuid.uuid4().hex[:8]}",
+    "url": lambda: f"https://example.com/{uuid.uuid4().hex[:8]}",
+    "hostname": lambda: f"host{rng().randrange(100)}.example.com",
+    "uuid": lambda: str(uuid.uuid4()),
+    "ipv4": lambda: f"192.0.2.{rng().randrange(1, 255)}",
+    "ipv6": lambda: f"2001:db8::{rng().randrange(1, 0xffff):x}",
+}
+
+# Nesting beyond this gets minimal values (required properties, fewest items), so recursive schemas terminate
+SCHEMA_MAX_DEPTH = 8
+
+
+def resolve_schema_ref(schema: Dict[str, Any], root: Dict[str, Any]) -> Dict[str, Any]:
+    """Follow a local `$ref` (#/$defs/..., #/definitions/...) to the schema it names"""
+    while isinstance(schema.get("$ref"), str) and schema["$ref"].startswith("#/"):
+        target: Any = root
+        for key in schema["$ref"][2:].split("/"):
+            target = target.get(key, {}) if isinstance(target, dict) else {}
+        schema = target
+    return schema
+
+
+def number_range(schema: Dict[str, Any], nudge: float) -> Tuple[float, float]:
+    """Inclusive bounds for a numeric schema; exclusive ones (draft 4 flags too) are moved in by `nudge`"""
+    low, high = schema.get("minimum"), schema.get("maximum")
+    exclusive_low, exclusive_high = schema.get("exclusiveMinimum"), schema.get("exclusiveMaximum")
+    if isinstance(exclusive_low, bool):
+        exclusive_low = low if exclusive_low else None
+    if isinstance(exclusive_high, bool):
+        exclusive_high = high if exclusive_high else None
+    if exclusive_low is not None:
+        low = max(low if low is not None else exclusive_low, exclusive_low + nudge)
+    if exclusive_high is not None:
+        high = min(high if high is not None else exclusive_high, exclusive_high - nudge)
+    if low is None:
+        low = min(0, high) if high is not None else 0
+    if high is None:
+        high = low + 100
+    return low, high
+
+
+def synthesize_value(schema: Any, root: Dict[str, Any], name: str = "value", depth: int = 0) -> Any:
+    """
+    A value that validates against a JSON Schema: required properties, enums, const,
+    formats, numeric ranges and length limits are respected. Also reads Gemini's
+    upper-case OpenAPI types. `pattern` is not.
+    """
+    if not isinstance(schema, dict):
+        return f"example {name}"
+    schema = resolve_schema_ref(schema, root)
+    if "const" in schema:
+        return schema["const"]
+    if schema.get("enum"):
+        return rng().choice(schema["enum"])
+    for combinator in ("oneOf", "anyOf"):
+        options = [option for option in schema.get(combinator, [])
+                   if resolve_schema_ref(option, root).get("type") != "null"]
+        if options:
+            return synthesize_value(options[0], root, name, depth)
+    if schema.get("allOf"):
+        merged: Dict[str, Any] = {}
+        for part in schema["allOf"]:
+            part = resolve_schema_ref(part, root)
+            merged = {**merged, **part,
+                      "properties": {**merged.get("properties", {}), **part.get("properties", {})},
+                      "required": merged.get("required", []) + part.get("required", [])}
+        return synthesize_value({**{k: v for k, v in schema.items() if k != "allOf"}, **merged}, root, name, depth)
+    kind = schema.get("type")
+    if isinstance(kind, list):
+        kind = next((k for k in kind if k != "null"), "null")
+    kind = (kind or ("object" if "properties" in schema else "string")).lower()
+    if kind == "object":
+        properties = schema.get("properties", {})
+        required = set(schema.get("required", []))
+        if depth >= 2 * SCHEMA_MAX_DEPTH:
+            return {}  # a schema requiring itself can't be satisfied at any depth
+        if depth >= SCHEMA_MAX_DEPTH:
+            properties = {key: value for key, value in properties.items() if key in required}
+        return {key: synthesize_value(value, root, key, depth + 1) for key, value in properties.items()
+                if key in required or rng().random() < 0.5}
+    if kind == "array":
+        low = schema.get("minItems", 0)
+        count = low if depth >= SCHEMA_MAX_DEPTH else min(max(low, 1), schema.get("maxItems", low + 2))
+        return [synthesize_value(schema.get("items", {}), root, name, depth + 1) for _ in range(count)]
+    if kind in ("integer", "number"):
+        low, high = number_range(schema, 1 if kind == "integer" else 0.01)
+        step = schema.get("multipleOf")
+        if kind == "integer" or step:
+            step = step or 1
+            first, last = math.ceil(low / step), math.floor(high / step)
+            value = rng().randint(first, max(first, last)) * step
+            return int(value) if kind == "integer" else value
+        return round(rng().uniform(low, high), 2)
+    if kind == "boolean":
+        return rng().random() < 0.5
+    if kind == "null":
+        return None
+    fmt = schema.get("format")
+    text = STRING_FORMATS[fmt]() if fmt in STRING_FORMATS else f"example {name}"
+    min_length, max_length = schema.get("minLength", 0), schema.get("maxLength")
+    if len(text) < min_length:
+        text += "x" * (min_length - len(text))
+    return text[:max_length] if max_length is not None else text
+
+
+def function_arguments(name: str, offered: List[Dict[str, Any]]) -> str:
+    """JSON arguments for the named function, synthesized from its declared parameters"""
+    for definition in offered:
+        function = definition.get("function") or definition
+        if function.get("name") == name:
+            schema = function.get("parameters")
+            if isinstance(schema, dict):
+                return json.dumps(synthesize_value({"type": "object", **schema}, schema))
+    return "{}"
+
+
+def chosen_function(choice: Optional[Union[str, Dict[str, Any]]], offered: List[Dict[str, Any]],
+                    call_on_auto: bool) -> Optional[str]:
+    """
+    Name of the function to call given a tool_choice/function_call value and the
+    offered definitions (each either {"name": ...} or {"function": {"name": ...}}):
+    the named one, else the first for "required" (or for "auto" and unset with
+    call_on_auto), else None
+    """
+    if choice == "none" or not offered:
+        return None
+    if isinstance(choice, dict):
+        return (choice.get("function") or choice).get("name")
+    if choice != "required" and not call_on_auto:
+        return None
+    first = offered[0]
+    return (first.get("function") or first).get("name")
+
+
+def tool_results(messages: List[Message]) -> List[Tuple[str, str, str]]:
+    """(function name, arguments, output) of the tool or function results ending the conversation"""
+    calls: Dict[Optional[str], Dict[str, Any]] = {}
+    for msg in messages:
+        for call in msg.tool_calls or []:
+            calls[call.get("id")] = call.get("function") or {}
+        if msg.function_call:
+            calls[msg.function_call.get("name")] = msg.function_call
+    results = []
+    for msg in reversed(messages):
+        if msg.role not in ("tool", "function"):
+            break
+        call = calls.get(msg.tool_call_id if msg.role == "tool" else msg.name, {})
+        results.append((call.get("name") or msg.name or "tool", call.get("arguments") or "{}", message_text(msg)))
+    return results[::-1]
+
+
+def plan_function_call(request: ChatCompletionRequest) -> Optional[PlannedFunctionCall]:
+    """
+    Call a function when the request offers tools (or legacy functions) and asks for a
+    call (see ToolCalls), unless the last message already carries a function result,
+    so agent loops can finish
+    """
+    if request.messages and request.messages[-1].role in ("tool", "function"):
+        return None
+    call_id = f"call_{uuid.uuid4().hex[:24]}"
+    auto = config.tool_calls.call_on_auto
+    name = chosen_function(request.tool_choice, request.tools or [], auto)
+    if name is not None:
+        return PlannedFunctionCall(id=call_id, name=name, arguments=function_arguments(name, request.tools or []))
+    name = chosen_function(request.function_call, request.functions or [], auto)
+    if name is not None:
+        return PlannedFunctionCall(id=call_id, name=name, arguments=function_arguments(name, request.functions or []),
+                                   legacy=True)
+    return None
+
+
+def resolve_response(request: ChatCompletionRequest, controls: Optional[Dict[str, str]] = None) -> ResolvedResponse:
+    """
+    Produce the assistant response for a request: a model's pinned response wins,
+    then the first matching rule, then a matching fixture, otherwise a function
+    call if tools are offered, otherwise the tool loop's answer to tool results or
+    the default echo response. Text is cut at the request's stop sequences and
+    max_tokens. Per-request controls override rule settings. Updates stats.
+    """
+    resolved = match_response(request)
+    if resolved.rule is None and resolved.fixture is None and not resolved.pinned:
+        resolved.function_call = plan_function_call(request)
+        if resolved.function_call is not None:
+            resolved.content = ""
+            resolved.finish_reason = "function_call" if resolved.function_call.legacy else "tool_calls"
+        elif config.tool_loop.enabled:
+            results = tool_results(request.messages)
+            if results:
+                resolved.content = config.tool_loop.render(results)
+    if not resolved.pinned:
+        noise = resolved.rule.noise if resolved.rule is not None and resolved.rule.noise is not None else config.noise
+        resolved.content = add_noise(resolved.content, noise)
+        if config.watermark.enabled or is_enabled((controls or {}).get("watermark")):
+            resolved.content = add_watermark(resolved.content)
+    if resolved.rule is not None and resolved.rule.finish_reason is not None:
+        resolved.finish_reason = resolved.rule.finish_reason
+    if resolved.function_call is None:
+        resolved.content = resolved.post_processing.apply(resolved.content)
+        stops = [request.stop] if isinstance(request.stop, str) else request.stop or []
+        resolved.content, cut, resolved.stop_sequence = truncate_output(resolved.content, stops, request.max_tokens)
+        if cut is not None:
+            resolved.finish_reason = cut
+    forced = (controls or {}).get("finish-reason")
+    if forced is not None:
+        resolved.finish_reason = forced
+    resolved.scenario = (controls or {}).get("scenario") or (resolved.rule.name if resolved.rule else "default")
+    return resolved
+
+
+def resolve_choices(request: ChatCompletionRequest, resolved: ResolvedResponse,
+                    controls: Optional[Dict[str, str]] = None) -> ResolvedResponse:
+    """
+    Fill in choices 1 to n-1 as copies of the resolved answer, then apply the rule's
+    per-choice settings by index, so choice-selection logic sees the choices differ.
+    The x-sim-finish-reason control still wins for every choice.
+    """
+    choices = [resolved]
+    for _ in range(1, request.n or 1):
+        call = resolved.function_call
+        if call is not None:
+            call = call.model_copy(update={"id": f"call_{uuid.uuid4().hex[:24]}"})
+        choices.append(resolved.model_copy(update={"function_call": call, "others": []}))
+    stops = [request.stop] if isinstance(request.stop, str) else request.stop or []
+    for choice, spec in zip(choices, resolved.rule.choices if resolved.rule is not None else []):
+        if spec.response is not None:
+            text = resolved.post_processing.apply(spec.response)
+            choice.content, cut, choice.stop_sequence = truncate_output(text, stops, request.max_tokens)
+            choice.function_call = None
+            choice.finish_reason = cut or "stop"
+        if spec.max_tokens is not None and choice.function_call is None:
+            choice.content, cut, _ = truncate_output(choice.content, [], spec.max_tokens)
+            if cut is not None:
+                choice.finish_reason, choice.stop_sequence = cut, None
+        if spec.finish_reason is not None:
+            choice.finish_reason = spec.finish_reason
+    forced = (controls or {}).get("finish-reason")
+    for choice in choices:
+        choice.finish_reason = forced or choice.finish_reason
+    resolved.others = choices[1:]
+    return resolved
+
+
+def match_response(request: ChatCompletionRequest) -> ResolvedResponse:
+    """
+    Apply the model's pinned response, else the first matching rule (or the
+    default response), and record stats
+    """
+    stats.record_request(request.model)
+    caps = config.models.get(request.model)
+    if caps is not None and caps.response is not None:
+        return ResolvedResponse(content=caps.response, pinned=True)
+    for rule in config.rules:
+        if not rule_matches(rule, request):
+            continue
+        if rule.variants:
+            variant = pick_variant(rule.variants)
+            stats.record_rule(rule.name, variant.name)
+            return ResolvedResponse(content=variant.content, rule=rule, variant=variant.name)
+        stats.record_rule(rule.name)
+        if rule.category is not None:
+            refusal = config.refusals[rule.category]
+            return ResolvedResponse(content=refusal.template.replace("{category}", rule.category),
+                                    finish_reason=refusal.finish_reason, rule=rule)
+        if rule.response is None:
+            return ResolvedResponse(content=generate_profile_text(rule.generator), rule=rule)
+        return ResolvedResponse(content=rule.response, rule=rule)
+    if len(fixtures):
+        index = fixtures.find(last_user_content(request.messages), config.fixtures.match,
+                              config.fixtures.min_similarity)
+        if index is not None:
+            stats.record_fixture(True, fixtures.sources[index])
+            return ResolvedResponse(content=fixtures.responses[index], fixture=fixtures.sources[index])
+        stats.record_fixture(False)
+    language = detect_language(last_user_content(request.messages)) if config.match_language else "en"
+    if config.generator is not None:
+        profile = LANGUAGE_PROFILES.get(language, config.generator) if config.match_language else config.generator
+        return ResolvedResponse(content=generate_profile_text(profile))
+    return ResolvedResponse(content=generate_response_text(request.messages, request.model, language))
+
+
+class ConsoleOperator:
+    """
+    Wizard-of-Oz responses: each request is shown in the terminal and the line the
+    operator types is sent back instead. One request is on screen at a time; others
+    wait their turn, and any not answered within the timeout get the configured response
+    """
+
+    def __init__(self):
+        self._lines: Optional[asyncio.Queue] = None
+        self._turn: Optional[asyncio.Lock] = None
+        self.closed = False  # stdin reached EOF; every request gets the configured response
+
+    def _start(self):
+        loop = asyncio.get_running_loop()
+        self._lines, self._turn = asyncio.Queue(), asyncio.Lock()
+
+        def read():
+            for line in sys.stdin:
+                loop.call_soon_threadsafe(self._lines.put_nowait, line.rstrip("\n"))
+            loop.call_soon_threadsafe(self._lines.put_nowait, None)
+
+        threading.Thread(target=read, name="console-operator", daemon=True).start()
+
+    async def answer(self, request: ChatCompletionRequest, resolved: ResolvedResponse,
+                     timeout: float) -> ResolvedResponse:
+        if self._lines is None:
+            self._start()
+        try:
+            typed = await asyncio.wait_for(self._prompt(request, resolved), timeout)
+        except asyncio.TimeoutError:
+            print(f"\n  (no reply within {timeout:g}s, sent the default)", flush=True)
+            return resolved
+        if not typed:
+            return resolved
+        resolved.content = typed.replace("\\n", "\n")
+        resolved.function_call = None
+        resolved.finish_reason = "stop"
+        resolved.stop_sequence = None
+        return resolved
+
+    async def _prompt(self, request: ChatCompletionRequest, resolved: ResolvedResponse) -> Optional[str]:
+        async with self._turn:
+            while not self._lines.empty():  # lines typed while no request was on screen
+                self.closed = self._lines.get_nowait() is None or self.closed
+            if self.closed:
+                return None
+            default = (f"call {resolved.function_call.name}({resolved.function_call.arguments})"
+                       if resolved.function_call is not None else resolved.content)
+            print(f"\n[{request.model}] user: {last_user_content(request.messages) or '(no user message)'}")
+            print(f"  default: {default[:300]}")
+            print("  reply (Enter sends the default, \\n for a line break): ", end="", flush=True)
+            line = await self._lines.get()
+            self.closed = line is None
+            return line
+
+
+console = ConsoleOperator()
+
+
+def active_tokenizer() -> Tokenizer:
+    return TOKENIZERS[config.tokenizer]
+
+
+def estimate_tokens(text: str) -> int:
+    """Token count of text under the configured tokenizer"""
+    return active_tokenizer().count(text)
+
+
+def truncate_output(text: str, stops: List[str],
+                    max_tokens: Optional[int]) -> Tuple[str, Optional[str], Optional[str]]:
+    """
+    Where generation of `text` ends, as OpenAI decides it: at the first stop sequence
+    completed within max_tokens, without the stop text, else after max_tokens tokens.
+    Returns the text kept, the finish reason if it was cut ("stop" or "length") and
+    the stop sequence matched. Usage then counts the kept text only.
+    """
+    data = text.encode("utf-8")
+    limit = None
+    if max_tokens is not None:
+        pieces = active_tokenizer().pieces(text)
+        if len(pieces) > max_tokens:
+            limit = sum(len(piece) for piece in pieces[:max_tokens])
+    match = None  # (end, start, stop) of the stop sequence generated first
+    for stop in stops:
+        start = data.find(stop.encode("utf-8")) if stop else -1
+        if start != -1:
+            candidate = (start + len(stop.encode("utf-8")), start, stop)
+            match = min(match, candidate) if match is not None else candidate
+    if match is not None and (limit is None or match[0] <= limit):
+        return data[:match[1]].decode("utf-8", errors="ignore"), "stop", match[2]
+    if limit is not None:
+        # A token can end inside a multi-byte character; that partial character is dropped
+        return data[:limit].decode("utf-8", errors="ignore"), "length", None
+    return text, None, None
+
+
+def iter_graphemes(text: str) -> Iterator[str]:
+    """
+    Approximate user-perceived characters: combining marks, variation selectors,
+    skin-tone modifiers, ZWJ sequences and flag pairs stay attached to their base.
+    """
+    cluster = ""
+    for ch in text:
+        code = ord(ch)
+        if cluster and (
+            unicodedata.category(ch) in ("Mn", "Me")
+            or ch in ("\u200d", "\ufe0f")
+            or 0x1F3FB <= code <= 0x1F3FF
+            or cluster.endswith("\u200d")
+            or (0x1F1E6 <= code <= 0x1F1FF and len(cluster) == 1
+                and 0x1F1E6 <= ord(cluster) <= 0x1F1FF)
+        ):
+            cluster += ch
+        else:
+            if cluster:
+                yield cluster
+            cluster = ch
+    if cluster:
+        yield cluster
+
+
+def split_graphemes(text: str) -> List[str]:
+    return list(iter_graphemes(text))
+
+
+# Wide characters (CJK, kana, hangul, most emoji) per stream chunk
+WIDE_CHARS_PER_CHUNK = 3
+
+
+def iter_stream_pieces(text: str) -> Iterator[str]:
+    """
+    Lazily split text into stream deltas that concatenate back to the exact text.
+    Space-separated scripts are split into words (keeping trailing whitespace);
+    wide-character runs are split every few graphemes, never inside a grapheme.
+    """
+    current = ""
+    wide = 0
+    for cluster in iter_graphemes(text):
+        if current and not cluster.isspace() and (current[-1].isspace() or wide >= WIDE_CHARS_PER_CHUNK):
+            yield current
+            current, wide = "", 0
+        current += cluster
+        if unicodedata.east_asian_width(cluster[0]) in ("W", "F"):
+            wide += 1
+    if current:
+        yield current
+
+
+def is_enabled(value: Optional[str]) -> bool:
+    """Interpret a header/env flag such as '1', 'true' or 'yes'"""
+    return value is not None and value.strip().lower() in ("1", "true", "yes", "on")
+
+
+def build_timings(prompt_tokens: int, completion_tokens: int, prompt_seconds: float, predicted_seconds: float) -> Timings:
+    """Timing data in llama.cpp's `timings` shape"""
+    return Timings(
+        prompt_n=prompt_tokens,
+        prompt_ms=round(prompt_seconds * 1000, 3),
+        prompt_per_second=round(prompt_tokens / prompt_seconds, 2) if prompt_seconds > 0 else 0.0,
+        predicted_n=completion_tokens,
+        predicted_ms=round(predicted_seconds * 1000, 3),
+        predicted_per_second=round(completion_tokens / predicted_seconds, 2) if predicted_seconds > 0 else 0.0,
+    )
+
+
+def debug_report(resolved: ResolvedResponse, model: str, tier_name: str, prompt_tokens: int,
+                 completion_tokens: int, delay_seconds: float) -> Dict[str, Any]:
+    """The simulator's decisions behind one response, for the x-sim-debug header and trailer"""
+    return {
+        "rule": resolved.rule.name if resolved.rule is not None else None,
+        "variant": resolved.variant,
+        "fixture": resolved.fixture,
+        "pinned": resolved.pinned,
+        "function_call": resolved.function_call.name if resolved.function_call is not None else None,
+        "finish_reason": resolved.finish_reason,
+        "service_tier": tier_name,
+        "prompt_tokens": prompt_tokens,
+        "completion_tokens": completion_tokens,
+        "cost_usd": config.pricing.cost(model, prompt_tokens, completion_tokens),  # None when unpriced
+        "delay_ms": round(delay_seconds * 1000, 3),
+    }
+
+
+def debug_trailer(report: Dict[str, Any], delay_seconds: float, newline: str = "\n") -> str:
+    """The SSE comment closing a debugged stream: the report with the stream's total delay"""
+    return f": x-sim-debug {SSE_ENCODER.encode({**report, 'delay_ms': round(delay_seconds * 1000, 3)})}{newline * 2}"
+
+
+def debug_header(report: Optional[Dict[str, Any]]) -> Dict[str, str]:
+    """x-sim-debug response header (ASCII JSON) for a report, if debugging"""
+    if report is None:
+        return {}
+    return {"x-sim-debug": json.dumps(report, separators=(",", ":"))}
+
+
+def processing_headers(processing_seconds: float) -> Dict[str, str]:
+    """
+    OpenAI's processing metadata headers. `openai-processing-ms` is the simulated
+    server time, so it never exceeds the wall-clock time a client measures.
+    """
+    return {
+        "openai-processing-ms": str(int(processing_seconds * 1000)),
+        "x-request-id": f"req_{uuid.uuid4().hex}",
+    }
+
+
+def openai_duration(seconds: float) -> str:
+    """A duration as OpenAI writes x-ratelimit-reset-* values: 20ms, 1.5s, 6m0s"""
+    if seconds < 1:
+        return f"{max(int(seconds * 1000), 1)}ms"
+    minutes, rest = divmod(round(seconds, 3), 60)
+    return f"{int(minutes)}m{rest:g}s" if minutes else f"{rest:g}s"
+
+
+def rate_limit_headers(limit: int, remaining: int, reset_seconds: float) -> Dict[str, str]:
+    """OpenAI's request rate limit headers, read from the window the request was counted in"""
+    return {
+        "x-ratelimit-limit-requests": str(limit),
+        "x-ratelimit-remaining-requests": str(remaining),
+        "x-ratelimit-reset-requests": openai_duration(reset_seconds),
+    }
+
+
+def retry_after_headers(seconds: float) -> Dict[str, str]:
+    """Retry-After rounded up, so a client sleeping that long lands in the next window, and exact in ms"""
+    return {"Retry-After": str(max(1, math.ceil(seconds))), "retry-after-ms": str(math.ceil(seconds * 1000))}
+
+
+def anthropic_rate_limit_headers(limit: int, remaining: int, reset_seconds: float) -> Dict[str, str]:
+    """Anthropic's request rate limit headers; the reset is an RFC 3339 time"""
+    reset = time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime(time.time() + math.ceil(reset_seconds)))
+    return {
+        "anthropic-ratelimit-requests-limit": str(limit),
+        "anthropic-ratelimit-requests-remaining": str(remaining),
+        "anthropic-ratelimit-requests-reset": reset,
+    }
+
+
+def check_rate_limits(http_request: Request, model: str,
+                      dialect: str = "openai") -> Tuple[Optional[JSONResponse], Dict[str, str]]:
+    """
+    Take a token from the caller's key bucket and the model's (rate_limits), only
+    once both have one, so a request refused by one bucket doesn't drain the other.
+    Returns the 429 to send if one is empty, and the rate limit headers of the
+    bucket with fewer requests left.
+    """
+    limits = config.rate_limits
+    if getattr(http_request.state, "self_test", False):
+        return None, {}
+    key = api_key(http_request)
+    buckets = []
+    key_bucket = limits.keys.get(key) if key is not None else None
+    if key_bucket is not None or limits.per_key is not None:
+        # Hashed, so state snapshots don't carry callers' keys
+        digest = hashlib.sha256((key or "").encode()).hexdigest()[:16]
+        buckets.append((f"key:{digest}", "your API key", key_bucket or limits.per_key))
+    if model in limits.models:
+        buckets.append((f"model:{model}", f"model {model}", limits.models[model]))
+    for bucket_id, scope, bucket in buckets:
+        wait = bucket_limiter.wait(bucket_id, bucket)
+        if wait is not None:
+            return provider_error(
+                dialect, 429, f"Rate limit reached for requests on {scope}: {bucket.burst} burst, "
+                              f"{bucket.refill_per_second:g} per second. Please try again in {openai_duration(wait)}.",
+                code="rate_limit_exceeded", headers=retry_after_headers(wait)), {}
+    tightest = None
+    for bucket_id, _, bucket in buckets:
+        _, remaining, reset_seconds = bucket_limiter.take(bucket_id, bucket)
+        if tightest is None or remaining < tightest[1]:
+            tightest = (bucket.burst, remaining, reset_seconds)
+    if tightest is None:
+        return None, {}
+    if dialect == "anthropic":
+        return None, anthropic_rate_limit_headers(*tightest)
+    if dialect == "openai":
+        return None, rate_limit_headers(*tightest)
+    return None, {}
+
+
+def load_multiplier(in_flight: int) -> float:
+    """Latency multiplier for this many in-flight requests, read off latency.load_curve"""
+    curve = config.latency.load_curve
+    if not curve:
+        return 1.0
+    if in_flight <= curve[0][0]:
+        return curve[0][1]
+    for (x0, y0), (x1, y1) in zip(curve, curve[1:]):
+        if in_flight <= x1:
+            return y0 + (y1 - y0) * (in_flight - x0) / (x1 - x0)
+    return curve[-1][1]
+
+
+def region_for(request: Request) -> Optional[str]:
+    """The region answering a request: the region header's, if it names a profile, else the listener's"""
+    requested = request.headers.get(config.region.header)
+    if requested in config.region.profiles:
+        return requested
+    return config.region.name
+
+
+class DelayClock:
+    """
+    The delays one response was configured with, and how long it actually took from
+    admission (when the clock is made) to the time `actual` is read, after its last byte
+    """
+
+    def __init__(self):
+        self.simulated = 0.0
+        self.started = time.perf_counter()
+
+    @property
+    def actual(self) -> float:
+        return time.perf_counter() - self.started
+
+    async def sleep(self, seconds: float):
+        resolution = config.latency.timer_resolution_ms
+        if resolution > 0:
+            await timers.sleep(seconds, resolution / 1000)
+        else:
+            await asyncio.sleep(seconds)
+        self.simulated += seconds
+
+
+def service_tier_for(request: ChatCompletionRequest, http_request: Request) -> Tuple[str, ServiceTier]:
+    """
+    Resolve the tier name and settings from the priority header or `service_tier`
+    field. The region's and current load's latency multipliers are folded into the tier's.
+    """
+    tiers = config.scheduling.tiers
+    name = http_request.headers.get(config.scheduling.priority_header) or request.service_tier or "default"
+    if name not in tiers:
+        name = "default"
+    tier = tiers.get(name, ServiceTier())
+    profile = config.region.profiles.get(region_for(http_request))
+    multiplier = load_multiplier(gate.active) * (profile.latency_multiplier if profile is not None else 1)
+    if multiplier != 1:
+        tier = tier.model_copy(update={"latency_multiplier": tier.latency_multiplier * multiplier})
+    return name, tier
+
+
+def prediction_tokens(request: ChatCompletionRequest, resolved: ResolvedResponse) -> Tuple[int, int]:
+    """
+    (accepted, rejected) tokens of a Predicted Outputs `prediction`: the part of it the
+    response starts with, and the rest
+    """
+    content = (request.prediction or {}).get("content")
+    predicted = anthropic_content_text(content)
+    if not predicted:
+        return 0, 0
+    shared = os.path.commonprefix([predicted, resolved.content])
+    accepted = estimate_tokens(shared) if shared else 0
+    return accepted, max(estimate_tokens(predicted) - accepted, 0)
+
+
+def openai_usage(request: ChatCompletionRequest, resolved: ResolvedResponse,
+                 prompt_tokens: int, completion_tokens: int) -> Dict[str, Any]:
+    """Chat completion usage with the nested details newer SDKs read; no audio or reasoning is simulated"""
+    accepted, rejected = prediction_tokens(request, resolved)
+    return {
+        "prompt_tokens": prompt_tokens,
+        "completion_tokens": completion_tokens,
+        "total_tokens": prompt_tokens + completion_tokens,
+        "prompt_tokens_details": {"cached_tokens": config.prompt_caching.cached(prompt_tokens), "audio_tokens": 0},
+        "completion_tokens_details": {"reasoning_tokens": 0, "audio_tokens": 0,
+                                      "accepted_prediction_tokens": accepted, "rejected_prediction_tokens": rejected},
+    }
+
+
+def anthropic_usage(prompt_tokens: int, output_tokens: int) -> Dict[str, int]:
+    """Messages usage: input_tokens excludes the prompt read from the cache, as Anthropic bills it"""
+    cached = config.prompt_caching.cached(prompt_tokens)
+    return {"input_tokens": prompt_tokens - cached, "cache_creation_input_tokens": 0,
+            "cache_read_input_tokens": cached, "output_tokens": output_tokens}
+
+
+def cost_headers(model: str, prompt_tokens: int, completion_tokens: int) -> Dict[str, str]:
+    """`x-sim-cost`, the response's simulated cost in USD, when pricing.header is on and the model is priced"""
+    cost = config.pricing.cost(model, prompt_tokens, completion_tokens) if config.pricing.header else None
+    return {} if cost is None else {"x-sim-cost": f"{cost:.6f}"}
+
+
+def message_format(model: Optional[str]) -> Optional[MessageFormat]:
+    """The chat format overhead of a model, by its longest matching name prefix"""
+    formats = {**MESSAGE_FORMATS, **config.message_formats}
+    matches = [prefix for prefix in formats if model and model.startswith(prefix)]
+    return formats[max(matches, key=len)] if matches else None
+
+
+def prompt_token_count(messages: List[Message], model: Optional[str] = None) -> int:
+    """
+    Estimated prompt tokens for a list of messages: their text, plus the model's chat
+    format overhead (see MessageFormat), where role, content and name count separately
+    """
+    fmt = message_format(model)
+    if fmt is None:
+        return estimate_tokens(" ".join([message_text(msg) for msg in messages]))
+    tokens = fmt.reply
+    for msg in messages:
+        tokens += fmt.per_message + estimate_tokens(msg.role) + estimate_tokens(message_text(msg))
+        if msg.name:
+            tokens += fmt.per_name + estimate_tokens(msg.name)
+    return tokens
+
+
+# json.dumps builds a new encoder per call whenever options are passed
+SSE_ENCODER = json.JSONEncoder(ensure_ascii=False)
+
+
+def sse_event(data: Dict[str, Any]) -> str:
+    """Format a JSON payload as an SSE data event (UTF-8, not ASCII-escaped)"""
+    return f"data: {SSE_ENCODER.encode(data)}\n\n"
+
+
+class ChunkFormatter:
+    """
+    The fixed parts of one stream's chunks, rendered once, so each event only
+    encodes its delta. Output is identical to sse_event() on the full chunk.
+    """
+
+    def __init__(self, request_id: str, created: int, model: str):
+        self.request_id = request_id
+        self.created = created
+        self.model = model
+        head = SSE_ENCODER.encode({"id": request_id, "object": "chat.completion.chunk",
+                                   "created": created, "model": model})
+        self.head = head[:-1]
+        self.prefix = self.choice_prefix(0)
+        self.suffix = ', "finish_reason": null}]}\n\n'
+
+    def choice_prefix(self, index: int) -> str:
+        return f'data: {self.head}, "choices": [{{"index": {index}, "delta": '
+
+    def chunk(self, delta: Dict[str, Any], finish_reason: Optional[str] = None, index: int = 0) -> Dict[str, Any]:
+        return {
+            "id": self.request_id,
+            "object": "chat.completion.chunk",
+            "created": self.created,
+            "model": self.model,
+            "choices": [{"index": index, "delta": delta, "finish_reason": finish_reason}],
+        }
+
+    def event(self, delta: Dict[str, Any], index: int = 0) -> str:
+        prefix = self.prefix if index == 0 else self.choice_prefix(index)
+        if len(delta) == 1 and isinstance(delta.get("content"), str):
+            # Most deltas are a text piece: escape just the string, not a whole dict
+            return prefix + '{"content": ' + encode_basestring(delta["content"]) + "}" + self.suffix
+        return prefix + SSE_ENCODER.encode(delta) + self.suffix
+
+
+# Without a delay between chunks, events are written in batches of about this many characters
+SSE_BATCH_CHARS = 16384
+
+
+class SSEBuffer:
+    """
+    Framed events waiting to be written together. Starlette sends every yield as
+    its own body message, so undelayed chunks are batched instead of sent one by one
+    """
+
+    def __init__(self, limit: int = 0):
+        self.limit = limit  # 0: every event is flushed on its own
+        self.parts: List[str] = []
+        self.size = 0
+
+    def add(self, text: str) -> bool:
+        """Buffer text; True when the buffer should be flushed"""
+        self.parts.append(text)
+        self.size += len(text)
+        return self.size >= self.limit
+
+    def flush(self) -> str:
+        out = "".join(self.parts)
+        self.parts.clear()
+        self.size = 0
+        return out
+
+
+# OpenAI-style error bodies for injected failures, by status code
+INJECTED_ERRORS = {
+    400: ("invalid_request_error", None, "Simulated bad request"),
+    404: ("invalid_request_error", "not_found", "Simulated not found"),
+    408: ("timeout", None, "Simulated request timeout"),
+    409: ("conflict", None, "Simulated conflict"),
+    429: ("requests", "rate_limit_exceeded", "Simulated rate limit reached for requests"),
+    500: ("server_error", None, "The server had an error while processing your request (simulated)"),
+    502: ("server_error", None, "Bad gateway (simulated)"),
+    503: ("server_error", "service_unavailable", "The server is overloaded or not ready yet (simulated)"),
+    504: ("server_error", None, "Gateway timeout (simulated)"),
+}
+
+
+def error_body(status: int, message: Optional[str] = None,
+               param: Optional[str] = None, code: Optional[str] = None) -> Dict[str, Any]:
+    """OpenAI-style error envelope for a status code"""
+    default_type = "invalid_request_error" if status < 500 else "server_error"
+    error_type, default_code, default_message = INJECTED_ERRORS.get(status, (default_type, None, f"Simulated error {status}"))
+    return {"error": {
+        "message": message or default_message,
+        "type": error_type,
+        "param": param,
+        "code": code or default_code,
+    }}
+
+
+# Anthropic error types per HTTP status
+ANTHROPIC_ERROR_TYPES = {
+    400: "invalid_request_error",
+    401: "authentication_error",
+    403: "permission_error",
+    404: "not_found_error",
+    413: "request_too_large",
+    429: "rate_limit_error",
+    500: "api_error",
+    529: "overloaded_error",
+}
+
+# google.rpc status names per HTTP status, with Gemini's default messages
+GEMINI_ERRORS = {
+    400: ("INVALID_ARGUMENT", "Request contains an invalid argument."),
+    401: ("UNAUTHENTICATED", "Request had invalid authentication credentials."),
+    403: ("PERMISSION_DENIED", "The caller does not have permission"),
+    404: ("NOT_FOUND", "Requested entity was not found."),
+    408: ("DEADLINE_EXCEEDED", "Request timed out."),
+    409: ("ABORTED", "The operation was aborted."),
+    429: ("RESOURCE_EXHAUSTED", "Resource has been exhausted (e.g. check quota)."),
+    500: ("INTERNAL", "An internal error has occurred. Please retry or report in "
+                      "https://developers.generativeai.google/guide/troubleshooting"),
+    502: ("UNAVAILABLE", "Bad gateway."),
+    503: ("UNAVAILABLE", "The model is overloaded. Please try again later."),
+    504: ("DEADLINE_EXCEEDED", "The request timed out. Please try again."),
+}
+
+
+def dialect_for_path(path: str) -> str:
+    """Provider whose API a path belongs to, which decides the shape of its errors"""
+    if path.startswith("/v1beta/"):
+        return "gemini"
+    if path.startswith("/v1/messages"):
+        return "anthropic"
+    return "openai"
+
+
+def dialect_for_request(request: Request) -> str:
+    """
+    Dialect of a request: the one mounted at its prefix, else by path. With
+    dialect_detection auto, paths several providers share (such as /v1/models)
+    are attributed by the SDK's headers instead
+    """
+    mounted = getattr(request.state, "dialect", None)
+    if mounted is not None:
+        return mounted
+    dialect = dialect_for_path(request.url.path)
+    if config.dialect_detection != "auto" or dialect != "openai":
+        return dialect
+    headers = request.headers
+    if "anthropic-version" in headers:
+        return "anthropic"
+    if "x-goog-api-key" in headers or "key" in request.query_params:
+        return "gemini"
+    return "openai"
+
+
+def anthropic_error_body(status: int, message: Optional[str] = None) -> Dict[str, Any]:
+    """Anthropic error envelope"""
+    error_type = ANTHROPIC_ERROR_TYPES.get(status, "api_error" if status >= 500 else "invalid_request_error")
+    default_message = "Overloaded" if status == 529 else error_body(status)["error"]["message"]
+    return {"type": "error", "error": {"type": error_type, "message": message or default_message}}
+
+
+def gemini_error_body(status: int, message: Optional[str] = None,
+                      details: Optional[List[Dict[str, Any]]] = None) -> Dict[str, Any]:
+    """Gemini (google.rpc.Status) error envelope"""
+    name, default_message = GEMINI_ERRORS.get(status, ("INTERNAL" if status >= 500 else "FAILED_PRECONDITION",
+                                                       f"Simulated error {status}"))
+    error: Dict[str, Any] = {"code": status, "message": message or default_message, "status": name}
+    if details:
+        error["details"] = details
+    return {"error": error}
+
+
+def provider_error(dialect: str, status: int, message: Optional[str] = None,
+                   param: Optional[str] = None, code: Optional[str] = None,
+                   details: Optional[List[Dict[str, Any]]] = None,
+                   headers: Optional[Dict[str, str]] = None) -> JSONResponse:
+    """
+    An error response in the given dialect's schema. `param` and `code` only exist
+    in OpenAI bodies and `details` only in Gemini ones; other dialects drop them.
+    """
+    if dialect == "anthropic":
+        body = anthropic_error_body(status, message)
+    elif dialect == "gemini":
+        body = gemini_error_body(status, message, details)
+    else:
+        body = error_body(status, message, param=param, code=code)
+    return JSONResponse(status_code=status, content=body, headers=headers)
+
+
+def validate_messages(messages: List[Message]) -> Optional[JSONResponse]:
+    """Strict-mode checks mirroring OpenAI's 400s for bad roles and orphan tool results"""
+    seen_tool_calls = set()
+    for i, msg in enumerate(messages):
+        if msg.role not in VALID_ROLES:
+            supported = ", ".join(f"'{r}'" for r in VALID_ROLES[:-1]) + f", and '{VALID_ROLES[-1]}'"
+            return JSONResponse(status_code=400, content=error_body(
+                400, f"Invalid value: '{msg.role}'. Supported values are: {supported}.",
+                param=f"messages[{i}].role", code="invalid_value"))
+        if msg.role == "assistant" and msg.tool_calls:
+            seen_tool_calls.update(call.get("id") for call in msg.tool_calls)
+        if msg.role == "tool":
+            if msg.tool_call_id is None:
+                return JSONResponse(status_code=400, content=error_body(
+                    400, f"Missing required parameter: 'messages[{i}].tool_call_id'.",
+                    param=f"messages[{i}].tool_call_id", code="missing_required_parameter"))
+            if msg.tool_call_id not in seen_tool_calls:
+                return JSONResponse(status_code=400, content=error_body(
+                    400, "Invalid parameter: messages with role 'tool' must be a response to a "
+                         "preceeding message with 'tool_calls'.",
+                    param=f"messages.[{i}].role"))
+    return None
+
+
+def check_capabilities(request: ChatCompletionRequest, dialect: str = "openai") -> Optional[JSONResponse]:
+    """Reject features the model's declared capabilities exclude, with the provider's 400s"""
+    caps = config.models.get(request.model)
+    if caps is None:
+        return None
+
+    def reject(message: str, param: str, code: Optional[str] = None) -> JSONResponse:
+        return provider_error(dialect, 400, message, param=param, code=code)
+
+    if not caps.tools:
+        for param in ("tools", "tool_choice", "functions", "function_call"):
+            if getattr(request, param) is not None:
+                return reject(f"Unsupported parameter: '{param}' is not supported with this model.",
+                              param, "unsupported_parameter")
+    if not caps.vision:
+        for i, msg in enumerate(request.messages):
+            for j, part in enumerate(msg.content if isinstance(msg.content, list) else []):
+                if part.get("type") == "image_url":
+                    return reject("Invalid content type. image_url is only supported by certain models.",
+                                  f"messages.[{i}].content.[{j}].type")
+    format_type = (request.response_format or {}).get("type", "text")
+    if not caps.json_mode and format_type != "text":
+        return reject(f"Invalid parameter: 'response_format' of type '{format_type}' is not supported "
+                      "with this model.", "response_format")
+    if caps.max_output is not None and request.max_tokens is not None and request.max_tokens > caps.max_output:
+        return reject(f"max_tokens is too large: {request.max_tokens}. This model supports at most "
+                      f"{caps.max_output} completion tokens, whereas you provided {request.max_tokens}.",
+                      "max_tokens")
+    if caps.max_context is not None:
+        prompt_tokens = prompt_token_count(request.messages, request.model)
+        requested = prompt_tokens + (request.max_tokens or 0)
+        if requested > caps.max_context:
+            if request.max_tokens:
+                detail = (f"you requested {requested} tokens ({prompt_tokens} in the messages, "
+                          f"{request.max_tokens} in the completion). Please reduce the length of the "
+                          "messages or completion.")
+            else:
+                detail = f"your messages resulted in {prompt_tokens} tokens. Please reduce the length of the messages."
+            return reject(f"This model's maximum context length is {caps.max_context} tokens. However, {detail}",
+                          "messages", "context_length_exceeded")
+    return None
+
+
+def masked_api_key(request: Request) -> str:
+    """The caller's bearer token with all but its edges hidden, as providers echo it"""
+    auth = request.headers.get("authorization", "")
+    key = auth[7:] if auth.lower().startswith("bearer ") else auth
+    if len(key) <= 8:
+        return "*" * len(key)
+    return f"{key[:3]}{'*' * (len(key) - 7)}{key[-4:]}"
+
+
+def api_key(request: Request) -> Optional[str]:
+    """The caller's API key, wherever its dialect sends it"""
+    auth = request.headers.get("authorization", "")
+    if auth.lower().startswith("bearer "):
+        return auth[7:].strip()
+    return (request.headers.get("x-api-key") or request.headers.get("api-key")
+            or request.headers.get("x-goog-api-key") or request.query_params.get("key"))
+
+
+def auth_error(request: Request) -> Optional[JSONResponse]:
+    """Roll the auth failure probabilities for an API request"""
+    path = request.url.path
+    if not is_api_path(path):
+        return None
+    dialect = dialect_for_request(request)
+    auth = config.errors.auth
+    if auth.invalid_api_key > 0 and rng().random() < auth.invalid_api_key:
+        if dialect == "gemini":
+            return provider_error(dialect, 400, "API key not valid. Please pass a valid API key.", details=[{
+                "@type": "type.googleapis.com/google.rpc.ErrorInfo",
+                "reason": "API_KEY_INVALID",
+                "domain": "googleapis.com",
+                "metadata": {"service": "generativelanguage.googleapis.com"},
+            }])
+        if dialect == "anthropic":
+            return provider_error(dialect, 401, "invalid x-api-key")
+        return provider_error(
+            dialect, 401, f"Incorrect API key provided: {masked_api_key(request)}. "
+                          "You can find your API key at https://platform.openai.com/account/api-keys.",
+            code="invalid_api_key")
+    if auth.permission_denied > 0 and rng().random() < auth.permission_denied:
+        return provider_error(dialect, 403, "You do not have permission to access this resource (simulated)",
+                              code="permission_denied")
+    return None
+
+
+def is_api_path(path: str) -> bool:
+    return path.startswith(API_PATH_PREFIXES)
+
+
+def error_injection_for(path: str) -> Optional[ErrorInjection]:
+    """Error settings for a path: an explicit endpoint entry, else the global setting for /v1/*"""
+    if path in config.errors.endpoints:
+        return config.errors.endpoints[path]
+    if is_api_path(path):
+        return config.errors
+    return None
+
+
+def answers_from_rules(path: str) -> bool:
+    """Whether the path's handler resolves its response from the rules: chat, Messages or Gemini generation"""
+    return (path in ("/v1/chat/completions", "/v1/messages", "/api/v1/chat/completions")
+            or fnmatch.fnmatchcase(path, "/openai/deployments/*/chat/completions")
+            or fnmatch.fnmatchcase(path, "/v1beta/models/*:*enerateContent"))
+
+
+def rule_error(http_request: Request, resolved: ResolvedResponse, dialect: str) -> Optional[JSONResponse]:
+    """
+    The injected error for a request once its rule is known: the rule's own `errors`,
+    else the endpoint's setting that inject_errors left to the handler
+    """
+    if getattr(http_request.state, "self_test", False):
+        return None
+    injection = resolved.rule.errors if resolved.rule is not None else None
+    if injection is None:
+        injection = getattr(http_request.state, "error_injection", None)
+    if injection is None or injection.rate <= 0 or rng().random() >= injection.rate:
+        return None
+    stats.record_injected_error(http_request.url.path, injection.status_code)
+    return injection.response(dialect)
+
+
+async def stream_retry_events(http_request: Request, resolved: ResolvedResponse, dialect: str,
+                              events: AsyncIterator[str]) -> AsyncIterator[str]:
+    """
+    A stream's events, cut partway if its rule sets stream_retry and this attempt
+    of the request is one to fail
+    """
+    retry = resolved.rule.stream_retry if resolved.rule is not None else None
+    if retry is None or getattr(http_request.state, "self_test", False):
+        return events
+    key = http_request.headers.get(retry.key_header)
+    if not key:
+        key, _ = request_fingerprint(http_request.url.path, await http_request.body())
+    failed = stream_retries.should_fail(f"{resolved.rule.name}:{key}", retry.failures)
+    stats.record_stream_retry(resolved.rule.name, failed)
+    if not failed:
+        return events
+    ending = ""
+    if retry.mode == "error":
+        body = json.loads(provider_error(dialect, retry.status).body)
+        ending = anthropic_event(body) if dialect == "anthropic" else sse_event(body)
+    separator = "\r\n\r\n" if dialect == "gemini" else "\n\n"
+    return cut_stream(events, retry.after_events, ending.replace("\n\n", separator), separator)
+
+
+async def cut_stream(events: AsyncIterator[str], after: int, ending: str, separator: str) -> AsyncIterator[str]:
+    """
+    Pass on `after` events (comments aside), then send `ending` and stop. A stream
+    with fewer events loses its last one instead, so it never arrives complete.
+    """
+    sent, held = 0, None
+    try:
+        async for text in events:
+            out = []
+            for event in text.split(separator)[:-1]:  # each yield is one or more whole events
+                if held is not None:
+                    if sent >= after:
+                        yield "".join(out) + ending
+                        return
+                    out.append(held)
+                    sent += not held.startswith(":")
+                held = event + separator
+            if out:
+                yield "".join(out)
+        yield ending
+    finally:
+        await events.aclose()
+
+
+async def transcript_chunks(chunks: List[str], due: List[float]) -> AsyncIterator[str]:
+    """Chunks at their due times, kept to schedule rather than accumulating a pause per chunk"""
+    loop = asyncio.get_running_loop()
+    started = loop.time()
+    for chunk, at in zip(chunks, due):
+        wait = started + at - loop.time()
+        if wait > 0:
+            await asyncio.sleep(wait)
+        yield chunk
+
+
+async def transcript_response(transcript: Transcript, pacing: TranscriptPacing) -> Response:
+    """The recorded response, byte for byte apart from headers the server sets itself"""
+    recorded = transcript.response
+    status, headers = recorded.get("status", 200), transcript.headers()
+    first, due = pacing.schedule(recorded)
+    if first > 0:
+        await asyncio.sleep(first)
+    if "chunks" in recorded:
+        return StreamingResponse(transcript_chunks(recorded["chunks"], due), status_code=status, headers=headers)
+    body = recorded["body"]
+    if not isinstance(body, str):
+        body = json.dumps(body, ensure_ascii=False)
+    return Response(body, status_code=status, headers=headers)
+
+
+@app.middleware("http")
+async def serve_transcripts(request: Request, call_next):
+    """With transcripts enabled, answer API requests with a recorded provider response when one fits"""
+    settings = config.transcripts
+    if not settings.enabled or not is_api_path(request.url.path):
+        return await call_next(request)
+    try:
+        body = json.loads(await request.body() or b"{}")
+    except ValueError:
+        body = {}
+    body = body if isinstance(body, dict) else {}
+    name = request.headers.get(settings.header)
+    if name is not None:
+        transcript = transcripts.transcripts.get(name)
+        if transcript is None:
+            return provider_error(dialect_for_request(request), 404,
+                                  f"No transcript named '{name}', available: {sorted(transcripts.transcripts)}",
+                                  param=settings.header, code="transcript_not_found")
+    else:
+        transcript = transcripts.find(request.method, request.url.path, body)
+        if transcript is None:
+            return await call_next(request)
+    stats.record_transcript(transcript.name)
+    request.state.capture_body = body
+    pacing = settings.scenarios.get(request.headers.get("x-sim-scenario", ""), settings)
+    return await transcript_response(transcript, pacing)
+
+
+@app.middleware("http")
+async def check_assertions(request: Request, call_next):
+    """Hold API requests to the configured assertions, rejecting violations with a descriptive 400"""
+    if not config.assertions or request.method != "POST" or not is_api_path(request.url.path) \
+            or getattr(request.state, "self_test", False):
+        return await call_next(request)
+    try:
+        body = json.loads(await request.body() or b"{}")
+    except ValueError:
+        body = {}
+    body = body if isinstance(body, dict) else {}
+    scenario = request.headers.get("x-sim-scenario")
+    for assertion in config.assertions:
+        if not assertion.applies(request.url.path, scenario, body):
+            continue
+        failed = [(check.field, failure) for check in assertion.expect
+                  for failure in [check.failure(body)] if failure is not None]
+        stats.record_assertion(assertion.name, request.url.path, [failure for _, failure in failed])
+        if failed and assertion.reject:
+            return provider_error(dialect_for_request(request), 400,
+                                  f"Request assertion '{assertion.name}' failed: "
+                                  + "; ".join(failure for _, failure in failed),
+                                  param=failed[0][0], code="request_assertion_failed")
+    return await call_next(request)
+
+
+@app.middleware("http")
+async def inject_errors(request: Request, call_next):
+    """Fail a configurable fraction of requests per endpoint before they reach the handler"""
+    if getattr(request.state, "self_test", False):
+        return await call_next(request)
+    fault = faults.take(request.url.path) if faults.armed and is_api_path(request.url.path) else None
+    if fault is not None:
+        failure = fault.response(dialect_for_request(request))
+        stats.record_injected_error(request.url.path, failure.status_code)
+        return failure
+    failure = auth_error(request)
+    if failure is not None:
+        stats.record_injected_error(request.url.path, failure.status_code)
+        return failure
+    outage = outages.failing(request.url.path)
+    if outage is not None:
+        name, dependency = outage
+        status, message = DEPENDENCY_ERRORS.get(name, (dependency.status, f"{name} unavailable (simulated)"))
+        status = dependency.status or status
+        stats.record_injected_error(request.url.path, status)
+        return provider_error(dialect_for_request(request), status, dependency.message or message,
+                              code=f"{name}_unavailable")
+    injection = error_injection_for(request.url.path)
+    if request.method == "POST" and answers_from_rules(request.url.path) \
+            and any(rule.errors is not None for rule in config.rules):
+        request.state.error_injection = injection  # rolled by the handler, unless the rule has its own
+        return await call_next(request)
+    if injection is not None and injection.rate > 0 and rng().random() < injection.rate:
+        stats.record_injected_error(request.url.path, injection.status_code)
+        return injection.response(dialect_for_request(request))
+    return await call_next(request)
+
+
+@app.middleware("http")
+async def vendor_errors(request: Request, call_next):
+    """Chat completion errors reshaped into the envelope of vendors that don't use OpenAI's"""
+    if request.method != "POST" or request.url.path != "/v1/chat/completions" \
+            or not (config.vendor or any(caps.vendor for caps in config.models.values())):
+        return await call_next(request)
+    try:
+        model = json.loads(await request.body()).get("model")
+    except (ValueError, AttributeError):
+        model = None
+    quirks = vendor_quirks(model if isinstance(model, str) else "")
+    response = await call_next(request)
+    if quirks is None or quirks.error_format == "openai" or response.status_code < 400:
+        return response
+    body = b"".join([chunk async for chunk in response.body_iterator])
+    try:
+        data = json.loads(body)
+    except ValueError:
+        return Response(content=body, status_code=response.status_code, headers=dict(response.headers))
+    error = data.get("error") if isinstance(data, dict) else None
+    message = error.get("message") if isinstance(error, dict) else data.get("detail") if isinstance(data, dict) else None
+    headers = {k: v for k, v in response.headers.items() if k not in ("content-length", "content-type")}
+    return JSONResponse(status_code=response.status_code, headers=headers, content={
+        "code": XAI_ERROR_CODES.get(response.status_code, "Unknown error"),
+        "error": message if isinstance(message, str) else json.dumps(data),
+    })
+
+
+@app.middleware("http")
+async def apply_region(request: Request, call_next):
+    """The answering region's network round trip, and its name in `x-sim-region`"""
+    if not is_api_path(request.url.path) or not (config.region.name or config.region.profiles):
+        return await call_next(request)
+    region = region_for(request)
+    profile = config.region.profiles.get(region)
+    if profile is not None and profile.rtt_ms > 0:
+        await asyncio.sleep(profile.rtt_ms / 1000)
+    response = await call_next(request)
+    if region is not None:
+        response.headers["x-sim-region"] = region
+    return response
+
+
+def cdn_error_page(status: int, host: str, ray: str) -> str:
+    """A Cloudflare-style error page, the body clients get when the edge can't reach the origin"""
+    title = CDN_ERRORS[status]
+    when = time.strftime("%Y-%m-%d %H:%M:%S UTC", time.gmtime())
+    return (f"<!DOCTYPE html>\n<html lang=\"en-US\">\n<head><title>{host} | {status}: {title}</title></head>\n"
+            f"<body>\n<h1>Error {status}</h1>\n<h2>{title}</h2>\n"
+            f"<p>Cloudflare Ray ID: <strong>{ray}</strong> &bull; {when}</p>\n"
+            f"<p>Performance &amp; security by Cloudflare</p>\n</body>\n</html>\n")
+
+
+@app.middleware("http")
+async def cdn_edge(request: Request, call_next):
+    """Simulated CDN in front of the API: edge failures first, then proxy headers on whatever comes back"""
+    cdn = config.cdn
+    if not is_api_path(request.url.path) or not (cdn.headers or cdn.error_rate > 0) \
+            or getattr(request.state, "self_test", False):
+        return await call_next(request)
+    ray = f"{random.getrandbits(64):016x}-{cdn.colo}"
+    if cdn.error_rate > 0 and rng().random() < cdn.error_rate:
+        status = rng().choice(cdn.statuses)
+        stats.record_injected_error(request.url.path, status)
+        response = HTMLResponse(cdn_error_page(status, request.url.hostname or "localhost", ray),
+                                status_code=status)
+    else:
+        response = await call_next(request)
+    if cdn.headers:
+        response.headers["Via"] = "1.1 cloudflare"
+        response.headers["CF-Ray"] = ray
+        response.headers["CF-Cache-Status"] = "DYNAMIC"
+        response.headers["X-Forwarded-For"] = request.client.host if request.client else "unknown"
+        response.headers["X-Forwarded-Proto"] = request.url.scheme
+        response.headers["X-Forwarded-Host"] = request.headers.get("host", "")
+    return response
+
+
+def is_stream_request(path: str, body: Any) -> bool:
+    """Whether a request asks for a streamed response, in any dialect"""
+    return path.endswith(":streamGenerateContent") or (isinstance(body, dict) and body.get("stream") is True)
+
+
+async def release_after(body: AsyncIterator[bytes], release) -> AsyncIterator[bytes]:
+    """The body, calling `release` once it has been sent or abandoned"""
+    try:
+        async for chunk in body:
+            yield chunk
+    finally:
+        release()
+
+
+async def call_holding(request: Request, call_next, release) -> Response:
+    """The response from call_next, calling `release` once, after its body is sent or the call fails"""
+    released = False
+
+    def release_once():
+        nonlocal released
+        if not released:
+            released = True
+            release()
+
+    try:
+        response = await call_next(request)
+    except BaseException:
+        release_once()
+        raise
+    if hasattr(response, "body_iterator"):
+        response.body_iterator = release_after(response.body_iterator, release_once)
+    else:
+        release_once()
+    return response
+
+
+@app.middleware("http")
+async def seed_randomness(request: Request, call_next):
+    """
+    Give requests of a seeded scenario (x-sim-scenario, else `seed`) a generator of their
+    own. Defined after cdn_edge so it wraps it, and the edge's rolls are seeded too
+    """
+    scenario = request.headers.get("x-sim-scenario", "")
+    seed = config.seeds.get(scenario, config.seed)
+    if seed is None or not is_api_path(request.url.path):
+        return await call_next(request)
+    fingerprint, _ = request_fingerprint(request.url.path, await request.body())
+    token = request_random.set(seeded_random.for_request(scenario, seed, fingerprint))
+    try:
+        return await call_next(request)
+    finally:
+        request_random.reset(token)
+
+
+@app.middleware("http")
+async def limit_streams(request: Request, call_next):
+    """Cap the streams each API key has open at once (rate_limits.streams), as providers do"""
+    limits = config.rate_limits.streams
+    if (limits.per_key is None and not limits.keys) or request.method != "POST" \
+            or not is_api_path(request.url.path) or getattr(request.state, "self_test", False):
+        return await call_next(request)
+    try:
+        body = json.loads(await request.body())
+    except ValueError:
+        body = None
+    key = api_key(request)
+    limit = limits.keys.get(key, limits.per_key) if key is not None else limits.per_key
+    if limit is None or not is_stream_request(request.url.path, body):
+        return await call_next(request)
+    digest = hashlib.sha256((key or "").encode()).hexdigest()[:16]
+    if open_streams.get(digest, 0) >= limit:
+        return provider_error(dialect_for_request(request), 429,
+                              f"Too many concurrent requests: your API key has {limit} streams open, the most "
+                              f"allowed at once. Wait for one to finish before starting another.",
+                              code="concurrent_requests_exceeded", headers=retry_after_headers(1))
+    open_streams[digest] = open_streams.get(digest, 0) + 1
+
+    def release():
+        open_streams[digest] -= 1
+        if open_streams[digest] == 0:
+            del open_streams[digest]
+
+    return await call_holding(request, call_next, release)
+
+
+def stream_complete(chunks: List[bytes]) -> bool:
+    """
+    Whether a stream body ends as a finished one does: with [DONE], Anthropic's
+    message_stop or a Gemini chunk carrying a finish reason (comments aside)
+    """
+    for event in reversed(re.split(rb"\r?\n\r?\n", b"".join(chunks))):
+        data = [line[5:].strip() for line in event.splitlines() if line.startswith(b"data:")]
+        if not data:
+            continue
+        if data[-1] == b"[DONE]":
+            return True
+        try:
+            payload = json.loads(data[-1])
+        except ValueError:
+            return False
+        if not isinstance(payload, dict):
+            return False
+        return payload.get("type") == "message_stop" or any(
+            isinstance(candidate, dict) and candidate.get("finishReason") for candidate in payload.get("candidates") or [])
+    return False
+
+
+async def cache_stream(body: AsyncIterator[bytes], key: str, status: int, headers: Dict[str, str],
+                       request: Request) -> AsyncIterator[bytes]:
+    """
+    Pass a stream on, storing it in the response cache once it has been sent in full,
+    unless it was cut short (stream_retry, an abort) rather than finished
+    """
+    chunks = []
+    async for chunk in body:
+        chunk = chunk if isinstance(chunk, bytes) else chunk.encode("utf-8")
+        chunks.append(chunk)
+        yield chunk
+    if stream_complete(chunks) and not stream_aborts.was_cut(getattr(request.state, "stream_id", None)):
+        response_cache.put(key, status, headers, chunks, stream=True)
+
+
+def cache_key(request: Request, body: bytes) -> str:
+    """
+    A request's response cache key: its fingerprint, `x-sim-*` controls and hashed
+    API key, so requests steering the simulator differently or from other callers
+    don't share answers
+    """
+    fingerprint, _ = request_fingerprint(request.url.path, body)
+    key_digest = hashlib.sha256((api_key(request) or "").encode()).hexdigest()[:16]
+    parts = [fingerprint, sorted(sim_controls(request).items()), key_digest]
+    return hashlib.sha256(json.dumps(parts).encode()).hexdigest()[:16]
+
+
+async def replay_chunks(chunks: List[bytes]) -> AsyncIterator[bytes]:
+    for chunk in chunks:
+        yield chunk
+
+
+@app.middleware("http")
+async def cache_responses(request: Request, call_next):
+    """
+    Answer identical API requests from response_cache while fresh. `Cache-Control:
+    no-cache` skips the lookup and `no-store` also keeps the response out of the cache
+    """
+    settings = config.response_cache
+    if not settings.enabled or request.method != "POST" or not is_api_path(request.url.path) \
+            or getattr(request.state, "self_test", False):
+        return await call_next(request)
+    directives = request.headers.get("cache-control", "").lower()
+    key = cache_key(request, await request.body())
+    entry = None if "no-cache" in directives or "no-store" in directives else response_cache.get(key)
+    stats.record_cache(request.url.path, entry is not None)
+    if entry is not None:
+        headers = {**entry["headers"], settings.header: "hit", "age": str(int(time.time() - entry["stored_at"]))}
+        if entry["stream"]:
+            return StreamingResponse(replay_chunks(entry["chunks"]), status_code=entry["status"], headers=headers)
+        return Response(content=b"".join(entry["chunks"]), status_code=entry["status"], headers=headers)
+    response = await call_next(request)
+    response.headers[settings.header] = "miss"
+    if response.status_code != 200 or "no-store" in directives:
+        return response
+    headers = {k: v for k, v in response.headers.items() if k.lower() not in ("content-length", settings.header)}
+    if response.headers.get("content-type", "").startswith("text/event-stream"):
+        response.body_iterator = cache_stream(response.body_iterator, key, response.status_code, headers, request)
+        return response
+    body = b"".join([chunk async for chunk in response.body_iterator])
+    response_cache.put(key, response.status_code, headers, [body], stream=False)
+    return Response(content=body, status_code=response.status_code, headers=dict(response.headers))
+
+
+def sse_flushing(request: Request) -> SSEFlushing:
+    """The listener's sse_flush, unless an `x-sim-flush` header (a mode, or N events per write) overrides it"""
+    value = sim_controls(request).get("flush", "").strip().lower()
+    if value.isdigit() and int(value) > 0:
+        return SSEFlushing(mode="batched", events=int(value))
+    if value in SSE_FLUSH_MODES:
+        return config.sse_flush.model_copy(update={"mode": value})
+    return config.sse_flush
+
+
+async def reflush_events(body: AsyncIterator[bytes], per_write: int) -> AsyncIterator[bytes]:
+    """
+    The body re-cut into writes of `per_write` whole SSE events (the last write may
+    hold fewer), however the handler grouped them
+    """
+    pending, held, count = b"", [], 0
+    async for chunk in body:
+        pending += chunk if isinstance(chunk, bytes) else chunk.encode("utf-8")
+        while True:
+            ends = [(pending.find(sep), sep) for sep in (b"\r\n\r\n", b"\n\n") if sep in pending]
+            if not ends:
+                break
+            at, sep = min(ends)
+            held.append(pending[:at + len(sep)])
+            pending = pending[at + len(sep):]
+            count += 1
+            if count >= per_write:
+                yield b"".join(held)
+                held, count = [], 0
+    if held or pending:
+        yield b"".join(held) + pending
+
+
+@app.middleware("http")
+async def flush_events(request: Request, call_next):
+    """Stream writes regrouped per sse_flush: one event per write (strict) or N at a time (batched)"""
+    response = await call_next(request)
+    if not is_api_path(request.url.path) or not hasattr(response, "body_iterator") \
+            or not response.headers.get("content-type", "").startswith("text/event-stream"):
+        return response
+    flushing = sse_flushing(request)
+    if flushing.mode != "default":
+        per_write = 1 if flushing.mode == "strict" else flushing.events
+        response.body_iterator = reflush_events(response.body_iterator, per_write)
+    return response
+
+
+@app.middleware("http")
+async def drain_requests(request: Request, call_next):
+    """Count API requests in flight, refusing new ones with a 503 during an admin drain"""
+    if not is_api_path(request.url.path):
+        return await call_next(request)
+    drain = lifecycle.maintenance()
+    if drain is not None:
+        return provider_error(dialect_for_request(request), 503,
+                              "The server is draining for maintenance. Please retry your request shortly.",
+                              code="service_unavailable", headers=retry_after_headers(drain["retry_after_seconds"]))
+    lifecycle.in_flight += 1
+
+    def release():
+        lifecycle.in_flight -= 1
+
+    return await call_holding(request, call_next, release)
+
+
+@app.middleware("http")
+async def capture_requests(request: Request, call_next):
+    """Record a summary of every API request, including ones failed by error injection"""
+    if not is_api_path(request.url.path) or getattr(request.state, "self_test", False):
+        return await call_next(request)
+    started = time.time()
+    response = await call_next(request)
+    body = getattr(request.state, "capture_body", None)
+    entry = {
+        "id": uuid.uuid4().hex[:12],
+        "timestamp": started,
+        "method": request.method,
+        "path": request.url.path,
+        "status": response.status_code,
+        "duration_ms": round((time.time() - started) * 1000, 3),
+        "model": getattr(request.state, "capture_model", None) or (body.get("model") if body else None),
+        "user": body.get("user") if body else None,
+        "stream": getattr(request.state, "capture_stream", None) or (bool(body.get("stream")) if body else False),
+        "body": body,
+        "response": getattr(request.state, "capture_response", None),
+    }
+    capture.record(entry)
+    if history is not None:
+        # The INSERT and commit run on a worker thread, off the event loop
+        task = asyncio.create_task(asyncio.to_thread(history.record, entry))
+        background_tasks.add(task)
+        task.add_done_callback(background_tasks.discard)
+    return response
+
+
+@app.middleware("http")
+async def track_schema(request: Request, call_next):
+    """Note the fields of every JSON API request body for schema_drift, as the client sent them"""
+    settings = config.schema_drift
+    if settings.enabled and request.method == "POST" and is_api_path(request.url.path) \
+            and not getattr(request.state, "self_test", False):
+        try:
+            body = json.loads(await request.body())
+        except ValueError:
+            body = None
+        if isinstance(body, dict):
+            schema_tracker.observe(request.url.path, body, settings.max_values)
+    return await call_next(request)
+
+
+def request_fingerprint(path: str, body: bytes) -> Tuple[str, Optional[str]]:
+    """
+    Fingerprint of a request (path and body, JSON compared by value so key order and
+    whitespace don't matter) and the model it names, if any
+    """
+    model = None
+    try:
+        data = json.loads(body)
+        canonical = json.dumps(data, sort_keys=True, separators=(",", ":")).encode()
+        if isinstance(data, dict) and isinstance(data.get("model"), str):
+            model = data["model"]
+    except ValueError:
+        canonical = body
+    return hashlib.sha256(path.encode() + b"\n" + canonical).hexdigest()[:16], model
+
+
+@app.middleware("http")
+async def detect_duplicates(request: Request, call_next):
+    """Count API request bodies seen again within duplicates.window_seconds, such as client retries"""
+    settings = config.duplicates
+    if not settings.enabled or request.method != "POST" or not is_api_path(request.url.path):
+        return await call_next(request)
+    fingerprint, model = request_fingerprint(request.url.path, await request.body())
+    response = await call_next(request)
+    stats.record_fingerprint(fingerprint, request.url.path, model, response.status_code, settings)
+    return response
+
+
+REDACTED = "[REDACTED]"
+
+body_logger = logging.getLogger("llm_simulator.bodies")
+if not body_logger.handlers:
+    _body_handler = logging.StreamHandler(sys.stdout)
+    _body_handler.setFormatter(logging.Formatter("%(message)s"))
+    body_logger.addHandler(_body_handler)
+    body_logger.setLevel(logging.INFO)
+    body_logger.propagate = False
+
+
+def redact(data: Any, patterns: List[str]) -> Any:
+    """Copy of a JSON value with the fields matching any pattern replaced by [REDACTED]"""
+    anywhere = {p for p in patterns if "." not in p}
+    paths = [p.split(".") for p in patterns if "." in p]
+
+    def walk(value: Any, path: List[str]) -> Any:
+        def child(key: str, item: Any) -> Any:
+            sub = path + [key]
+            if key in anywhere or any(len(p) == len(sub) and all(a in ("*", b) for a, b in zip(p, sub))
+                                      for p in paths):
+                return REDACTED
+            return walk(item, sub)
+        if isinstance(value, dict):
+            return {k: child(str(k), v) for k, v in value.items()}
+        if isinstance(value, list):
+            return [child(str(i), v) for i, v in enumerate(value)]
+        return value
+
+    return walk(data, [])
+
+
+def parse_logged_body(raw: bytes) -> Any:
+    if not raw:
+        return None
+    try:
+        return json.loads(raw)
+    except ValueError:
+        return raw.decode("utf-8", errors="replace")
+
+
+@app.middleware("http")
+async def log_bodies(request: Request, call_next):
+    """Log a sampled share of API request/response bodies, redacted, as JSON lines"""
+    settings = config.body_logging
+    if not settings.enabled or not is_api_path(request.url.path) or random.random() >= settings.sample_rate:
+        return await call_next(request)
+    started = time.time()
+    request_body = parse_logged_body(await request.body())
+    response = await call_next(request)
+    entry = {
+        "event": "http_body",
+        "timestamp": started,
+        "method": request.method,
+        "path": request.url.path,
+        "status": response.status_code,
+        "request": {
+            "headers": {k: REDACTED if k.lower() in settings.redact_headers else v
+                        for k, v in request.headers.items()},
+            "body": redact(request_body, settings.redact),
+        },
+    }
+    streaming = response.headers.get("content-type", "").startswith("text/event-stream")
+    if settings.include_response and not streaming:
+        raw = b"".join([chunk async for chunk in response.body_iterator])
+        entry["response"] = {"body": redact(parse_logged_body(raw), settings.redact)}
+        response = Response(content=raw, status_code=response.status_code,
+                            headers=dict(response.headers), media_type=response.media_type)
+    elif streaming:
+        entry["response"] = {"stream": True}  # logging would mean buffering the whole stream
+    entry["duration_ms"] = round((time.time() - started) * 1000, 3)
+    body_logger.info(json.dumps(entry, ensure_ascii=False, default=str))
+    return response
+
+
+# Left open so liveness probes and discovery work from anywhere
+UNRESTRICTED_PATHS = ("/", "/health", "/healthz", "/readyz", "/version")
+
+
+def client_allowed(request: Request) -> bool:
+    """Whether the source address may call this path under the configured allowlists"""
+    path = request.url.path
+    if path in UNRESTRICTED_PATHS:
+        return True
+    networks = config.access.networks(admin=path.startswith("/admin/"))
+    if not networks:
+        return True
+    try:
+        address = ipaddress.ip_address(request.client.host if request.client else "")
+    except ValueError:
+        return False
+    return any(address in network for network in networks)
+
+
+def admin_token_valid(request: Request) -> bool:
+    """Whether the request carries the configured admin bearer token (always true without one)"""
+    token = config.admin.token
+    if not token or not request.url.path.startswith("/admin/"):
+        return True
+    scheme, _, presented = request.headers.get("authorization", "").partition(" ")
+    return scheme.lower() == "bearer" and hmac.compare_digest(presented.strip(), token)
+
+
+@admin_app.middleware("http")
+@app.middleware("http")
+async def require_admin_token(request: Request, call_next):
+    """Bearer-token auth for the control plane, independent of API keys"""
+    if not admin_token_valid(request):
+        return JSONResponse(status_code=401, content=error_body(
+            401, "Missing or invalid admin token.", code="invalid_admin_token"),
+            headers={"WWW-Authenticate": "Bearer"})
+    return await call_next(request)
+
+
+@admin_app.middleware("http")
+@app.middleware("http")
+async def enforce_allowlist(request: Request, call_next):
+    """Refuse disallowed source addresses before anything else, so they never reach captured requests"""
+    if not client_allowed(request) and not getattr(request.state, "self_test", False):
+        host = request.client.host if request.client else "unknown"
+        return provider_error(dialect_for_request(request), 403,
+                              f"Access from {host} is not allowed.", code="ip_not_allowed")
+    return await call_next(request)
+
+
+async def cut_stream_at(body: AsyncIterator[bytes], deadline: float) -> AsyncIterator[bytes]:
+    """A response body that ends early, as a gateway cuts a stream, once the deadline passes"""
+    loop = asyncio.get_running_loop()
+    while True:
+        try:
+            yield await asyncio.wait_for(body.__anext__(), max(deadline - loop.time(), 0))
+        except (StopAsyncIteration, asyncio.TimeoutError):
+            return
+
+
+@app.middleware("http")
+async def enforce_timeouts(request: Request, call_next):
+    """Server-side read and processing limits (timeouts.read_seconds and request_seconds)"""
+    limits = config.timeouts
+    loop = asyncio.get_running_loop()
+    deadline = loop.time() + limits.request_seconds if limits.request_seconds else None
+    if limits.read_seconds:
+        try:
+            await asyncio.wait_for(request.body(), limits.read_seconds)
+        except asyncio.TimeoutError:
+            return provider_error(dialect_for_request(request), 408,
+                                  f"Timed out after {limits.read_seconds:g}s reading the request body.")
+    if deadline is None or not is_api_path(request.url.path):
+        return await call_next(request)
+    try:
+        response = await asyncio.wait_for(call_next(request), max(deadline - loop.time(), 0))
+    except asyncio.TimeoutError:
+        return provider_error(dialect_for_request(request), 504,
+                              f"The request exceeded the server's {limits.request_seconds:g}s processing limit.")
+    if hasattr(response, "body_iterator"):
+        response.body_iterator = cut_stream_at(response.body_iterator, deadline)
+    return response
+
+
+class WriteTimeout:
+    """
+    ASGI middleware failing sends that block longer than timeouts.write_seconds,
+    which drops the connection to a client that stopped reading
+    """
+
+    def __init__(self, app):
+        self.app = app
+
+    async def __call__(self, scope, receive, send):
+        limit = config.timeouts.write_seconds
+        if scope["type"] != "http" or not limit:
+            return await self.app(scope, receive, send)
+
+        async def timed_send(message):
+            await asyncio.wait_for(send(message), limit)
+
+        await self.app(scope, receive, timed_send)
+
+
+class LinkState:
+    """When a connection's simulated link is next free, each way"""
+
+    def __init__(self):
+        self.down_free = 0.0
+        self.up_free = 0.0
+
+
+class Bandwidth:
+    """
+    ASGI middleware pacing API traffic to connections.bytes_per_second (responses)
+    and upload_bytes_per_second (request bodies). Connections are told apart by
+    client address and port, so keep-alive requests and HTTP/2 streams share a link.
+    """
+
+    SLICES_PER_SECOND = 20  # bodies go out in pieces of 50 ms worth of bytes
+
+    def __init__(self, app):
+        self.app = app
+        self.links: Dict[Any, LinkState] = {}
+
+    def link(self, scope) -> LinkState:
+        if len(self.links) > 1000:
+            # A link that is free again carries no state worth keeping
+            now = asyncio.get_running_loop().time()
+            self.links = {k: v for k, v in self.links.items() if max(v.down_free, v.up_free) > now}
+        key = tuple(scope.get("client") or ())
+        return self.links.setdefault(key, LinkState())
+
+    async def __call__(self, scope, receive, send):
+        down, up = config.connections.bytes_per_second, config.connections.upload_bytes_per_second
+        if scope["type"] != "http" or not (down or up) or not is_api_path(scope["path"]):
+            return await self.app(scope, receive, send)
+        link = self.link(scope)
+        loop = asyncio.get_running_loop()
+
+        async def transmit(size: int, rate: int, free_at: float) -> float:
+            """Sleep until `size` more bytes have crossed the link; returns when it is next free"""
+            now = loop.time()
+            free_at = max(now, free_at) + size / rate
+            await asyncio.sleep(free_at - now)
+            return free_at
+
+        async def paced_receive():
+            message = await receive()
+            if up and message["type"] == "http.request" and message.get("body"):
+                link.up_free = await transmit(len(message["body"]), up, link.up_free)
+            return message
+
+        async def paced_send(message):
+            body = message.get("body", b"")
+            if not down or message["type"] != "http.response.body" or not body:
+                return await send(message)
+            step = max(down // self.SLICES_PER_SECOND, 1)
+            for start in range(0, len(body), step):
+                piece = body[start:start + step]
+                link.down_free = await transmit(len(piece), down, link.down_free)
+                last = start + step >= len(body)
+                await send({**message, "body": piece, "more_body": message.get("more_body", False) if last else True})
+
+        await self.app(scope, paced_receive if up else receive, paced_send)
+
+
+class ExpectContinue:
+    """
+    ASGI middleware for `Expect: 100-continue` API requests. Uvicorn sends the
+    interim 100 when the app first reads the body, so delaying that read delays
+    the 100; a reject status answers before the client sends its body at all.
+    """
+
+    def __init__(self, app):
+        self.app = app
+
+    async def __call__(self, scope, receive, send):
+        settings = config.connections
+        if (scope["type"] != "http" or not is_api_path(scope["path"])
+                or (not settings.continue_delay_ms and settings.continue_reject_status is None)
+                or dict(scope["headers"]).get(b"expect", b"").lower() != b"100-continue"):
+            return await self.app(scope, receive, send)
+        if settings.continue_reject_status is not None:
+            status = settings.continue_reject_status
+            response = provider_error(dialect_for_request(Request(scope)), status,
+                                      f"Request body refused before upload (simulated {status})",
+                                      headers={"Connection": "close"})  # the unread body can't stay on it
+            return await response(scope, receive, send)
+        waited = False
+
+        async def delayed_receive():
+            nonlocal waited
+            if not waited:
+                waited = True
+                await asyncio.sleep(settings.continue_delay_ms / 1000)
+            return await receive()
+
+        await self.app(scope, delayed_receive, send)
+
+
+app.add_middleware(ExpectContinue)
+app.add_middleware(Bandwidth)
+app.add_middleware(WriteTimeout)
+
+
+# Requests served and the request count to close at, per client address and port
+connection_requests: "OrderedDict[Any, Tuple[int, int]]" = OrderedDict()
+
+
+def should_close(request: Request) -> bool:
+    """Whether this response ends its connection, per keep_alive, max_requests and close_rate"""
+    settings = config.connections
+    if not settings.keep_alive:
+        return True
+    if settings.close_rate > 0 and random.random() < settings.close_rate:
+        connection_requests.pop(tuple(request.scope.get("client") or ()), None)
+        return True
+    if settings.max_requests is None:
+        return False
+    key = tuple(request.scope.get("client") or ())
+    served, limit = connection_requests.pop(key, (0, None))
+    if limit is None:
+        jitter = settings.max_requests_jitter
+        limit = max(settings.max_requests + random.randint(-jitter, jitter), 1)
+    if served + 1 >= limit:
+        return True
+    connection_requests[key] = (served + 1, limit)
+    while len(connection_requests) > 10000:  # connections the client closed itself
+        connection_requests.popitem(last=False)
+    return False
+
+
+@app.middleware("http")
+async def close_connections(request: Request, call_next):
+    """Send `Connection: close` so clients have to open a new connection, always or after a while"""
+    response = await call_next(request)
+    if request.scope.get("http_version", "1.1").startswith("1") and should_close(request):
+        response.headers["Connection"] = "close"
+    return response
+
+
+def mounted_dialect(path: str) -> Optional[Tuple[str, str]]:
+    """(prefix, dialect) of the dialect_prefixes entry a path falls under, longest prefix first"""
+    for prefix in sorted(config.dialect_prefixes, key=len, reverse=True):
+        if path.startswith(prefix + "/"):
+            return prefix, config.dialect_prefixes[prefix]
+    return None
+
+
+@app.middleware("http")
+async def strip_dialect_prefix(request: Request, call_next):
+    """
+    Serve a dialect under its configured prefix (e.g. /anthropic/v1/messages) by
+    routing the rest of the path, so every other middleware sees the usual path.
+    Only the dialect's own API paths are found under a prefix.
+    """
+    mount = mounted_dialect(request.url.path)
+    if mount is None:
+        return await call_next(request)
+    prefix, dialect = mount
+    path = request.url.path[len(prefix):]
+    if not is_api_path(path) or (dialect_for_path(path) != dialect and path != "/v1/models"):
+        return provider_error(dialect, 404, f"{path} is not part of the {dialect} API mounted at {prefix}")
+    request.scope["path"] = path
+    request.scope["raw_path"] = path.encode()
+    request.state.dialect = dialect
+    return await call_next(request)
+
+
+@app.get("/")
+async def root():
+    """Root endpoint with API information"""
+    return {
+        "name": "LLM Behavior Simulator",
+        "version": VERSION,
+        "description": "OpenAI-compatible API for testing AI gateways",
+        "endpoints": [
+            "/v1/chat/completions",
+            "/v1/models",
+            "/v1/messages",
+            "/v1/messages/count_tokens",
+            "/v1beta/models/{model}:generateContent",
+            "/v1beta/models/{model}:streamGenerateContent",
+            "/tokenize",
+            "/detokenize",
+            "/version",
+            "/admin/stats"
+        ]
+    }
+
+
+@app.get("/health")
+async def health():
+    """Health check endpoint"""
+    return {"status": "healthy"}
+
+
+class DrainRequest(BaseModel):
+    """POST /admin/drain: refuse new API requests with 503s while in-flight ones finish"""
+    retry_after_seconds: float = Field(30.0, ge=0)
+    duration_seconds: Optional[float] = Field(None, gt=0)  # serve again after this long, else on DELETE
+    wait: bool = False  # answer only once no API request is in flight (or timeout_seconds passes)
+    timeout_seconds: float = Field(60.0, gt=0)
+
+
+# How often a waiting POST /admin/drain checks whether in-flight requests have finished
+DRAIN_POLL_SECONDS = 0.05
+
+
+class Lifecycle:
+    """
+    Readiness state; flips to draining when shutdown begins so traffic moves elsewhere
+    first. An admin-triggered drain rehearses maintenance without shutting down
+    """
+
+    def __init__(self):
+        self.draining = False
+        self.drain: Optional[Dict[str, Any]] = None  # admin drain: started_at, until, retry_after_seconds
+        self.in_flight = 0  # API requests being answered, streams until their last byte
+
+    def begin_shutdown(self):
+        self.draining = True
+
+    def maintenance(self) -> Optional[Dict[str, Any]]:
+        """The admin drain in effect, if any; one with a duration ends by itself"""
+        if self.drain is not None and self.drain["until"] is not None and time.time() >= self.drain["until"]:
+            self.drain = None
+        return self.drain
+
+    def describe(self) -> Dict[str, Any]:
+        return {"status": "draining" if self.maintenance() is not None else "serving",
+                "in_flight": self.in_flight, **(self.drain or {})}
+
+
+lifecycle = Lifecycle()
+
+
+def readiness_checks() -> Dict[str, Tuple[bool, str]]:
+    """Check name -> (passed, detail) for /readyz"""
+    uses_markov = config.generator == "markov" or any(r.generator == "markov" for r in config.rules)
+    checks = {
+        "config": (True, f"{len(config.rules)} rules"),
+        "markov": (not uses_markov or bool(markov.starts),
+                   f"{len(markov.starts)} starting states" if uses_markov else "not used"),
+        "fixtures": (True, f"{len(fixtures)} fixtures" if config.fixtures.files else "not used"),
+        "transcripts": (True, f"{len(transcripts)} transcripts" if config.transcripts.enabled else "not used"),
+        "history": (history is not None or not config.history.path,
+                    history.path if history is not None else "not enabled"),
+        "shutdown": (not lifecycle.draining, "draining" if lifecycle.draining else "serving"),
+        "maintenance": (lifecycle.maintenance() is None,
+                        "draining (admin)" if lifecycle.maintenance() is not None else "serving"),
+    }
+    return checks
+
+
+@app.get("/version")
+async def version():
+    """Version, build info and enabled features, for bug reports"""
+    return build_info()
+
+
+@app.get("/healthz")
+async def healthz():
+    """Liveness: the process is up and serving requests"""
+    return {"status": "alive"}
+
+
+@app.get("/readyz")
+async def readyz():
+    """Readiness: failing while anything needed to serve is missing, and during shutdown"""
+    checks = readiness_checks()
+    ready = all(passed for passed, _ in checks.values())
+    return JSONResponse(status_code=200 if ready else 503, content={
+        "status": "ready" if ready else "not ready",
+        "checks": {name: {"ok": passed, "detail": detail} for name, (passed, detail) in checks.items()},
+    })
+
+
+async def asgi_call(target, method: str, path: str, body: Dict[str, Any],
+                    state: Optional[Dict[str, Any]] = None,
+                    headers: Optional[Dict[str, str]] = None) -> Tuple[int, Dict[str, str], bytes]:
+    """One request through an ASGI app in this process, without a socket: (status, headers, body)"""
+    payload = json.dumps(body).encode("utf-8")
+    extra = [(k.lower().encode("latin-1"), v.encode("latin-1")) for k, v in (headers or {}).items()
+             if k.lower() not in ("content-type", "content-length")]
+    scope = {
+        "type": "http", "asgi": {"version": "3.0"}, "http_version": "1.1", "scheme": "http",
+        "method": method, "path": path, "raw_path": path.encode("ascii"), "query_string": b"", "root_path": "",
+        "headers": [(b"content-type", b"application/json"),
+                    (b"content-length", str(len(payload)).encode("ascii")), *extra],
+        "client": ("127.0.0.1", 0), "server": ("127.0.0.1", 0), "state": dict(state or {}),
+    }
+    sent = False
+    response: Dict[str, Any] = {"status": 0, "headers": {}, "body": []}
+
+    async def receive():
+        nonlocal sent
+        if sent:
+            await asyncio.Event().wait()  # never disconnects; streams end on their own
+        sent = True
+        return {"type": "http.request", "body": payload, "more_body": False}
+
+    async def send(message):
+        if message["type"] == "http.response.start":
+            response["status"] = message["status"]
+            response["headers"] = {k.decode("latin-1").lower(): v.decode("latin-1") for k, v in message["headers"]}
+        elif message["type"] == "http.response.body":
+            response["body"].append(message.get("body", b""))
+
+    await target(scope, receive, send)
+    return response["status"], response["headers"], b"".join(response["body"])
+
+
+def self_test_failure(stream: bool, status: int, headers: Dict[str, str], body: bytes) -> Optional[str]:
+    """
+    What is wrong with a self-test response, or None. Self-test requests skip the
+    allowlist, CDN edge, rate limits, stream caps, response cache, injected errors,
+    faults, assertions and stream retries, so anything but a 200 fails
+    """
+    if status != 200:
+        return f"{'stream' if stream else 'chat completion'} answered {status}: {body[:200].decode('utf-8', 'replace')}"
+    try:
+        if not stream:
+            message = json.loads(body)["choices"][0]["message"]
+            return None if message["role"] == "assistant" else f"unexpected role {message['role']!r}"
+        if not headers.get("content-type", "").startswith("text/event-stream"):
+            return f"stream has content-type {headers.get('content-type')!r}"
+        data = [line[5:].strip() for line in body.decode("utf-8").splitlines() if line.startswith("data:")]
+        if not data or data[-1] != "[DONE]":
+            return "stream does not end with data: [DONE]"
+        for chunk in data[:-1]:
+            json.loads(chunk)["choices"]
+    except (ValueError, KeyError, IndexError, TypeError) as e:
+        return f"malformed {'stream' if stream else 'chat completion'}: {type(e).__name__}: {e}"
+    return None
+
+
+@app.on_event("startup")
+async def run_self_test():
+    """
+    With self_test, fail startup unless a chat completion and a stream make it through
+    every middleware and handler. Counters are left as they were, and interactive
+    mode is off for the test.
+    """
+    global config
+    if not config.self_test:
+        return
+    saved, serving = stats.export_state(), config
+    config = config.model_copy(update={"interactive": InteractiveConfig()})
+    try:
+        for stream in (False, True):
+            body = {"model": available_models()[0], "stream": stream,
+                    "messages": [{"role": "user", "content": "Self-test: hello"}]}
+            try:
+                failure = self_test_failure(stream, *await asgi_call(app, "POST", "/v1/chat/completions", body,
+                                                                     state={"self_test": True}))
+            except Exception as e:
+                traceback.print_exc()
+                failure = f"{type(e).__name__}: {e}"
+            if failure is not None:
+                raise RuntimeError(f"Self-test failed: {failure}")
+    finally:
+        config = serving
+        stats.restore_state(saved)
+    print("Self-test passed: chat completion and stream")
+
+
+@app.on_event("shutdown")
+async def mark_unready():
+    lifecycle.begin_shutdown()
+
+
+async def answer_job(raw: bytes) -> Tuple[Optional[str], bytes]:
+    """
+    The response message for a queued job, and the reply_to it named. The body is the
+    response's JSON, or for streams the list of its events' data, as `diff` compares them
+    """
+    try:
+        job = QueueJob.model_validate_json(raw)
+    except ValidationError as e:
+        return None, json.dumps({"id": None, "status": 400, "error": f"invalid job: {e.errors()[0]['msg']}"}).encode()
+    try:
+        status, headers, body = await asgi_call(app, job.method, job.path, job.body, headers=job.headers)
+    except Exception as e:
+        traceback.print_exc()
+        return job.reply_to, json.dumps({"id": job.id, "status": 500, "error": f"{type(e).__name__}: {e}"}).encode()
+    message = {"id": job.id, "status": status, "headers": headers,
+               "body": parse_replayed_body(body, headers.get("content-type", ""))}
+    return job.reply_to, json.dumps(message, ensure_ascii=False).encode("utf-8")
+
+
+async def consume_nats(settings: QueueConfig, slots: asyncio.Semaphore):
+    import nats
+    client = await nats.connect(settings.url)
+
+    async def answer(msg):
+        async with slots:
+            reply_to, data = await answer_job(msg.data)
+            await client.publish(msg.reply or reply_to or settings.responses, data)
+
+    async def handle(msg):
+        # nats-py awaits one callback at a time per subscription, so jobs are answered in tasks
+        task = asyncio.create_task(answer(msg))
+        background_tasks.add(task)
+        task.add_done_callback(background_tasks.discard)
+
+    await client.subscribe(settings.requests, queue=settings.group, cb=handle)
+    try:
+        await asyncio.Event().wait()
+    finally:
+        await client.drain()
+
+
+async def consume_redis(settings: QueueConfig, slots: asyncio.Semaphore):
+    import redis.asyncio as aioredis
+    client = aioredis.from_url(settings.url)
+
+    async def handle(raw: bytes):
+        try:
+            reply_to, data = await answer_job(raw)
+            await client.rpush(reply_to or settings.responses, data)
+        finally:
+            slots.release()
+
+    try:
+        while True:
+            await slots.acquire()
+            try:
+                _, raw = await client.blpop([settings.requests])
+            except BaseException:
+                slots.release()
+                raise
+            task = asyncio.create_task(handle(raw))
+            background_tasks.add(task)
+            task.add_done_callback(background_tasks.discard)
+    finally:
+        await client.aclose()
+
+
+# Pause before reconnecting to a broker that failed
+QUEUE_RETRY_SECONDS = 5.0
+# Client library each queue backend needs: (module, pip package)
+QUEUE_CLIENTS = {"nats": ("nats", "nats-py"), "redis": ("redis", "redis"), "rediss": ("redis", "redis")}
+
+
+async def consume_queue(settings: QueueConfig):
+    """Answer queued jobs for as long as the app serves, reconnecting after broker failures"""
+    consume = consume_nats if settings.url.startswith("nats://") else consume_redis
+    slots = asyncio.Semaphore(settings.concurrency)
+    while True:
+        try:
+            await consume(settings, slots)
+        except asyncio.CancelledError:
+            raise
+        except Exception as e:
+            print(f"Queue {settings.url}: {type(e).__name__}: {e}; reconnecting in {QUEUE_RETRY_SECONDS:g}s")
+            await asyncio.sleep(QUEUE_RETRY_SECONDS)
+
+
+queue_consumer: Optional[asyncio.Task] = None
+
+
+@app.on_event("startup")
+async def start_queue_consumer():
+    """With queue.url, take jobs from the broker alongside HTTP traffic"""
+    global queue_consumer
+    if config.queue.url is not None:
+        import importlib.util
+        module, package = QUEUE_CLIENTS[config.queue.url.partition("://")[0]]
+        if importlib.util.find_spec(module) is None:
+            raise RuntimeError(f"queue.url {config.queue.url} needs {package}: pip install {package}")
+        queue_consumer = asyncio.create_task(consume_queue(config.queue))
+        print(f"Answering jobs from {config.queue.requests} on {config.queue.url}")
+
+
+@app.on_event("shutdown")
+async def stop_queue_consumer():
+    if queue_consumer is not None:
+        queue_consumer.cancel()
+
+
+@app.get("/v1/models")
+async def list_models(http_request: Request) -> ModelList:
+    """List available models, in the Anthropic or Gemini shape when their SDKs ask"""
+    dialect = dialect_for_request(http_request)
+    if dialect == "anthropic":
+        return JSONResponse(content=anthropic_model_list())
+    if dialect == "gemini":
+        return JSONResponse(content=await list_gemini_models())
+    models = [
+        Model(
+            id=model_id,
+            created=int(time.time()),
+            owned_by="simulator"
+        )
+        for model_id in available_models() + COMPLETION_MODELS + list(embedding_models())
+    ]
+    return ModelList(data=models)
+
+
+@app.post("/tokenize")
+async def tokenize(request: TokenizeRequest):
+    """Tokenize text: vLLM response shape for `prompt`/`messages`, TGI shape for `inputs`"""
+    tokenizer = active_tokenizer()
+    if request.inputs is not None:
+        tokens, offset = [], 0
+        for piece, token_id in zip(tokenizer.pieces(request.inputs), tokenizer.encode(request.inputs)):
+            text = piece.decode("utf-8", errors="replace")
+            tokens.append({"id": token_id, "text": text, "start": offset, "stop": offset + len(piece)})
+            offset += len(piece)
+        return tokens
+    if request.messages is not None:
+        tokens = tokenizer.encode(" ".join(message_text(msg) for msg in request.messages))
+        # matches usage.prompt_tokens, chat format overhead included (it has no token ids)
+        count = prompt_token_count(request.messages, request.model)
+    elif request.prompt is not None:
+        tokens = tokenizer.encode(request.prompt)
+        count = len(tokens)
+    else:
+        raise HTTPException(status_code=400, detail="One of 'prompt', 'messages' or 'inputs' is required")
+    return {"count": count, "max_model_len": MAX_MODEL_LEN, "tokens": tokens}
+
+
+@app.post("/detokenize")
+async def detokenize(request: DetokenizeRequest):
+    """Turn token ids from /tokenize back into text (vLLM shape)"""
+    try:
+        return {"prompt": active_tokenizer().decode(request.tokens)}
+    except (OverflowError, ValueError):
+        raise HTTPException(status_code=400, detail="Token ids must be non-negative ids produced by /tokenize")
+
+
+def anthropic_content_text(content: Any) -> str:
+    """Text of an Anthropic content field (a string or a list of content blocks)"""
+    if isinstance(content, str):
+        return content
+    if isinstance(content, list):
+        return " ".join(block.get("text", "") for block in content if isinstance(block, dict))
+    return ""
+
+
+@app.post("/v1/messages/count_tokens")
+async def count_message_tokens(request: CountTokensRequest):
+    """Anthropic-style prompt token count"""
+    texts = [anthropic_content_text(request.system)] if request.system else []
+    texts.extend(anthropic_content_text(msg.get("content")) for msg in request.messages)
+    return {"input_tokens": estimate_tokens(" ".join(texts))}
+
+
+@admin_router.get("/admin/stats")
+async def get_stats():
+    """Request counters, including per-rule and per-variant hit counts"""
+    return {**stats.snapshot(), "scheduler": {"active": gate.active, "queued": gate.queued,
+                                              "load_multiplier": round(load_multiplier(gate.active), 3),
+                                              "sleeping": timers.waiting, "timer_slots": timers.slots,
+                                              "open_streams_by_key": dict(open_streams)},
+            "dependencies": outages.snapshot()}
+
+
+@admin_router.delete("/admin/stats")
+async def reset_stats():
+    """Reset all counters (e.g. between experiment runs)"""
+    stats.reset()
+    return {"status": "reset"}
+
+
+def coverage_report() -> Dict[str, Any]:
+    """Which configured rules, variants and fixtures have answered since the counters were reset"""
+    rules = []
+    for rule in config.rules:
+        hits = stats.rules.get(rule.name, {"matched": 0, "variants": {}})
+        entry: Dict[str, Any] = {"name": rule.name, "matched": hits["matched"]}
+        if rule.variants:
+            entry["variants"] = {v.name: hits["variants"].get(v.name, 0) for v in rule.variants}
+        rules.append(entry)
+    never_matched = [r["name"] for r in rules if r["matched"] == 0]
+    return {
+        "rules": rules,
+        "rule_coverage": round(1 - len(never_matched) / len(rules), 4) if rules else 1.0,
+        "never_matched": never_matched,
+        "never_selected_variants": [f"{r['name']}/{name}" for r in rules
+                                    for name, count in r.get("variants", {}).items() if count == 0],
+        "fixtures": {
+            "total": len(fixtures),
+            "used": sum(1 for source in fixtures.sources if source in stats.fixture_hits),
+            "never_matched": [source for source in fixtures.sources if source not in stats.fixture_hits],
+        },
+    }
+
+
+@admin_router.get("/admin/scenarios/coverage")
+async def scenario_coverage():
+    """Rule, variant and fixture coverage, flagging entries that never fired"""
+    return coverage_report()
+
+
+@admin_router.get("/admin/transcripts")
+async def list_transcripts():
+    """Loaded transcripts, what they answer and how often they have been served"""
+    return {"object": "list", "enabled": config.transcripts.enabled, "data": [
+        {"name": t.name, "description": t.description, "recorded": t.recorded,
+         "method": t.request.get("method", "POST"), "path": t.request["path"], "stream": t.request.get("stream"),
+         "tools": t.request.get("tools", False), "by_name_only": t.by_name_only,
+         "status": t.response.get("status", 200), "served": stats.transcripts.get(t.name, 0)}
+        for t in transcripts.transcripts.values()
+    ]}
+
+
+@admin_router.get("/admin/assertions")
+async def list_assertions():
+    """Request assertion outcomes, with each assertion's most recent failures"""
+    return {"object": "list", "data": [
+        {"name": a.name, "reject": a.reject, **stats.assertions.get(a.name, {"passed": 0, "failed": 0,
+                                                                             "recent_failures": []})}
+        for a in config.assertions
+    ]}
+
+
+class WatermarkCheck(BaseModel):
+    text: str
+    expected: Optional[int] = Field(None, ge=0)  # markers the response had, if known
+
+
+@admin_router.post("/admin/watermark/verify")
+async def check_watermark(check: WatermarkCheck):
+    """Verify the watermark markers of text a client reassembled from a stream"""
+    return verify_watermark(check.text, check.expected)
+
+
+@admin_router.get("/admin/usage")
+async def get_usage():
+    """Tokens and simulated cost per model and per user"""
+    return {**stats.usage_snapshot(),
+            "by_user": {user: {"prompt_tokens": e["prompt_tokens"], "completion_tokens": e["completion_tokens"],
+                               "cost_usd": round(e["cost_usd"], 6) if "cost_usd" in e else None}
+                        for user, e in stats.users.items()}}
+
+
+@admin_router.get("/admin/requests")
+async def list_captured_requests(limit: Optional[int] = None):
+    """Most recent captured API requests, oldest first"""
+    return {"object": "list", "data": capture.recent(limit)}
+
+
+@admin_router.get("/admin/requests/stream")
+async def stream_captured_requests(backlog: int = 0, bodies: bool = False, model: Optional[str] = None,
+                                   path: Optional[str] = None):
+    """
+    Captured request summaries as server-sent events, as they happen: the last `backlog`
+    first, then live ones. Bodies and responses are left out unless `bodies` is set.
+    """
+    def wanted(entry: Dict[str, Any]) -> bool:
+        return (model is None or entry.get("model") == model) and (path is None or entry.get("path") == path)
+
+    def event(entry: Dict[str, Any]) -> str:
+        shown = entry if bodies else {k: v for k, v in entry.items() if k not in ("body", "response")}
+        return f"event: request\nid: {entry['id']}\n" + sse_event(shown)
+
+    async def events() -> AsyncIterator[str]:
+        yield ": following captured requests\n\n"
+        for entry in capture.recent(backlog) if backlog > 0 else []:
+            if wanted(entry):
+                yield event(entry)
+        async for entry in capture.follow():
+            if entry is None:
+                yield ": keep-alive\n\n"
+            elif wanted(entry):
+                yield event(entry)
+
+    return StreamingResponse(events(), media_type="text/event-stream", headers={"cache-control": "no-cache"})
+
+
+@admin_router.get("/admin/requests/finetune")
+async def export_finetune(limit: Optional[int] = None):
+    """Captured chat conversations as OpenAI fine-tuning JSONL"""
+    lines = [json.dumps(e, ensure_ascii=False) + "\n" for e in finetune_examples(capture.recent(limit))]
+    return PlainTextResponse("".join(lines), media_type="application/jsonl")
+
+
+@admin_router.get("/admin/requests/history")
+async def query_request_history(model: Optional[str] = None, status: Optional[int] = None,
+                                path: Optional[str] = None, user: Optional[str] = None,
+                                since: Optional[str] = None, until: Optional[str] = None, limit: int = 100):
+    """Query the persistent request history (`since`/`until` take 1h, 30m, epochs or ISO times)"""
+    if history is None:
+        raise HTTPException(status_code=404, detail="Request history is not enabled (set history.path)")
+    try:
+        window = [parse_since(t) if t is not None else None for t in (since, until)]
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    return {"object": "list", "data": history.query(model, status, path, user, window[0], window[1], limit)}
+
+
+@admin_router.post("/admin/fault")
+async def arm_fault(fault: Fault):
+    """Arm a fault for the next `count` matching requests; it disarms after firing"""
+    entry = faults.arm(fault)
+    return {"id": entry["id"], "remaining": entry["remaining"], **fault.model_dump(exclude_none=True)}
+
+
+@admin_router.get("/admin/faults")
+async def list_faults():
+    """Faults still armed, with how many more requests each will fail"""
+    return {"object": "list", "data": faults.snapshot()}
+
+
+@admin_router.delete("/admin/faults")
+async def disarm_faults(id: Optional[str] = None):
+    """Disarm one fault by id, or all of them"""
+    return {"status": "disarmed", "count": faults.disarm(id)}
+
+
+@admin_router.get("/admin/schema")
+async def get_request_schema():
+    """Request body fields seen per path in this run (schema_drift)"""
+    return {"paths": schema_tracker.current}
+
+
+@admin_router.get("/admin/schema/drift")
+async def get_schema_drift():
+    """Fields and values this run added or stopped sending, compared with the baseline run"""
+    return schema_tracker.drift()
+
+
+@admin_router.post("/admin/schema/baseline")
+async def save_schema_baseline():
+    """Make this run the baseline (written to schema_drift.baseline if set) and start a new run"""
+    try:
+        baseline = schema_tracker.promote()
+    except OSError as e:
+        raise HTTPException(status_code=500, detail=f"Cannot write the baseline: {e}")
+    return {"status": "saved", "saved_at": baseline["saved_at"], "paths": len(baseline["paths"]),
+            "file": schema_tracker.baseline_path}
+
+
+@admin_router.delete("/admin/schema")
+async def reset_request_schema():
+    """Start a new run, keeping the baseline"""
+    schema_tracker.current = {}
+    return {"status": "reset"}
+
+
+@admin_router.delete("/admin/cache")
+async def clear_response_cache():
+    """Drop every response stored by response_cache"""
+    return {"status": "cleared", "count": response_cache.clear()}
+
+
+@admin_router.post("/admin/drain")
+async def start_drain(drain: Optional[DrainRequest] = None):
+    """
+    Drain for maintenance: new API requests get 503 with Retry-After and /readyz fails,
+    while in-flight requests and streams finish. With `wait`, long-polls until they have
+    """
+    drain = drain or DrainRequest()
+    now = time.time()
+    lifecycle.drain = {"started_at": now, "retry_after_seconds": drain.retry_after_seconds,
+                       "until": now + drain.duration_seconds if drain.duration_seconds is not None else None}
+    deadline = time.monotonic() + drain.timeout_seconds
+    while drain.wait and lifecycle.in_flight > 0 and time.monotonic() < deadline:
+        await asyncio.sleep(DRAIN_POLL_SECONDS)
+    return {**lifecycle.describe(), "drained": lifecycle.in_flight == 0}
+
+
+@admin_router.get("/admin/drain")
+async def get_drain():
+    """Whether an admin drain is in effect, and how many API requests are in flight"""
+    return lifecycle.describe()
+
+
+@admin_router.delete("/admin/drain")
+async def end_drain():
+    """End an admin drain: new API requests are served again"""
+    lifecycle.drain = None
+    return lifecycle.describe()
+
+
+@admin_router.get("/admin/streams")
+async def list_streams():
+    """Chat streams in flight, with the chunks each has sent"""
+    return {"object": "list", "data": stream_aborts.snapshot()}
+
+
+@admin_router.post("/admin/streams/{stream_id}/abort")
+async def abort_stream(stream_id: str, abort: Optional[StreamAbort] = None):
+    """End an in-flight chat stream early, cleanly or abruptly, now or after a number of chunks"""
+    abort = abort or StreamAbort()
+    if not stream_aborts.request(stream_id, abort):
+        raise HTTPException(status_code=404, detail=f"No stream '{stream_id}' is in flight")
+    return {"id": stream_id, "status": "aborting", **abort.model_dump(exclude_none=True)}
+
+
+@admin_router.delete("/admin/seeds")
+async def reset_seeds(scenario: Optional[str] = None):
+    """Replay seeded scenarios (one, or all) from their first request"""
+    seeded_random.reset(scenario)
+    return {"status": "reset", "scenario": scenario}
+
+
+@admin_router.delete("/admin/requests")
+async def clear_captured_requests():
+    """Drop all captured requests"""
+    capture.clear()
+    return {"status": "cleared"}
+
+
+@admin_router.get("/admin/state")
+async def get_state():
+    """Export the full simulator state (save it with `curl -o state.json`)"""
+    return export_state()
+
+
+@admin_router.put("/admin/state")
+async def put_state(http_request: Request):
+    """Restore a snapshot previously exported from /admin/state"""
+    try:
+        restore_state(await http_request.json())
+    except (ValueError, ValidationError) as e:
+        raise HTTPException(status_code=400, detail=f"Invalid state snapshot: {e}")
+    return {"status": "restored"}
+
+
+# Runtime diagnostics (the Python counterparts of Go's pprof and expvar), off by default
+PROFILE_MAX_SECONDS = 60
+profile_running = False  # cProfile allows a single active profiler
+
+
+def require_debug():
+    if not config.admin.debug:
+        raise HTTPException(status_code=404, detail="Debug endpoints are disabled (enable admin.debug)")
+
+
+@admin_router.get("/admin/debug/vars")
+async def debug_vars():
+    """Process-level counters in the spirit of /debug/vars"""
+    require_debug()
+    return {
+        "cmdline": sys.argv,
+        "pid": os.getpid(),
+        "python": sys.version,
+        "uptime_seconds": round(time.time() - stats.started, 3),
+        "threads": threading.active_count(),
+        "asyncio_tasks": len(asyncio.all_tasks()),
+        "gc": {"counts": gc.get_count(), "objects": len(gc.get_objects()), "stats": gc.get_stats()},
+        "tracemalloc": tracemalloc.get_traced_memory() if tracemalloc.is_tracing() else None,
+        "scheduler": {"active": gate.active, "queued": gate.queued, "sleeping": timers.waiting,
+                      "timer_slots": timers.slots},
+        "captured_requests": len(capture.entries),
+    }
+
+
+@admin_router.get("/admin/debug/stacks")
+async def debug_stacks():
+    """Current stack of every thread and asyncio task, like pprof's goroutine dump"""
+    require_debug()
+    out = []
+    names = {t.ident: t.name for t in threading.enumerate()}
+    for ident, frame in sys._current_frames().items():
+        out.append(f"thread {names.get(ident, ident)}:\n" + "".join(traceback.format_stack(frame)))
+    for task in asyncio.all_tasks():
+        buf = io.StringIO()
+        task.print_stack(file=buf)
+        out.append(f"task {task.get_name()}:\n" + buf.getvalue())
+    return PlainTextResponse("\n".join(out))
+
+
+@admin_router.get("/admin/debug/profile")
+async def debug_profile(seconds: float = 10, sort: str = "cumulative", limit: int = 50):
+    """CPU profile of the event loop for `seconds`, as pstats text"""
+    require_debug()
+    if not 0 < seconds <= PROFILE_MAX_SECONDS:
+        raise HTTPException(status_code=400, detail=f"seconds must be in (0, {PROFILE_MAX_SECONDS}]")
+    if sort not in pstats.Stats.sort_arg_dict_default:
+        raise HTTPException(status_code=400, detail=f"Unknown sort key '{sort}'")
+    global profile_running
+    if profile_running:
+        raise HTTPException(status_code=409, detail="A profile is already being collected")
+    profile_running = True
+    profiler = cProfile.Profile()
+    profiler.enable()
+    try:
+        await asyncio.sleep(seconds)
+    finally:
+        profiler.disable()
+        profile_running = False
+    buf = io.StringIO()
+    pstats.Stats(profiler, stream=buf).sort_stats(sort).print_stats(limit)
+    return PlainTextResponse(buf.getvalue())
+
+
+@admin_router.get("/admin/debug/heap")
+async def debug_heap(limit: int = 25):
+    """
+    Top allocation sites by size. Tracing starts on the first call, so the first
+    response is empty; call again after some traffic.
+    """
+    require_debug()
+    if not tracemalloc.is_tracing():
+        tracemalloc.start()
+        return PlainTextResponse("tracemalloc started; request again to see allocations\n")
+    top = tracemalloc.take_snapshot().statistics("lineno")[:limit]
+    current, peak = tracemalloc.get_traced_memory()
+    lines = [f"traced: {current} bytes current, {peak} bytes peak"] + [str(stat) for stat in top]
+    return PlainTextResponse("\n".join(lines) + "\n")
+
+
+def serve_admin_on_app(enabled: bool):
+    """Add the /admin routes to `app`, or take them off it when only admin_app serves them"""
+    mounted = any(getattr(route, "path", "").startswith("/admin") for route in app.router.routes)
+    if enabled and not mounted:
+        app.include_router(admin_router)
+    elif not enabled and mounted:
+        app.router.routes[:] = [route for route in app.router.routes
+                                if not getattr(route, "path", "").startswith("/admin")]
+
+
+admin_app.include_router(admin_router)
+serve_admin_on_app(config.admin.port is None)
+
+
+embedded_config: Optional[SimulatorConfig] = None  # the config create_app installed, if any
+
+
+def create_app(sim_config: Optional[SimulatorConfig] = None) -> FastAPI:
+    """
+    The simulator's ASGI app, with every route and middleware, for embedding
+    (`parent.mount("/llm", create_app(cfg))`) instead of re-wiring endpoints.
+    Simulator state is per process, so there is one app: the first config given
+    is installed before the app is mounted anywhere, and a later call with a
+    different one is refused rather than changing an app already in use.
+    """
+    global embedded_config
+    if sim_config is None or sim_config == embedded_config:
+        return app
+    if embedded_config is not None:
+        raise RuntimeError("create_app() already configured the simulator with a different config; "
+                           "it keeps one app per process")
+    install_config(sim_config)
+    serve_admin_on_app(sim_config.admin.port is None)
+    embedded_config = sim_config
+    return app
+
+
+def corrupt_chunks(chunk: Dict[str, Any], corruption: StreamCorruption) -> List[Dict[str, Any]]:
+    """
+    Apply the configured defects to one content chunk, returning the chunk(s) to send:
+    a repeated copy, a copy whose choice index is out of sequence, or an extra role delta.
+    """
+    out = [chunk]
+    if rng().random() < corruption.duplicate_role:
+        role_chunk = json.loads(json.dumps(chunk))
+        role_chunk["choices"][0]["delta"] = {"role": "assistant"}
+        out.insert(0, role_chunk)
+    if rng().random() < corruption.duplicate_content:
+        out.append(json.loads(json.dumps(chunk)))
+    if rng().random() < corruption.out_of_order_index:
+        bad = json.loads(json.dumps(chunk))
+        bad["choices"][0]["index"] = rng().randint(1, 3)
+        out.append(bad)
+    return out
+
+
+def iter_chunk_events(fmt: ChunkFormatter, resolved: ResolvedResponse,
+                      corruption: StreamCorruption, index: int = 0) -> Iterator[str]:
+    """
+    SSE text for each step of a choice's stream: a single pre-framed event normally;
+    with corruption enabled, whatever the defects turn the step into (possibly nothing)
+    """
+    deltas = iter_stream_deltas(resolved)
+    if not corruption.active:
+        for delta in deltas:
+            yield fmt.event(delta, index)
+        return
+    held_back = None  # chunk delayed by the 'reorder' defect
+    for delta in deltas:
+        chunk = fmt.chunk(delta, index=index)
+        if held_back is None and rng().random() < corruption.reorder:
+            held_back = chunk
+            continue
+        events = [sse_event(out) for out in corrupt_chunks(chunk, corruption)]
+        if held_back is not None:
+            events.append(sse_event(held_back))
+            held_back = None
+        yield "".join(events)
+    if held_back is not None:  # the last chunk has nothing to swap with
+        yield sse_event(held_back)
+
+
+async def generate_stream(request: ChatCompletionRequest, resolved: ResolvedResponse,
+                          started: float, tier: ServiceTier, debug: Optional[Dict[str, Any]] = None,
+                          stream_id: Optional[str] = None):
+    """
+    Generate streaming response. With stream_resume, generation runs in the
+    background so a disconnect doesn't stop it, and the client follows its recording
+    """
+    stream_id = stream_id or f"chatcmpl-{uuid.uuid4().hex[:24]}"
+    if not config.stream_resume.enabled:
+        async for event in held_stream(request, resolved, started, tier, debug, stream_id):
+            yield event
+        return
+    recording = stream_recorder.start(stream_id)
+    task = asyncio.create_task(drain(held_stream(request, resolved, started, tier, debug, stream_id, recording)))
+    background_tasks.add(task)
+    task.add_done_callback(background_tasks.discard)
+    async for event in recording.tail():
+        yield event
+
+
+async def held_stream(request: ChatCompletionRequest, resolved: ResolvedResponse, started: float,
+                      tier: ServiceTier, debug: Optional[Dict[str, Any]], stream_id: str,
+                      recording: Optional[StreamRecording] = None) -> AsyncIterator[str]:
+    """A stream's events, holding a capacity slot for its whole duration"""
+    await gate.acquire(tier.rank)
+    stream_aborts.start(stream_id, request.model)
+    try:
+        events = stream_events(request, resolved, started, tier, debug, stream_id)
+        if config.stream_event_ids or recording is not None:
+            events = with_event_ids(events, stream_id, recording or stream_recorder.start(stream_id))
+        async for event in events:
+            yield event
+    finally:
+        stream_aborts.finish(stream_id)
+        gate.release()
+
+
+async def drain(events: AsyncIterator[str]):
+    async for _ in events:
+        pass
+
+
+async def with_event_ids(events: AsyncIterator[str], stream_id: str,
+                         recording: StreamRecording) -> AsyncIterator[str]:
+    """
+    Give each SSE event an incrementing `id: <stream id>:<n>` (comments get none)
+    and record it, so a reconnect with Last-Event-ID can be replayed the rest
+    """
+    index = 0
+    try:
+        async for text in events:
+            out = []
+            for event in text.split("\n\n")[:-1]:  # each yield is one or more whole events
+                if event.startswith(":"):
+                    recording.append(None, event + "\n\n")
+                else:
+                    event = f"id: {stream_id}:{index}\n{event}"
+                    recording.append(index, event + "\n\n")
+                    index += 1
+                out.append(event + "\n\n")
+            yield "".join(out)
+    finally:
+        recording.finish()
+
+
+def iter_stream_deltas(resolved: ResolvedResponse) -> Iterator[Dict[str, Any]]:
+    """
+    Choice deltas for a response (text, a tool call, or a legacy function call),
+    produced one at a time so long responses never exist as a full list of chunks
+    """
+    call = resolved.function_call
+    if call is None:
+        for i, piece in enumerate(iter_stream_pieces(resolved.content)):
+            yield {"role": "assistant", "content": piece} if i == 0 else {"content": piece}
+        return
+    if call.legacy:
+        yield {"role": "assistant", "content": None, "function_call": {"name": call.name, "arguments": ""}}
+        for piece in iter_stream_pieces(call.arguments):
+            yield {"function_call": {"arguments": piece}}
+        return
+    yield {"role": "assistant", "content": None, "tool_calls": [
+        {"index": 0, "id": call.id, "type": "function", "function": {"name": call.name, "arguments": ""}}
+    ]}
+    for piece in iter_stream_pieces(call.arguments):
+        yield {"tool_calls": [{"index": 0, "function": {"arguments": piece}}]}
+
+
+def delta_text(delta: Dict[str, Any]) -> str:
+    """The generated text a chunk delta carries: content, or function call name and arguments"""
+    call = delta.get("function_call") or ((delta.get("tool_calls") or [{}])[0].get("function") or {})
+    return (delta.get("content") or "") + (call.get("name") or "") + (call.get("arguments") or "")
+
+
+def completion_token_count(resolved: ResolvedResponse) -> int:
+    """Estimated completion tokens of every choice, including any function call name and arguments"""
+    total = 0
+    for choice in resolved.choices:
+        call = choice.function_call
+        total += estimate_tokens(call.name + call.arguments if call is not None else choice.content)
+    return total
+
+
+async def stream_events(request: ChatCompletionRequest, resolved: ResolvedResponse,
+                        started: float, tier: ServiceTier, debug: Optional[Dict[str, Any]],
+                        completion_id: Optional[str] = None):
+    """
+    SSE events for a streaming chat completion, one choice after another when n > 1,
+    each closed by its own finish chunk. With a debug report, the last finish chunk
+    carries `timings` and an `: x-sim-debug` comment follows it
+    """
+    completion_id = completion_id or f"chatcmpl-{uuid.uuid4().hex[:24]}"
+    fmt = ChunkFormatter(completion_id, int(time.time()), request.model)
+    latency = resolved.latency
+    clock = DelayClock()
+    delay = latency.first_token_ms * tier.latency_multiplier / 1000
+    await clock.sleep(delay)
+    first_chunk_at = time.perf_counter()
+    
+    # Chunks are built as they are sent, batched when nothing separates them
+    chunk_delay = latency.chunk_delay_ms * tier.latency_multiplier / 1000
+    buffer = SSEBuffer(0 if chunk_delay > 0 else SSE_BATCH_CHARS)
+    abort, sent = None, 0
+    for index, choice in enumerate(resolved.choices):
+        if index > 0:
+            buffer.add(sse_event(fmt.chunk({}, resolved.choices[index - 1].finish_reason, index - 1)))
+        for sent, events in enumerate(iter_chunk_events(fmt, choice, resolved.stream_corruption, index)):
+            abort = stream_aborts.step(completion_id)
+            if abort is not None:
+                break
+            if buffer.add(events):
+                yield buffer.flush()
+                await clock.sleep(chunk_delay)  # Simulate processing delay
+            delay += chunk_delay
+        if abort is not None:
+            break
+    prompt_tokens = prompt_token_count(request.messages, request.model)
+    completion_tokens = completion_token_count(resolved)
+    if abort is not None:
+        # Usage of what was sent: the earlier choices, and this one's first `sent` chunks
+        partial = "".join(delta_text(delta) for delta in itertools.islice(iter_stream_deltas(choice), sent))
+        earlier = resolved.model_copy(update={"others": resolved.others[:index - 1]}) if index > 0 else None
+        completion_tokens = (completion_token_count(earlier) if earlier is not None else 0) + estimate_tokens(partial)
+        if abort.mode == "abrupt":
+            stats.record_usage(request.model, request.user, prompt_tokens, completion_tokens)
+            yield buffer.flush()
+            stats.record_latency(resolved.scenario, clock.simulated, clock.actual)
+            return
+    
+    # Send final chunk
+    final_chunk = fmt.chunk({}, abort.finish_reason if abort is not None else resolved.choices[-1].finish_reason,
+                            index if abort is not None else len(resolved.choices) - 1)
+    finished_at = time.perf_counter()
+    stats.record_throughput(request.model, completion_tokens, finished_at - first_chunk_at, stream_id=fmt.request_id)
+    stats.record_usage(request.model, request.user, prompt_tokens, completion_tokens)
+    if debug is not None:
+        final_chunk["timings"] = build_timings(
+            prompt_tokens, completion_tokens,
+            first_chunk_at - started, finished_at - first_chunk_at
+        ).model_dump()
+    buffer.add(sse_event(final_chunk))
+    if (request.stream_options or {}).get("include_usage"):
+        buffer.add(sse_event({**fmt.chunk({}), "choices": [],
+                              "usage": openai_usage(request, resolved, prompt_tokens, completion_tokens)}))
+    if debug is not None:
+        # A comment, so SSE parsers that don't look for it skip it
+        buffer.add(debug_trailer(debug, delay))
+    buffer.add("data: [DONE]\n\n")
+    yield buffer.flush()
+    stats.record_latency(resolved.scenario, clock.simulated, clock.actual)
+
+
+def vendor_quirks(model: str) -> Optional[VendorQuirks]:
+    """The vendor quirks a model's chat completions get: its own vendor's, else the listener's"""
+    caps = config.models.get(model)
+    name = caps.vendor if caps is not None and caps.vendor is not None else config.vendor
+    return None if name is None else {**VENDOR_QUIRKS, **config.vendors}[name]
+
+
+def vendor_usage(quirks: VendorQuirks, usage: Dict[str, Any], queue_seconds: float,
+                 prompt_seconds: float, completion_seconds: float) -> Dict[str, Any]:
+    """Usage with the vendor's extra fields: Groq's timings, in seconds"""
+    if quirks.usage_timings:
+        usage.update(queue_time=round(queue_seconds, 6), prompt_time=round(prompt_seconds, 6),
+                     completion_time=round(completion_seconds, 6),
+                     total_time=round(prompt_seconds + completion_seconds, 6))
+    return usage
+
+
+def vendor_annotate(body: Dict[str, Any], quirks: VendorQuirks, request_id: str) -> Dict[str, Any]:
+    """A chat completion (or chunk) with the vendor's extra top-level fields"""
+    if quirks.system_fingerprint is not None:
+        body["system_fingerprint"] = quirks.system_fingerprint
+    if quirks.x_groq:
+        body["x_groq"] = {"id": request_id}
+    return body
+
+
+async def vendor_stream(events: AsyncIterator[str], quirks: VendorQuirks, request_id: str,
+                        usage: Dict[str, Any], choices: int) -> AsyncIterator[str]:
+    """
+    A chat stream with a vendor's quirks: its fields on every chunk, except `x_groq`, which
+    Groq sends on the first chunk and, with the usage, on the last choice's finishing chunk.
+    `[DONE]` is only sent if the vendor sends it.
+    """
+    first = True
+    async for text in events:
+        out = []
+        for event in text.split("\n\n")[:-1]:  # each yield is one or more whole events
+            lines = event.split("\n")
+            if lines[-1] == "data: [DONE]" and not quirks.done_marker:
+                continue
+            if lines[-1].startswith("data: {"):
+                chunk = json.loads(lines[-1][6:])
+                if "choices" in chunk:
+                    vendor_annotate(chunk, quirks, request_id)
+                    last = any(c.get("index") == choices - 1 and c.get("finish_reason") for c in chunk["choices"])
+                    if quirks.x_groq and last:
+                        chunk["x_groq"]["usage"] = usage
+                    elif quirks.x_groq and not first:
+                        del chunk["x_groq"]
+                    first = False
+                    lines[-1] = "data: " + SSE_ENCODER.encode(chunk)
+            out.append("\n".join(lines) + "\n\n")
+        if out:
+            yield "".join(out)
+
+
+def completion_body(completion: ChatCompletionResponse) -> Dict[str, Any]:
+    """The JSON body of a completion: unset fields are left out, but tool call messages keep `"content": null`"""
+    body = completion.model_dump(exclude_none=True)
+    for choice in body["choices"]:
+        choice["message"].setdefault("content", None)
+    return body
+
+
+def response_message(resolved: ResolvedResponse) -> Message:
+    """The assistant message for a non-streaming response"""
+    call = resolved.function_call
+    if call is None:
+        return Message(role="assistant", content=resolved.content)
+    if call.legacy:
+        return Message(role="assistant", function_call={"name": call.name, "arguments": call.arguments})
+    return Message(role="assistant", tool_calls=[call.tool_call()])
+
+
+@app.post("/v1/chat/completions", response_model=ChatCompletionResponse, response_model_exclude_none=True)
+async def create_chat_completion(request: ChatCompletionRequest, http_request: Request, response: Response):
+    """Create a chat completion"""
+    started = time.perf_counter()
+    http_request.state.capture_body = request.model_dump(exclude_none=True)
+    
+    # Validate model
+    if request.model not in available_models():
+        raise HTTPException(
+            status_code=400,
+            detail=f"Model {request.model} not found. Available models: {available_models()}"
+        )
+    
+    last_event_id = http_request.headers.get("last-event-id")
+    if request.stream and last_event_id:
+        replay = stream_recorder.after(last_event_id)
+        if replay is not None:
+            return StreamingResponse(replay, media_type="text/event-stream")
+    
+    if config.strict:
+        invalid = validate_messages(request.messages)
+        if invalid is not None:
+            return invalid
+    
+    unsupported = check_capabilities(request)
+    if unsupported is not None:
+        return unsupported
+    
+    limit_headers: Dict[str, str] = {}
+    if request.user is not None:
+        limit = config.user_limits.requests_per_minute
+        retry_after = user_limiter.hit(request.user, limit) if limit > 0 else None
+        stats.record_user_request(request.user, rate_limited=retry_after is not None)
+        if limit > 0:
+            limit_headers = rate_limit_headers(limit, *user_limiter.usage(request.user, limit))
+        if retry_after is not None:
+            return JSONResponse(
+                status_code=429,
+                content=error_body(429, f"Rate limit reached for user '{request.user}': "
+                                        f"{limit} requests per minute. "
+                                        f"Please try again in {openai_duration(retry_after)}."),
+                headers={**limit_headers, **retry_after_headers(retry_after)}
+            )
+    limited, bucket_headers = check_rate_limits(http_request, request.model)
+    if limited is not None:
+        return limited
+    # Report whichever limit is closer to running out
+    limit_headers = min(filter(None, [limit_headers, bucket_headers]), default={},
+                        key=lambda headers: int(headers["x-ratelimit-remaining-requests"]))
+    
+    controls = sim_controls(http_request)
+    invalid = finish_reason_error(dialect_for_request(http_request), controls)
+    if invalid is not None:
+        return invalid
+    resolved = resolve_response(request, controls)
+    failure = rule_error(http_request, resolved, dialect_for_request(http_request))
+    if failure is not None:
+        return failure
+    if config.interactive.enabled:
+        resolved = await console.answer(request, resolved, config.interactive.timeout_seconds)
+    resolved = resolve_choices(request, resolved, controls)
+    http_request.state.capture_response = response_message(resolved).model_dump(exclude_none=True)
+    debug = is_enabled(controls.get("debug"))
+    tier_name, tier = service_tier_for(request, http_request)
+    
+    # Calculate token usage
+    prompt_tokens = prompt_token_count(request.messages, request.model)
+    completion_tokens = completion_token_count(resolved)
+    
+    # Handle streaming
+    if request.stream:
+        # Headers go out before the first token, so report the time to first token
+        first_token_seconds = resolved.latency.first_token_ms * tier.latency_multiplier / 1000
+        headers = processing_headers(time.perf_counter() - started + first_token_seconds)
+        report = debug_report(resolved, request.model, tier_name, prompt_tokens, completion_tokens,
+                              first_token_seconds) if debug else None
+        http_request.state.stream_id = f"chatcmpl-{uuid.uuid4().hex[:24]}"  # for response_cache to spot aborts
+        events = generate_stream(request, resolved, started, tier, report, http_request.state.stream_id)
+        quirks = vendor_quirks(request.model)
+        if quirks is not None:
+            completion_seconds = resolved.latency.per_token_ms * completion_tokens * tier.latency_multiplier / 1000
+            usage = vendor_usage(quirks, openai_usage(request, resolved, prompt_tokens, completion_tokens),
+                                 time.perf_counter() - started, first_token_seconds, completion_seconds)
+            events = vendor_stream(events, quirks, headers["x-request-id"], usage, len(resolved.choices))
+        return StreamingResponse(
+            await stream_retry_events(http_request, resolved, "openai", events),
+            media_type="text/event-stream",
+            headers={**headers, **limit_headers, **resolved.headers, **debug_header(report),
+                     **cost_headers(request.model, prompt_tokens, completion_tokens)}
+        )
+    
+    # Simulate queueing and generation time
+    await gate.acquire(tier.rank)
+    try:
+        admitted = time.perf_counter()
+        latency = resolved.latency
+        delay_seconds = (latency.first_token_ms + latency.per_token_ms * completion_tokens) * tier.latency_multiplier / 1000
+        clock = DelayClock()
+        await clock.sleep(delay_seconds)
+    finally:
+        gate.release()
+    stats.record_latency(resolved.scenario, clock.simulated, clock.actual)
+    elapsed = time.perf_counter() - admitted
+    stats.record_throughput(request.model, completion_tokens, elapsed)
+    stats.record_usage(request.model, request.user, prompt_tokens, completion_tokens)
+    
+    headers = {**processing_headers(time.perf_counter() - started), **limit_headers, **resolved.headers,
+               **cost_headers(request.model, prompt_tokens, completion_tokens)}
+    if debug:
+        headers.update(debug_header(debug_report(resolved, request.model, tier_name, prompt_tokens, completion_tokens,
+                                                 delay_seconds)))
+    response.headers.update(headers)
+    completion = ChatCompletionResponse(
+        id=f"chatcmpl-{uuid.uuid4().hex[:24]}",
+        created=int(time.time()),
+        model=request.model,
+        choices=[
+            Choice(
+                index=index,
+                message=response_message(choice),
+                finish_reason=choice.finish_reason
+            )
+            for index, choice in enumerate(resolved.choices)
+        ],
+        usage=Usage(**openai_usage(request, resolved, prompt_tokens, completion_tokens)),
+        service_tier=tier_name if request.service_tier is not None else None,
+        timings=build_timings(prompt_tokens, completion_tokens, admitted - started, elapsed) if debug else None
+    )
+    
+    quirks = vendor_quirks(request.model)
+    if quirks is not None:
+        body = vendor_annotate(completion_body(completion), quirks, headers["x-request-id"])
+        first_token_seconds = resolved.latency.first_token_ms * tier.latency_multiplier / 1000
+        vendor_usage(quirks, body["usage"], admitted - started, first_token_seconds, delay_seconds - first_token_seconds)
+        return JSONResponse(content=resolved.decorate(body), headers=headers)
+    return JSONResponse(content=resolved.decorate(completion_body(completion)), headers=headers)
+
+
+@app.get("/v1/chat/completions/{completion_id}/stream")
+async def resume_chat_stream(completion_id: str, http_request: Request, after: Optional[int] = None):
+    """Resume a chat stream kept by stream_resume after an event index (?after=N or Last-Event-ID)"""
+    recording = stream_recorder.get(completion_id)
+    if recording is None:
+        return provider_error("openai", 404, f"No resumable stream '{completion_id}' (unknown or expired).",
+                              code="stream_not_found")
+    if after is None:
+        _, _, index = http_request.headers.get("last-event-id", "").rpartition(":")
+        after = int(index) if index.isdigit() else -1
+    return StreamingResponse(recording.tail(after), media_type="text/event-stream")
+
+
+def azure_annotate(body: Dict[str, Any]) -> Dict[str, Any]:
+    """A chat completion (or chunk) with Azure's content filter annotation on each choice"""
+    for choice in body.get("choices", []):
+        # Azure leaves the annotation empty on role-only and finishing chunks
+        delta = choice.get("delta")
+        has_content = delta is None or bool(delta.get("content"))
+        choice["content_filter_results"] = config.azure.filter_results() if has_content else {}
+    return body
+
+
+def azure_prompt_filter_results() -> List[Dict[str, Any]]:
+    return [{"prompt_index": 0, "content_filter_results": config.azure.filter_results()}]
+
+
+async def azure_stream(events: AsyncIterator[Any]) -> AsyncIterator[str]:
+    """
+    A chat stream as Azure sends it: a first chunk with no choices carrying
+    prompt_filter_results, then every chunk annotated
+    """
+    yield sse_event({"choices": [], "created": 0, "id": "", "model": "", "object": "",
+                     "prompt_filter_results": azure_prompt_filter_results()})
+    async for event in events:
+        text = event.decode("utf-8") if isinstance(event, bytes) else event
+        lines = text.split("\n")
+        for i, line in enumerate(lines):
+            if line.startswith("data: {"):
+                lines[i] = "data: " + SSE_ENCODER.encode(azure_annotate(json.loads(line[6:])))
+        yield "\n".join(lines)
+
+
+@app.post("/openai/deployments/{deployment}/chat/completions")
+async def azure_chat_completion(deployment: str, request: ChatCompletionRequest, http_request: Request,
+                                response: Response):
+    """Azure OpenAI chat completions: the deployment picks the model, responses carry content filter results"""
+    model = config.azure.deployments.get(deployment, deployment)
+    if model not in available_models():
+        return JSONResponse(status_code=404, content={"error": {
+            "code": "DeploymentNotFound",
+            "message": "The API deployment for this resource does not exist. If you created the deployment "
+                       "within the last 5 minutes, please wait a moment and try again.",
+        }})
+    request.model = model
+    result = await create_chat_completion(request, http_request, response)
+    if isinstance(result, StreamingResponse):
+        result.body_iterator = azure_stream(result.body_iterator)
+        return result
+    if isinstance(result, ChatCompletionResponse):
+        body = result.model_dump(exclude_none=True)
+        headers = {k: v for k, v in response.headers.items() if k != "content-length"}
+    elif result.status_code == 200:
+        body = json.loads(result.body)
+        headers = {k: v for k, v in result.headers.items() if k not in ("content-length", "content-type")}
+    else:
+        return result
+    body["prompt_filter_results"] = azure_prompt_filter_results()
+    return JSONResponse(content=azure_annotate(body), headers=headers)
+
+
+def openrouter_id(model: str) -> str:
+    """A model's OpenRouter id, `vendor/model`"""
+    if "/" in model:
+        return model
+    vendor = "anthropic" if model.startswith("claude") else "google" if model.startswith("gemini") else "openai"
+    return f"{vendor}/{model}"
+
+
+def openrouter_provider(model_id: str, preferences: Any) -> Optional[str]:
+    """
+    The provider serving a request: the first of its `provider.only` or `provider.order`
+    not in `provider.ignore`, else the configured or vendor's own. None if all are ignored.
+    """
+    vendor, _, model = model_id.rpartition("/")
+    default = config.openrouter.providers.get(model) or OPENROUTER_VENDORS.get(vendor, vendor or "OpenAI")
+    preferences = preferences if isinstance(preferences, dict) else {}
+    ignored = set(preferences.get("ignore") or [])
+    candidates = preferences.get("only") or preferences.get("order") or [default]
+    return next((name for name in candidates if name not in ignored), None)
+
+
+def openrouter_annotate(body: Dict[str, Any], generation_id: str, model_id: str, provider: str) -> Dict[str, Any]:
+    """A chat completion (or chunk) as OpenRouter returns it: its id, model id, provider and native finish reasons"""
+    body.update(id=generation_id, model=model_id, provider=provider)
+    for choice in body.get("choices", []):
+        choice["native_finish_reason"] = choice.get("finish_reason")
+    usage = body.get("usage")
+    if usage is not None:
+        cost = config.pricing.cost(model_id.rpartition("/")[2], usage["prompt_tokens"], usage["completion_tokens"])
+        usage["cost"] = cost or 0.0
+    return body
+
+
+async def openrouter_stream(events: AsyncIterator[Any], generation_id: str, model_id: str,
+                            provider: str) -> AsyncIterator[str]:
+    """A chat stream as OpenRouter sends it: a processing comment first, then every chunk annotated"""
+    yield ": OPENROUTER PROCESSING\n\n"
+    async for event in events:
+        text = event.decode("utf-8") if isinstance(event, bytes) else event
+        lines = text.split("\n")
+        for i, line in enumerate(lines):
+            if line.startswith("data: {"):
+                chunk = json.loads(line[6:])
+                if "choices" in chunk:
+                    lines[i] = "data: " + SSE_ENCODER.encode(openrouter_annotate(chunk, generation_id, model_id, provider))
+        yield "\n".join(lines)
+
+
+def openrouter_error(status: int, message: str) -> JSONResponse:
+    """OpenRouter's error envelope: the status repeated as the code"""
+    return JSONResponse(status_code=status, content={"error": {"message": message, "code": status}})
+
+
+@app.post("/api/v1/chat/completions")
+async def openrouter_chat_completion(request: ChatCompletionRequest, http_request: Request, response: Response):
+    """OpenRouter chat completions: `vendor/model` ids, provider preferences and the provider in responses"""
+    model_id = request.model
+    request.model = model_id.rpartition("/")[2]
+    if request.model not in available_models():
+        return openrouter_error(400, f"{model_id} is not a valid model ID")
+    model_id = openrouter_id(model_id)
+    provider = openrouter_provider(model_id, (await http_request.json()).get("provider"))
+    if provider is None:
+        return openrouter_error(404, "No allowed providers are available for the selected model.")
+    generation_id = f"gen-{int(time.time())}-{uuid.uuid4().hex[:20]}"
+    result = await create_chat_completion(request, http_request, response)
+    if isinstance(result, StreamingResponse):
+        result.body_iterator = openrouter_stream(result.body_iterator, generation_id, model_id, provider)
+        return result
+    if isinstance(result, ChatCompletionResponse):
+        body = result.model_dump(exclude_none=True)
+        headers = {k: v for k, v in response.headers.items() if k != "content-length"}
+    elif result.status_code == 200:
+        body = json.loads(result.body)
+        headers = {k: v for k, v in result.headers.items() if k not in ("content-length", "content-type")}
+    else:
+        return result
+    return JSONResponse(content=openrouter_annotate(body, generation_id, model_id, provider), headers=headers)
+
+
+def per_token(per_million: float) -> str:
+    """A per-million-token price as OpenRouter lists it: USD per token, as a decimal string"""
+    return f"{per_million / 1_000_000:.12f}".rstrip("0").rstrip(".")
+
+
+@app.get("/api/v1/models")
+async def list_openrouter_models():
+    """OpenRouter's model list: `vendor/model` ids with per-token prices and context limits"""
+    data = []
+    for model in available_models():
+        caps = config.models.get(model) or ModelCapabilities()
+        price = config.pricing.models.get(model) or ModelPricing()
+        context_length = caps.max_context or config.openrouter.context_length
+        parameters = ["max_tokens", "temperature", "top_p", "stop", "n"]
+        parameters += ["tools", "tool_choice"] if caps.tools else []
+        parameters += ["response_format", "structured_outputs"] if caps.json_mode else []
+        model_id = openrouter_id(model)
+        data.append({
+            "id": model_id,
+            "canonical_slug": model_id,
+            "name": f"{OPENROUTER_VENDORS.get(model_id.split('/')[0], 'OpenAI')}: {model}",
+            "created": int(time.time()),
+            "description": f"Simulated {model}",
+            "context_length": context_length,
+            "architecture": {
+                "modality": "text+image->text" if caps.vision else "text->text",
+                "input_modalities": ["text", "image"] if caps.vision else ["text"],
+                "output_modalities": ["text"],
+                "tokenizer": "GPT",
+                "instruct_type": None,
+            },
+            "pricing": {"prompt": per_token(price.input), "completion": per_token(price.output),
+                        "request": "0", "image": "0", "web_search": "0", "internal_reasoning": "0"},
+            "top_provider": {"context_length": context_length, "max_completion_tokens": caps.max_output,
+                             "is_moderated": False},
+            "per_request_limits": None,
+            "supported_parameters": parameters,
+        })
+    return {"data": data}
+
+
+def embedding_models() -> Dict[str, EmbeddingModel]:
+    return {**EMBEDDING_MODELS, **config.embedding_models}
+
+
+def embed(text: str, model: str, spec: EmbeddingModel, dimensions: int) -> List[float]:
+    """
+    A deterministic vector for text: the same input always embeds the same. Shortened
+    vectors are the native one cut and renormalized, as text-embedding-3 does.
+    """
+    rng = random.Random(hashlib.sha256(f"{model}\n{text}".encode("utf-8")).digest())
+    vector = [rng.gauss(0, 1) for _ in range(spec.dimensions)][:dimensions]
+    if spec.normalize:
+        norm = math.sqrt(sum(v * v for v in vector)) or 1.0
+        vector = [v / norm for v in vector]
+    return vector
+
+
+@app.post("/v1/embeddings")
+async def create_embeddings(request: EmbeddingRequest, http_request: Request):
+    """Embeddings with each model's dimensions; `dimensions` is checked as the real API does"""
+    http_request.state.capture_body = request.model_dump(exclude_none=True)
+    spec = embedding_models().get(request.model)
+    if spec is None:
+        return provider_error("openai", 404, f"The model `{request.model}` does not exist or you do not have "
+                                             "access to it.", code="model_not_found")
+    dimensions = spec.dimensions
+    if request.dimensions is not None:
+        if not spec.shortenable:
+            return provider_error("openai", 400, "This model does not support specifying dimensions.",
+                                  param="dimensions")
+        if not 1 <= request.dimensions <= spec.dimensions:
+            return provider_error("openai", 400, f"Invalid value for 'dimensions' = {request.dimensions}. Must be "
+                                                 f"between 1 and {spec.dimensions}.",
+                                  param="dimensions", code="invalid_value")
+        dimensions = request.dimensions
+    if request.encoding_format not in ("float", "base64"):
+        return provider_error("openai", 400, f"Invalid value for 'encoding_format': '{request.encoding_format}'. "
+                                             "Supported values are: 'float' and 'base64'.",
+                              param="encoding_format", code="invalid_value")
+    inputs = request.input
+    if not inputs:
+        return provider_error("openai", 400, "'$.input' is invalid. Please check the API reference: "
+                                             "https://platform.openai.com/docs/api-reference.", param="input")
+    if isinstance(inputs, str) or isinstance(inputs[0], int):
+        inputs = [inputs]
+    data, prompt_tokens = [], 0
+    for index, item in enumerate(inputs):
+        if isinstance(item, list):  # token ids
+            text, prompt_tokens = " ".join(map(str, item)), prompt_tokens + len(item)
+        else:
+            text, prompt_tokens = item, prompt_tokens + estimate_tokens(item)
+        vector = embed(text, request.model, spec, dimensions)
+        if request.encoding_format == "base64":
+            vector = base64.b64encode(struct.pack(f"<{len(vector)}f", *vector)).decode("ascii")
+        data.append({"object": "embedding", "index": index, "embedding": vector})
+    stats.record_request(request.model)
+    stats.record_usage(request.model, request.user, prompt_tokens, 0)
+    return JSONResponse(content={
+        "object": "list",
+        "data": data,
+        "model": request.model,
+        "usage": {"prompt_tokens": prompt_tokens, "total_tokens": prompt_tokens},
+    }, headers=cost_headers(request.model, prompt_tokens, 0))
+
+
+# Instruct and base models only served by the legacy /v1/completions endpoint
+COMPLETION_MODELS = ["gpt-3.5-turbo-instruct", "davinci-002", "babbage-002"]
+
+
+def token_prompt_text(tokens: List[int]) -> str:
+    """
+    Text of a pre-tokenized prompt: decoded when the ids are ones the tokenizer
+    produces (see /tokenize), else a placeholder giving their count
+    """
+    if tokens and all(t > 0 and t.to_bytes((t.bit_length() + 7) // 8, "big")[0] == 1 for t in tokens):
+        return active_tokenizer().decode(tokens)
+    return f"[{len(tokens)} prompt tokens]"
+
+
+def completion_prompts(prompt: Union[str, List[str], List[int], List[List[int]]]) -> List[Tuple[str, int]]:
+    """(text, token count) of each prompt; token id prompts count exactly"""
+    if isinstance(prompt, str) or not prompt or isinstance(prompt[0], int):
+        prompt = [prompt]
+    return [(token_prompt_text(item), len(item)) if isinstance(item, list) else (item, estimate_tokens(item))
+            for item in prompt]
+
+
+@app.post("/v1/completions")
+async def create_completion(request: CompletionRequest, http_request: Request):
+    """Legacy text completions: `n` choices per prompt, answered like chat turns from the user"""
+    started = time.perf_counter()
+    http_request.state.capture_body = request.model_dump(exclude_none=True)
+    if request.model not in COMPLETION_MODELS + available_models():
+        return provider_error("openai", 404, f"The model `{request.model}` does not exist or you do not have "
+                                             "access to it.", code="model_not_found")
+    controls = sim_controls(http_request)
+    choices, prompt_tokens, completion_tokens = [], 0, 0
+    for text, tokens in completion_prompts(request.prompt):
+        prompt_tokens += tokens
+        chat = ChatCompletionRequest(model=request.model, messages=[Message(role="user", content=text)],
+                                     max_tokens=request.max_tokens, stop=request.stop, n=request.n,
+                                     user=request.user)
+        resolved = resolve_choices(chat, resolve_response(chat, controls), controls)
+        completion_tokens += completion_token_count(resolved)
+        for choice in resolved.choices:
+            content = choice.function_call.arguments if choice.function_call is not None else choice.content
+            choices.append((text + content if request.echo else content, choice))
+    latency = choices[0][1].latency
+    completion_id = f"cmpl-{uuid.uuid4().hex[:24]}"
+    created = int(time.time())
+
+    def body(index: int, text: str, finish_reason: Optional[str]) -> Dict[str, Any]:
+        return {"text": text, "index": index, "logprobs": None, "finish_reason": finish_reason}
+
+    if request.stream:
+        async def events():
+            head = {"id": completion_id, "object": "text_completion", "created": created, "model": request.model}
+            clock = DelayClock()
+            await clock.sleep(latency.first_token_ms / 1000)
+            for index, (text, choice) in enumerate(choices):
+                for piece in iter_stream_pieces(text):
+                    yield sse_event({**head, "choices": [body(index, piece, None)]})
+                    await clock.sleep(latency.chunk_delay_ms / 1000)
+                yield sse_event({**head, "choices": [body(index, "", choice.finish_reason)]})
+            stats.record_latency(choices[0][1].scenario, clock.simulated, clock.actual)
+            stats.record_usage(request.model, request.user, prompt_tokens, completion_tokens)
+            yield "data: [DONE]\n\n"
+
+        return StreamingResponse(events(), media_type="text/event-stream",
+                                 headers={**processing_headers(time.perf_counter() - started),
+                                          **cost_headers(request.model, prompt_tokens, completion_tokens)})
+
+    clock = DelayClock()
+    await clock.sleep((latency.first_token_ms + latency.per_token_ms * completion_tokens) / 1000)
+    stats.record_latency(choices[0][1].scenario, clock.simulated, clock.actual)
+    stats.record_usage(request.model, request.user, prompt_tokens, completion_tokens)
+    return JSONResponse(content={
+        "id": completion_id,
+        "object": "text_completion",
+        "created": created,
+        "model": request.model,
+        "choices": [body(index, text, choice.finish_reason) for index, (text, choice) in enumerate(choices)],
+        "usage": {"prompt_tokens": prompt_tokens, "completion_tokens": completion_tokens,
+                  "total_tokens": prompt_tokens + completion_tokens},
+    }, headers={**processing_headers(time.perf_counter() - started),
+                **cost_headers(request.model, prompt_tokens, completion_tokens)})
+
+
+# Gemini dialect: generateContent / streamGenerateContent under /v1beta
+GEMINI_MODELS = [
+    "gemini-1.5-flash",
+    "gemini-1.5-pro",
+    "gemini-2.0-flash",
+]
+
+# Categories Gemini rates every candidate on, in the order it reports them
+GEMINI_SAFETY_CATEGORIES = (
+    "HARM_CATEGORY_SEXUALLY_EXPLICIT",
+    "HARM_CATEGORY_HATE_SPEECH",
+    "HARM_CATEGORY_HARASSMENT",
+    "HARM_CATEGORY_DANGEROUS_CONTENT",
+)
+# Category reported as blocked when a response ends with finish_reason content_filter
+GEMINI_BLOCKED_CATEGORY = "HARM_CATEGORY_DANGEROUS_CONTENT"
+
+GEMINI_FINISH_REASONS = {
+    "stop": "STOP",
+    "length": "MAX_TOKENS",
+    "content_filter": "SAFETY",
+    "tool_calls": "STOP",
+    "function_call": "STOP",
+}
+
+
+class GeminiRequest(BaseModel):
+    contents: List[Dict[str, Any]]
+    systemInstruction: Optional[Dict[str, Any]] = None
+    generationConfig: Optional[Dict[str, Any]] = None
+    tools: Optional[List[Dict[str, Any]]] = None
+    toolConfig: Optional[Dict[str, Any]] = None
+    safetySettings: Optional[List[Dict[str, Any]]] = None
+
+
+def gemini_parts_text(parts: List[Dict[str, Any]]) -> str:
+    return "".join(part.get("text", "") for part in parts if isinstance(part, dict))
+
+
+def gemini_to_chat(model: str, request: GeminiRequest) -> ChatCompletionRequest:
+    """The equivalent chat completion request, so rules, fixtures and tools behave the same"""
+    messages = []
+    if request.systemInstruction:
+        messages.append(Message(role="system", content=gemini_parts_text(request.systemInstruction.get("parts", []))))
+    for content in request.contents:
+        role = "assistant" if content.get("role") == "model" else "user"
+        parts = [p for p in content.get("parts", []) if isinstance(p, dict)]
+        calls = [p["functionCall"] for p in parts if "functionCall" in p]
+        results = [p["functionResponse"] for p in parts if "functionResponse" in p]
+        if calls:
+            messages.append(Message(role="assistant", tool_calls=[
+                {"id": call.get("name"), "type": "function",
+                 "function": {"name": call.get("name"), "arguments": json.dumps(call.get("args", {}))}}
+                for call in calls
+            ]))
+        elif results:
+            messages.extend(Message(role="tool", tool_call_id=result.get("name"),
+                                    content=json.dumps(result.get("response", {}))) for result in results)
+        elif any("inlineData" in p or "fileData" in p for p in parts):
+            messages.append(Message(role=role, content=[
+                {"type": "text", "text": p["text"]} if "text" in p else {"type": "image_url", "image_url": {}}
+                for p in parts
+            ]))
+        else:
+            messages.append(Message(role=role, content=gemini_parts_text(parts)))
+    generation = request.generationConfig or {}
+    tools = [{"type": "function", "function": decl}
+             for tool in request.tools or [] for decl in tool.get("functionDeclarations", [])]
+    calling = (request.toolConfig or {}).get("functionCallingConfig", {})
+    mode = calling.get("mode", "AUTO")
+    allowed = calling.get("allowedFunctionNames") or []
+    if mode == "NONE":
+        tool_choice = "none"
+    elif mode == "ANY" and allowed:
+        tool_choice = {"type": "function", "function": {"name": allowed[0]}}
+    elif mode == "ANY":
+        tool_choice = "required"
+    else:
+        tool_choice = None
+    json_mode = generation.get("responseMimeType") == "application/json"
+    return ChatCompletionRequest(
+        model=model,
+        messages=messages,
+        temperature=generation.get("temperature", 1.0),
+        top_p=generation.get("topP", 1.0),
+        max_tokens=generation.get("maxOutputTokens"),
+        n=generation.get("candidateCount", 1),
+        stop=generation.get("stopSequences"),
+        tools=tools or None,
+        tool_choice=tool_choice,
+        response_format={"type": "json_object"} if json_mode else None,
+    )
+
+
+def gemini_safety_ratings(finish_reason: str) -> List[Dict[str, Any]]:
+    ratings = []
+    for category in GEMINI_SAFETY_CATEGORIES:
+        if finish_reason == "content_filter" and category == GEMINI_BLOCKED_CATEGORY:
+            ratings.append({"category": category, "probability": "HIGH", "blocked": True})
+        else:
+            ratings.append({"category": category, "probability": "NEGLIGIBLE"})
+    return ratings
+
+
+def gemini_candidate(parts: Optional[List[Dict[str, Any]]], finish_reason: Optional[str]) -> Dict[str, Any]:
+    """One candidate; blocked candidates carry no content, as Gemini sends them"""
+    candidate: Dict[str, Any] = {}
+    if parts is not None and finish_reason != "content_filter":
+        candidate["content"] = {"parts": parts, "role": "model"}
+    if finish_reason is not None:
+        candidate["finishReason"] = GEMINI_FINISH_REASONS.get(finish_reason, "OTHER")
+    candidate["index"] = 0
+    candidate["safetyRatings"] = gemini_safety_ratings(finish_reason or "stop")
+    return candidate
+
+
+def gemini_usage(prompt_tokens: int, completion_tokens: int) -> Dict[str, int]:
+    usage = {
+        "promptTokenCount": prompt_tokens,
+        "candidatesTokenCount": completion_tokens,
+        "totalTokenCount": prompt_tokens + completion_tokens,
+    }
+    cached = config.prompt_caching.cached(prompt_tokens)
+    if cached:
+        usage["cachedContentTokenCount"] = cached
+    return usage
+
+
+def gemini_call_part(call: PlannedFunctionCall) -> Dict[str, Any]:
+    return {"functionCall": {"name": call.name, "args": json.loads(call.arguments)}}
+
+
+async def gemini_stream(model: str, chat: ChatCompletionRequest, resolved: ResolvedResponse,
+                        tier: ServiceTier, sse: bool, debug: Optional[Dict[str, Any]] = None):
+    """
+    streamGenerateContent output: `data:` events separated by CRLF pairs with alt=sse,
+    else one JSON array streamed element by element. There is no [DONE] marker. With
+    a debug report, an `: x-sim-debug` comment ends an alt=sse stream
+    """
+    await gate.acquire(tier.rank)
+    try:
+        latency = resolved.latency
+        response_id = uuid.uuid4().hex[:22]
+        prompt_tokens = prompt_token_count(chat.messages, chat.model)
+        clock = DelayClock()
+        await clock.sleep(latency.first_token_ms * tier.latency_multiplier / 1000)
+        first_chunk_at = time.perf_counter()
+        chunk_delay = latency.chunk_delay_ms * tier.latency_multiplier / 1000
+
+        def frame(chunk: Dict[str, Any], first: bool) -> str:
+            body = SSE_ENCODER.encode(chunk)
+            if sse:
+                return f"data: {body}\r\n\r\n"
+            return ("[" if first else ",\r\n") + body
+
+        if resolved.function_call is not None:
+            steps: Iterator[Tuple[Dict[str, Any], str]] = iter([(gemini_call_part(resolved.function_call), "")])
+        else:
+            steps = (({"text": piece}, piece) for piece in iter_stream_pieces(resolved.content))
+        sent = ""
+        previous = next(steps, None)
+        first = True
+        while previous is not None:
+            part, text = previous
+            previous = next(steps, None)
+            sent += text
+            finish = resolved.finish_reason if previous is None else None
+            completion_tokens = completion_token_count(resolved) if previous is None else estimate_tokens(sent)
+            chunk = {
+                "candidates": [gemini_candidate([part], finish)],
+                "usageMetadata": gemini_usage(prompt_tokens, completion_tokens),
+                "modelVersion": model,
+                "responseId": response_id,
+            }
+            yield frame(chunk, first)
+            first = False
+            if previous is not None:
+                await clock.sleep(chunk_delay)
+        if first:  # empty response: a lone chunk with the finish reason
+            yield frame({
+                "candidates": [gemini_candidate([{"text": ""}], resolved.finish_reason)],
+                "usageMetadata": gemini_usage(prompt_tokens, 0),
+                "modelVersion": model,
+                "responseId": response_id,
+            }, True)
+        if not sse:
+            yield "]"
+        elif debug is not None:
+            yield debug_trailer(debug, clock.simulated, "\r\n")
+        stats.record_latency(resolved.scenario, clock.simulated, clock.actual)
+        stats.record_throughput(model, completion_token_count(resolved), time.perf_counter() - first_chunk_at,
+                                stream_id=response_id)
+        stats.record_usage(model, None, prompt_token_count(chat.messages, chat.model), completion_token_count(resolved))
+    finally:
+        gate.release()
+
+
+def gemini_models() -> List[str]:
+    return GEMINI_MODELS + [m for m in config.models if m.startswith("gemini") and m not in GEMINI_MODELS]
+
+
+@app.get("/v1beta/models")
+async def list_gemini_models():
+    """Gemini model list"""
+    return {"models": [
+        {"name": f"models/{name}", "displayName": name, "supportedGenerationMethods":
+            ["generateContent", "streamGenerateContent", "countTokens"]}
+        for name in gemini_models()
+    ]}
+
+
+@app.post("/v1beta/models/{target}")
+async def gemini_generate(target: str, http_request: Request, alt: Optional[str] = None):
+    """Gemini generateContent, streamGenerateContent and countTokens"""
+    started = time.perf_counter()
+    model, _, method = target.partition(":")
+    if method not in ("generateContent", "streamGenerateContent", "countTokens"):
+        return provider_error("gemini", 404, f"Method '{method}' is not supported.")
+    if model not in gemini_models():
+        return provider_error("gemini", 404, f"models/{model} is not found for API version v1beta, or is not "
+                                             f"supported for {method}. Call ListModels to see the list of "
+                                             "available models and their supported methods.")
+    try:
+        body = await http_request.json()
+        request = GeminiRequest.model_validate(body)
+        chat = gemini_to_chat(model, request)
+    except ValidationError as e:
+        err = e.errors()[0]
+        return provider_error("gemini", 400, f"Invalid JSON payload received. Invalid value at "
+                                             f"'{format_location(err['loc'])}' ({err['msg']}).")
+    except (ValueError, TypeError, AttributeError) as e:
+        return provider_error("gemini", 400, f"Invalid JSON payload received. {e}")
+    stream = method == "streamGenerateContent"
+    http_request.state.capture_body = body
+    http_request.state.capture_model = model
+    http_request.state.capture_stream = stream
+    if method == "countTokens":
+        return {"totalTokens": prompt_token_count(chat.messages, chat.model)}
+
+    unsupported = check_capabilities(chat, "gemini")
+    if unsupported is not None:
+        return unsupported
+    limited, limit_headers = check_rate_limits(http_request, model, "gemini")
+    if limited is not None:
+        return limited
+
+    controls = sim_controls(http_request)
+    invalid = finish_reason_error("gemini", controls)
+    if invalid is not None:
+        return invalid
+    resolved = resolve_response(chat, controls)
+    failure = rule_error(http_request, resolved, "gemini")
+    if failure is not None:
+        return failure
+    if config.interactive.enabled:
+        resolved = await console.answer(chat, resolved, config.interactive.timeout_seconds)
+    http_request.state.capture_response = response_message(resolved).model_dump(exclude_none=True)
+    tier_name, tier = service_tier_for(chat, http_request)
+    debug = is_enabled(controls.get("debug"))
+    prompt_tokens = prompt_token_count(chat.messages, chat.model)
+    completion_tokens = completion_token_count(resolved)
+    if stream:
+        sse = alt == "sse"
+        first_token_seconds = resolved.latency.first_token_ms * tier.latency_multiplier / 1000
+        headers = processing_headers(time.perf_counter() - started + first_token_seconds)
+        report = debug_report(resolved, model, tier_name, prompt_tokens, completion_tokens,
+                              first_token_seconds) if debug else None
+        headers.update(debug_header(report))
+        events = gemini_stream(model, chat, resolved, tier, sse, report)
+        if sse:
+            events = await stream_retry_events(http_request, resolved, "gemini", events)
+        return StreamingResponse(
+            events,
+            media_type="text/event-stream" if sse else "application/json",
+            headers={**headers, **limit_headers, **resolved.headers,
+                     **cost_headers(model, prompt_tokens, completion_tokens)}
+        )
+
+    await gate.acquire(tier.rank)
+    try:
+        admitted = time.perf_counter()
+        latency = resolved.latency
+        delay_seconds = (latency.first_token_ms + latency.per_token_ms * completion_tokens) * tier.latency_multiplier / 1000
+        clock = DelayClock()
+        await clock.sleep(delay_seconds)
+    finally:
+        gate.release()
+    stats.record_latency(resolved.scenario, clock.simulated, clock.actual)
+    headers = {**processing_headers(time.perf_counter() - started), **limit_headers, **resolved.headers,
+               **cost_headers(model, prompt_tokens, completion_tokens)}
+    if debug:
+        headers.update(debug_header(debug_report(resolved, model, tier_name, prompt_tokens, completion_tokens,
+                                                 delay_seconds)))
+    stats.record_throughput(model, completion_tokens, time.perf_counter() - admitted)
+    stats.record_usage(model, None, prompt_tokens, completion_tokens)
+    if resolved.function_call is not None:
+        parts = [gemini_call_part(resolved.function_call)]
+    else:
+        parts = [{"text": resolved.content}]
+    return JSONResponse(
+        content=resolved.decorate({
+            "candidates": [gemini_candidate(parts, resolved.finish_reason)],
+            "usageMetadata": gemini_usage(prompt_tokens, completion_tokens),
+            "modelVersion": model,
+            "responseId": uuid.uuid4().hex[:22],
+        }),
+        headers=headers
+    )
+
+
+# Anthropic dialect: /v1/messages, with tool_use/tool_result content blocks
+ANTHROPIC_MODELS = [
+    "claude-3-5-haiku-20241022",
+    "claude-3-5-sonnet-20241022",
+    "claude-3-opus-20240229",
+]
+
+ANTHROPIC_STOP_REASONS = {
+    "stop": "end_turn",
+    "length": "max_tokens",
+    "content_filter": "refusal",
+    "tool_calls": "tool_use",
+    "function_call": "tool_use",
+}
+
+
+def anthropic_stop_reason(resolved: ResolvedResponse) -> str:
+    """stop_sequence when a stop sequence cut the text, else the finish reason's equivalent"""
+    if resolved.stop_sequence is not None and resolved.finish_reason == "stop":
+        return "stop_sequence"
+    return ANTHROPIC_STOP_REASONS.get(resolved.finish_reason, "end_turn")
+
+
+class AnthropicRequest(BaseModel):
+    model: str
+    messages: List[Dict[str, Any]]
+    max_tokens: int
+    system: Optional[Any] = None
+    stream: Optional[bool] = False
+    temperature: Optional[float] = 1.0
+    top_p: Optional[float] = None
+    stop_sequences: Optional[List[str]] = None
+    tools: Optional[List[Dict[str, Any]]] = None
+    tool_choice: Optional[Dict[str, Any]] = None
+    metadata: Optional[Dict[str, Any]] = None
+
+
+def anthropic_tool_id(call: PlannedFunctionCall) -> str:
+    """Anthropic-style id (toolu_...) for a planned call"""
+    return "toolu_" + call.id[len("call_"):]
+
+
+def anthropic_to_chat(request: AnthropicRequest) -> ChatCompletionRequest:
+    """The equivalent chat completion request; tool_result blocks become tool messages"""
+    messages = []
+    if request.system:
+        messages.append(Message(role="system", content=anthropic_content_text(request.system)))
+    for msg in request.messages:
+        role = msg.get("role", "user")
+        content = msg.get("content")
+        if not isinstance(content, list):
+            messages.append(Message(role=role, content=content))
+            continue
+        blocks = [b for b in content if isinstance(b, dict)]
+        calls = [b for b in blocks if b.get("type") == "tool_use"]
+        results = [b for b in blocks if b.get("type") == "tool_result"]
+        parts = [
+            {"type": "text", "text": b.get("text", "")} if b.get("type") == "text"
+            else {"type": "image_url", "image_url": {}}
+            for b in blocks if b.get("type") in ("text", "image")
+        ]
+        messages.extend(Message(role="tool", tool_call_id=result.get("tool_use_id"),
+                                content=anthropic_content_text(result.get("content")))
+                        for result in results)
+        if calls:
+            text = " ".join(part["text"] for part in parts if part["type"] == "text")
+            messages.append(Message(role="assistant", content=text or None, tool_calls=[
+                {"id": call.get("id"), "type": "function",
+                 "function": {"name": call.get("name"), "arguments": json.dumps(call.get("input", {}))}}
+                for call in calls
+            ]))
+        elif parts or not results:
+            messages.append(Message(role=role, content=parts))
+    tools = [{"type": "function", "function": {
+                 "name": tool.get("name"), "description": tool.get("description"),
+                 "parameters": tool.get("input_schema")}}
+             for tool in request.tools or []]
+    choice = (request.tool_choice or {}).get("type", "auto")
+    if choice == "none":
+        tool_choice: Optional[Union[str, Dict[str, Any]]] = "none"
+    elif choice == "any":
+        tool_choice = "required"
+    elif choice == "tool":
+        tool_choice = {"type": "function", "function": {"name": request.tool_choice.get("name")}}
+    else:
+        tool_choice = None
+    return ChatCompletionRequest(
+        model=request.model,
+        messages=messages,
+        temperature=request.temperature,
+        top_p=request.top_p,
+        max_tokens=request.max_tokens,
+        stream=request.stream,
+        stop=request.stop_sequences,
+        tools=tools or None,
+        tool_choice=tool_choice,
+        user=(request.metadata or {}).get("user_id"),
+    )
+
+
+def anthropic_content_blocks(resolved: ResolvedResponse) -> List[Dict[str, Any]]:
+    """The response's content blocks: its text, then a tool_use block for a planned call (text only if any)"""
+    call = resolved.function_call
+    if call is None:
+        return [{"type": "text", "text": resolved.content}]
+    blocks = [{"type": "text", "text": resolved.content}] if resolved.content else []
+    return blocks + [{"type": "tool_use", "id": anthropic_tool_id(call), "name": call.name,
+                      "input": json.loads(call.arguments)}]
+
+
+def anthropic_event(data: Dict[str, Any]) -> str:
+    """Anthropic SSE event: the payload's type repeated as the event name"""
+    return f"event: {data['type']}\ndata: {SSE_ENCODER.encode(data)}\n\n"
+
+
+async def anthropic_stream(chat: ChatCompletionRequest, resolved: ResolvedResponse, tier: ServiceTier,
+                           debug: Optional[Dict[str, Any]] = None):
+    """
+    Messages API stream: message_start, the content blocks (text_delta events, then
+    input_json_delta events for a tool_use), message_delta with the stop reason, message_stop.
+    With a debug report, an `: x-sim-debug` comment comes just before message_stop
+    """
+    await gate.acquire(tier.rank)
+    try:
+        latency = resolved.latency
+        message_id = f"msg_{uuid.uuid4().hex[:24]}"
+        prompt_tokens = prompt_token_count(chat.messages, chat.model)
+        completion_tokens = completion_token_count(resolved)
+        yield anthropic_event({"type": "message_start", "message": {
+            "id": message_id, "type": "message", "role": "assistant", "model": chat.model, "content": [],
+            "stop_reason": None, "stop_sequence": None,
+            "usage": anthropic_usage(prompt_tokens, 1),
+        }})
+        yield anthropic_event({"type": "ping"})
+        clock = DelayClock()
+        await clock.sleep(latency.first_token_ms * tier.latency_multiplier / 1000)
+        first_chunk_at = time.perf_counter()
+        chunk_delay = latency.chunk_delay_ms * tier.latency_multiplier / 1000
+
+        call = resolved.function_call
+        blocks: List[Tuple[Dict[str, Any], Iterator[Dict[str, Any]]]] = []
+        if call is None or resolved.content:
+            blocks.append(({"type": "text", "text": ""},
+                           ({"type": "text_delta", "text": piece} for piece in iter_stream_pieces(resolved.content))))
+        if call is not None:
+            blocks.append(({"type": "tool_use", "id": anthropic_tool_id(call), "name": call.name, "input": {}},
+                           ({"type": "input_json_delta", "partial_json": piece}
+                            for piece in iter_stream_pieces(call.arguments))))
+        for index, (block, deltas) in enumerate(blocks):
+            yield anthropic_event({"type": "content_block_start", "index": index, "content_block": block})
+            for delta in deltas:
+                yield anthropic_event({"type": "content_block_delta", "index": index, "delta": delta})
+                await clock.sleep(chunk_delay)
+            yield anthropic_event({"type": "content_block_stop", "index": index})
+        yield anthropic_event({
+            "type": "message_delta",
+            "delta": {"stop_reason": anthropic_stop_reason(resolved),
+                      "stop_sequence": resolved.stop_sequence},
+            "usage": {"output_tokens": completion_tokens},
+        })
+        if debug is not None:
+            yield debug_trailer(debug, clock.simulated)
+        yield anthropic_event({"type": "message_stop"})
+        stats.record_latency(resolved.scenario, clock.simulated, clock.actual)
+        stats.record_throughput(chat.model, completion_tokens, time.perf_counter() - first_chunk_at,
+                                stream_id=message_id)
+        stats.record_usage(chat.model, chat.user, prompt_tokens, completion_tokens)
+    finally:
+        gate.release()
+
+
+def anthropic_models() -> List[str]:
+    return ANTHROPIC_MODELS + [m for m in config.models if m.startswith("claude") and m not in ANTHROPIC_MODELS]
+
+
+def anthropic_model_list() -> Dict[str, Any]:
+    """Anthropic's /v1/models page (everything fits on one)"""
+    names = anthropic_models()
+    return {
+        "data": [{"type": "model", "id": name, "display_name": name,
+                  "created_at": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime())}
+                 for name in names],
+        "has_more": False,
+        "first_id": names[0],
+        "last_id": names[-1],
+    }
+
+
+@app.post("/v1/messages")
+async def create_message(http_request: Request):
+    """Anthropic Messages API, including tool use"""
+    started = time.perf_counter()
+    try:
+        body = await http_request.json()
+        request = AnthropicRequest.model_validate(body)
+        chat = anthropic_to_chat(request)
+    except ValidationError as e:
+        err = e.errors()[0]
+        return provider_error("anthropic", 400, f"{format_location(err['loc'])}: {err['msg']}")
+    except (ValueError, TypeError, AttributeError) as e:
+        return provider_error("anthropic", 400, f"Invalid request body: {e}")
+    http_request.state.capture_body = body
+    if request.model not in anthropic_models():
+        return provider_error("anthropic", 404, f"model: {request.model}")
+
+    unsupported = check_capabilities(chat, "anthropic")
+    if unsupported is not None:
+        return unsupported
+    limited, limit_headers = check_rate_limits(http_request, chat.model, "anthropic")
+    if limited is not None:
+        return limited
+
+    controls = sim_controls(http_request)
+    invalid = finish_reason_error("anthropic", controls)
+    if invalid is not None:
+        return invalid
+    resolved = resolve_response(chat, controls)
+    failure = rule_error(http_request, resolved, "anthropic")
+    if failure is not None:
+        return failure
+    if config.interactive.enabled:
+        resolved = await console.answer(chat, resolved, config.interactive.timeout_seconds)
+    http_request.state.capture_response = response_message(resolved).model_dump(exclude_none=True)
+    tier_name, tier = service_tier_for(chat, http_request)
+    debug = is_enabled(controls.get("debug"))
+    prompt_tokens = prompt_token_count(chat.messages, chat.model)
+    completion_tokens = completion_token_count(resolved)
+    if request.stream:
+        first_token_seconds = resolved.latency.first_token_ms * tier.latency_multiplier / 1000
+        headers = processing_headers(time.perf_counter() - started + first_token_seconds)
+        report = debug_report(resolved, chat.model, tier_name, prompt_tokens, completion_tokens,
+                              first_token_seconds) if debug else None
+        headers.update(debug_header(report))
+        return StreamingResponse(
+            await stream_retry_events(http_request, resolved, "anthropic", anthropic_stream(chat, resolved, tier, report)),
+            media_type="text/event-stream",
+            headers={**headers, **limit_headers, **resolved.headers,
+                     **cost_headers(chat.model, prompt_tokens, completion_tokens)}
+        )
+
+    await gate.acquire(tier.rank)
+    try:
+        admitted = time.perf_counter()
+        latency = resolved.latency
+        delay_seconds = (latency.first_token_ms + latency.per_token_ms * completion_tokens) * tier.latency_multiplier / 1000
+        clock = DelayClock()
+        await clock.sleep(delay_seconds)
+    finally:
+        gate.release()
+    stats.record_latency(resolved.scenario, clock.simulated, clock.actual)
+    headers = {**processing_headers(time.perf_counter() - started), **limit_headers, **resolved.headers,
+               **cost_headers(chat.model, prompt_tokens, completion_tokens)}
+    if debug:
+        headers.update(debug_header(debug_report(resolved, chat.model, tier_name, prompt_tokens, completion_tokens,
+                                                 delay_seconds)))
+    stats.record_throughput(chat.model, completion_tokens, time.perf_counter() - admitted)
+    stats.record_usage(chat.model, chat.user, prompt_tokens, completion_tokens)
+    return JSONResponse(
+        content=resolved.decorate({
+            "id": f"msg_{uuid.uuid4().hex[:24]}",
+            "type": "message",
+            "role": "assistant",
+            "model": chat.model,
+            "content": anthropic_content_blocks(resolved),
+            "stop_reason": anthropic_stop_reason(resolved),
+            "stop_sequence": resolved.stop_sequence,
+            "usage": anthropic_usage(prompt_tokens, completion_tokens),
+        }),
+        headers=headers
+    )
+
+
+# In-process benchmarks of the hot paths, for `simulator.py bench`
+BENCH_PROMPT = "Summarize the quarterly report in three bullet points."
+BENCH_LONG_TEXT = "The quick brown fox jumps over the lazy dog while the simulator streams tokens. " * 40
+
+
+def bench_cases(loop: asyncio.AbstractEventLoop) -> Dict[str, Tuple[Any, int]]:
+    """Benchmark name -> (one operation, items it produces), using the current config and running async ones on `loop`"""
+    request = ChatCompletionRequest(model=AVAILABLE_MODELS[0],
+                                    messages=[Message(role="user", content=BENCH_PROMPT)])
+    long_request = request.model_copy(update={"stream": True})
+    long_response = ResolvedResponse(content=BENCH_LONG_TEXT)
+    chunks = sum(1 for _ in iter_stream_deltas(long_response))
+    fmt = ChunkFormatter("chatcmpl-bench", int(time.time()), request.model)
+
+    async def drain_stream():
+        async for _ in stream_events(long_request, long_response, time.perf_counter(), ServiceTier(), None):
+            pass
+
+    return {
+        "resolve_response": (lambda: resolve_response(request), 1),
+        "estimate_tokens": (lambda: estimate_tokens(BENCH_LONG_TEXT), 1),
+        "chunk_events": (lambda: sum(1 for _ in iter_chunk_events(fmt, long_response, config.stream_corruption)), chunks),
+        "stream_events": (lambda: loop.run_until_complete(drain_stream()), chunks + 2),
+    }
+
+
+def run_benchmark(op, seconds: float) -> Dict[str, float]:
+    """Repeat `op` for about `seconds`; report ops/sec and the peak memory one run allocates"""
+    ops = 0
+    started = time.perf_counter()
+    deadline = started + seconds
+    while True:
+        op()
+        ops += 1
+        if ops % 16 == 0 and time.perf_counter() >= deadline:
+            break
+    elapsed = time.perf_counter() - started
+    tracemalloc.start()
+    try:
+        op()
+        peak = tracemalloc.get_traced_memory()[1]
+    finally:
+        tracemalloc.stop()
+    return {"ops": ops, "ops_per_sec": ops / elapsed, "us_per_op": elapsed / ops * 1e6, "peak_bytes_per_op": peak}
+
+
+def bench_command(argv: List[str]):
+    """`bench`: run the in-process benchmarks, failing if any falls below its budget"""
+    global config
+    import argparse
+
+    parser = argparse.ArgumentParser(prog="simulator.py bench", description="Benchmark response generation and streaming")
+    parser.add_argument("--config", help="Benchmark with this YAML/JSON config (rules, generators, corruption)")
+    parser.add_argument("--seconds", type=float, default=1.0, help="Time spent on each benchmark (default: 1)")
+    parser.add_argument("--only", action="append", metavar="NAME", help="Run only this benchmark (repeatable)")
+    parser.add_argument("--budget", action="append", default=[], metavar="NAME=OPS",
+                        help="Fail unless NAME reaches OPS operations per second (repeatable)")
+    parser.add_argument("--json", action="store_true", help="Print results as JSON")
+    args = parser.parse_args(argv)
+
+    budgets: Dict[str, float] = {}
+    for item in args.budget:
+        name, _, value = item.partition("=")
+        try:
+            budgets[name] = float(value)
+        except ValueError:
+            parser.error(f"invalid budget '{item}', expected NAME=OPS")
+    try:
+        loaded = load_config(args.config)
+    except (OSError, yaml.YAMLError, ValidationError) as e:
+        parser.error(f"invalid configuration: {e}")
+    # Measure the simulator's own cost, not its simulated latency
+    config = loaded.model_copy(update={"latency": LatencyConfig(first_token_ms=0, per_token_ms=0, chunk_delay_ms=0)})
+    loop = asyncio.new_event_loop()
+    try:
+        cases = bench_cases(loop)
+        unknown = sorted((set(args.only or []) | set(budgets)) - set(cases))
+        if unknown:
+            parser.error(f"unknown benchmark(s) {unknown}, available: {sorted(cases)}")
+
+        results = {}
+        for name, (op, items) in cases.items():
+            if args.only and name not in args.only:
+                continue
+            result = run_benchmark(op, args.seconds)
+            result["items_per_sec"] = result["ops_per_sec"] * items
+            results[name] = result
+    finally:
+        loop.close()
+    failures = [f"{name}: {results[name]['ops_per_sec']:,.0f} ops/sec < budget {minimum:,.0f}"
+                for name, minimum in budgets.items() if name in results and results[name]["ops_per_sec"] < minimum]
+
+    if args.json:
+        print(json.dumps({"results": results, "budget_failures": failures}, indent=2))
+    else:
+        print(f"{'benchmark':<20} {'ops/sec':>12} {'us/op':>10} {'items/sec':>12} {'peak B/op':>11}")
+        for name, r in results.items():
+            print(f"{name:<20} {r['ops_per_sec']:>12,.0f} {r['us_per_op']:>10.1f} "
+                  f"{r['items_per_sec']:>12,.0f} {r['peak_bytes_per_op']:>11,}")
+        for failure in failures:
+            print(f"BUDGET FAILED {failure}")
+    if failures:
+        sys.exit(1)
+
+
+def format_location(loc: Tuple) -> str:
+    """Pydantic error location as a config path, e.g. rules[0].variants"""
+    path = ""
+    for part in loc:
+        path += f"[{part}]" if isinstance(part, int) else (f".{part}" if path else str(part))
+    return path or "(top level)"
+
+
+def unknown_keys(model: type, data: Any, path: str = "") -> List[str]:
+    """Paths of keys in `data` that `model` ignores (usually typos)"""
+    if not isinstance(data, dict):
+        return []
+    found = []
+    for key, value in data.items():
+        where = f"{path}.{key}" if path else str(key)
+        field = model.model_fields.get(key)
+        if field is None:
+            found.append(where)
+            continue
+        annotation = field.annotation
+        while typing.get_origin(annotation) is Union:  # Optional[X]
+            annotation = next(a for a in typing.get_args(annotation) if a is not type(None))
+        origin, args = typing.get_origin(annotation), typing.get_args(annotation)
+        if isinstance(annotation, type) and issubclass(annotation, BaseModel):
+            found += unknown_keys(annotation, value, where)
+        elif origin is list and args and isinstance(args[0], type) and issubclass(args[0], BaseModel) \
+                and isinstance(value, list):
+            for i, item in enumerate(value):
+                found += unknown_keys(args[0], item, f"{where}[{i}]")
+        elif origin is dict and len(args) == 2 and isinstance(args[1], type) and issubclass(args[1], BaseModel) \
+                and isinstance(value, dict):
+            for name, item in value.items():
+                found += unknown_keys(args[1], item, f"{where}.{name}")
+    return found
+
+
+def config_warnings(loaded: SimulatorConfig) -> List[str]:
+    """Valid but probably unintended settings"""
+    warnings = []
+    seen: Dict[str, int] = {}
+    catch_all = None
+    for i, rule in enumerate(loaded.rules):
+        if rule.name in seen:
+            warnings.append(f"rules[{i}]: name '{rule.name}' is already used by rules[{seen[rule.name]}]; "
+                            f"their stats will be merged")
+        seen.setdefault(rule.name, i)
+        if catch_all is not None:
+            warnings.append(f"rules[{i}] '{rule.name}' can never match: rules[{catch_all}] matches every request")
+        elif rule.match == RuleMatch():
+            catch_all = i
+    return warnings
+
+
+def validate_command(argv: List[str]):
+    """`validate`: check a config file without starting the server"""
+    import argparse
+
+    parser = argparse.ArgumentParser(prog="simulator.py validate", description="Validate a simulator config file")
+    parser.add_argument("--config", required=True, help="Path to the YAML/JSON config to check, or builtin:NAME")
+    parser.add_argument("--fail-on-warnings", action="store_true", help="Exit with status 1 on warnings too")
+    args = parser.parse_args(argv)
+    path = args.config
+
+    errors: List[str] = []
+    warnings: List[str] = []
+    loaded = None
+    try:
+        data = read_config_file(scenario_path(path))
+        warnings += [f"{key}: unknown key (ignored)" for key in unknown_keys(SimulatorConfig, data)]
+        loaded = SimulatorConfig.model_validate(data)
+    except OSError as e:
+        errors.append(f"cannot read file: {e}")
+    except (yaml.YAMLError, json.JSONDecodeError) as e:
+        errors.append(f"syntax error: {e}")
+    except ValidationError as e:
+        for err in e.errors():
+            message = re.sub(r"^Value error, ", "", err["msg"])
+            errors.append(f"{format_location(err['loc'])}: {message}")
+    except ValueError as e:
+        errors.append(str(e))
+    if loaded is not None:
+        warnings += config_warnings(loaded)
+        try:
+            MarkovChain.from_files(loaded.markov.corpus, loaded.markov.order)
+        except OSError as e:
+            errors.append(f"markov.corpus: cannot read {e.filename}: {e.strerror}")
+        try:
+            FixtureStore.from_files(loaded.fixtures.files)
+        except OSError as e:
+            errors.append(f"fixtures.files: cannot read {e.filename}: {e.strerror}")
+        except ValueError as e:
+            errors.append(f"fixtures.files: {e}")
+        try:
+            TranscriptStore.from_config(loaded.transcripts)
+        except OSError as e:
+            errors.append(f"transcripts.dir: cannot read {e.filename}: {e.strerror}")
+        except ValueError as e:
+            errors.append(f"transcripts: {e}")
+
+    for error in errors:
+        print(f"{path}: error: {error}")
+    for warning in warnings:
+        print(f"{path}: warning: {warning}")
+    if errors or (warnings and args.fail_on_warnings):
+        sys.exit(1)
+    print(f"{path}: OK ({len(loaded.rules)} rules)")
+
+
+def http_call(method: str, url: str, body: Any = None, headers: Optional[Dict[str, str]] = None,
+              timeout: float = 60) -> Tuple[int, bytes, float, Dict[str, str]]:
+    """One HTTP request with the standard library: (status, body, seconds to first byte, headers)"""
+    import urllib.error
+    import urllib.request
+
+    data = json.dumps(body).encode() if body is not None else None
+    req = urllib.request.Request(url, data=data, method=method,
+                                 headers={"Content-Type": "application/json", **(headers or {})})
+    started = time.perf_counter()
+    try:
+        with urllib.request.urlopen(req, timeout=timeout) as resp:
+            first = resp.read(1)
+            ttfb = time.perf_counter() - started
+            return resp.status, first + resp.read(), ttfb, {k.lower(): v for k, v in resp.headers.items()}
+    except urllib.error.HTTPError as e:
+        return e.code, e.read(), time.perf_counter() - started, {k.lower(): v for k, v in e.headers.items()}
+
+
+def parse_header_args(parser, items: List[str]) -> Dict[str, str]:
+    headers = {}
+    for item in items:
+        name, sep, value = item.partition(":")
+        if not sep or not name.strip():
+            parser.error(f"invalid header '{item}', expected 'Name: value'")
+        headers[name.strip()] = value.strip()
+    return headers
+
+
+def record_command(argv: List[str]):
+    """`record`: save a running simulator's captured requests as JSONL for `replay`"""
+    import argparse
+    import urllib.error
+
+    parser = argparse.ArgumentParser(prog="simulator.py record",
+                                     description="Save captured requests from a running simulator")
+    parser.add_argument("--from", dest="source", default="http://localhost:8000",
+                        help="Base URL of the simulator's admin endpoints (default: http://localhost:8000)")
+    parser.add_argument("--out", required=True, help="JSONL file to write, one request per line")
+    parser.add_argument("--limit", type=int, help="Only the most recent N requests")
+    parser.add_argument("--admin-token", default=os.getenv("LLM_SIM_ADMIN_TOKEN"),
+                        help="Bearer token for the admin endpoints (default: $LLM_SIM_ADMIN_TOKEN)")
+    parser.add_argument("--clear", action="store_true", help="Clear the captured requests once saved")
+    args = parser.parse_args(argv)
+
+    base = args.source.rstrip("/")
+    headers = {"Authorization": f"Bearer {args.admin_token}"} if args.admin_token else {}
+    query = f"?limit={args.limit}" if args.limit else ""
+    try:
+        status, body, _, _ = http_call("GET", f"{base}/admin/requests{query}", headers=headers)
+        if status != 200:
+            sys.exit(f"record: {base} answered {status}: {body.decode(errors='replace')[:200]}")
+        entries = [e for e in json.loads(body)["data"] if e.get("body") is not None]
+        with open(args.out, "w", encoding="utf-8") as f:
+            for entry in entries:
+                f.write(json.dumps(entry, ensure_ascii=False) + "\n")
+        if args.clear:
+            http_call("DELETE", f"{base}/admin/requests", headers=headers)
+    except (OSError, urllib.error.URLError) as e:
+        sys.exit(f"record: {e}")
+    print(f"Recorded {len(entries)} requests to {args.out}")
+
+
+def export_command(argv: List[str]):
+    """`export`: turn captured chat traffic into OpenAI fine-tuning JSONL"""
+    import argparse
+    import urllib.error
+
+    parser = argparse.ArgumentParser(prog="simulator.py export",
+                                     description="Write captured chat conversations as fine-tuning JSONL")
+    source = parser.add_mutually_exclusive_group()
+    source.add_argument("--from", dest="source", default="http://localhost:8000",
+                        help="Base URL of a running simulator's admin endpoints (default: http://localhost:8000)")
+    source.add_argument("--file", help="JSONL file written by `record` instead of a running simulator")
+    source.add_argument("--db", help="Request history database (`--history`) instead of a running simulator")
+    parser.add_argument("--out", required=True, help="JSONL file to write, one training example per line")
+    parser.add_argument("--since", help="With --db, only requests after this time (30m, 1h, 2d, epoch or ISO)")
+    parser.add_argument("--model", help="With --db, only this model")
+    parser.add_argument("--admin-token", default=os.getenv("LLM_SIM_ADMIN_TOKEN"),
+                        help="Bearer token for the admin endpoints (default: $LLM_SIM_ADMIN_TOKEN)")
+    args = parser.parse_args(argv)
+
+    try:
+        if args.file:
+            with open(args.file, encoding="utf-8") as f:
+                entries = [json.loads(line) for line in f if line.strip()]
+        elif args.db:
+            if not os.path.exists(args.db):
+                parser.error(f"no history database at {args.db}")
+            since = parse_since(args.since) if args.since else None
+            entries = RequestHistory(args.db).query(model=args.model, since=since, limit=None)
+        else:
+            base = args.source.rstrip("/")
+            headers = {"Authorization": f"Bearer {args.admin_token}"} if args.admin_token else {}
+            status, body, _, _ = http_call("GET", f"{base}/admin/requests", headers=headers)
+            if status != 200:
+                sys.exit(f"export: {base} answered {status}: {body.decode(errors='replace')[:200]}")
+            entries = json.loads(body)["data"]
+        examples = finetune_examples(entries)
+        with open(args.out, "w", encoding="utf-8") as f:
+            for example in examples:
+                f.write(json.dumps(example, ensure_ascii=False) + "\n")
+    except ValueError as e:
+        parser.error(str(e))
+    except (OSError, sqlite3.Error, urllib.error.URLError) as e:
+        sys.exit(f"export: {e}")
+    print(f"Exported {len(examples)} conversations ({len(entries) - len(examples)} requests skipped) to {args.out}")
+
+
+def replay_command(argv: List[str]):
+    """`replay`: re-send recorded requests to a target, comparing statuses with the recording"""
+    import argparse
+    import urllib.error
+
+    parser = argparse.ArgumentParser(prog="simulator.py replay", description="Re-send recorded requests")
+    parser.add_argument("--file", required=True, help="JSONL file written by `record`")
+    parser.add_argument("--target", default="http://localhost:8000",
+                        help="Base URL to send the requests to (default: http://localhost:8000)")
+    parser.add_argument("--header", action="append", default=[], metavar="'NAME: VALUE'",
+                        help="Extra request header, e.g. 'Authorization: Bearer sk-test' (repeatable)")
+    parser.add_argument("--check-status", action="store_true",
+                        help="Exit with status 1 if any status differs from the recorded one")
+    args = parser.parse_args(argv)
+    headers = parse_header_args(parser, args.header)
+
+    try:
+        with open(args.file, "r", encoding="utf-8") as f:
+            entries = [json.loads(line) for line in f if line.strip()]
+    except (OSError, ValueError) as e:
+        parser.error(f"cannot read {args.file}: {e}")
+    target = args.target.rstrip("/")
+    mismatches = 0
+    for entry in entries:
+        try:
+            status, _, _, _ = http_call(entry.get("method", "POST"), target + entry["path"], entry.get("body"), headers)
+        except (OSError, urllib.error.URLError) as e:
+            sys.exit(f"replay: {e}")
+        recorded = entry.get("status")
+        marker = "" if recorded in (None, status) else "  MISMATCH"
+        mismatches += bool(marker)
+        print(f"{entry.get('method', 'POST')} {entry['path']} -> {status} (recorded {recorded}){marker}")
+    print(f"Replayed {len(entries)} requests, {mismatches} status mismatches")
+    if mismatches and args.check_status:
+        sys.exit(1)
+
+
+def percentile(values: List[float], pct: float) -> float:
+    if not values:
+        return 0.0
+    ordered = sorted(values)
+    return ordered[min(len(ordered) - 1, int(len(ordered) * pct / 100))]
+
+
+def loadgen_command(argv: List[str]):
+    """`loadgen`: drive chat completion traffic at a target and report throughput and latency"""
+    import argparse
+    import urllib.error
+
+    parser = argparse.ArgumentParser(prog="simulator.py loadgen", description="Generate chat completion load")
+    parser.add_argument("--target", default="http://localhost:8000",
+                        help="Base URL to load (default: http://localhost:8000)")
+    parser.add_argument("--concurrency", type=int, default=8, help="Parallel clients (default: 8)")
+    parser.add_argument("--duration", type=float, default=10, help="Seconds to run (default: 10)")
+    parser.add_argument("--requests", type=int, help="Stop after this many requests instead")
+    parser.add_argument("--model", default=AVAILABLE_MODELS[0], help=f"Model to request (default: {AVAILABLE_MODELS[0]})")
+    parser.add_argument("--prompt", default=BENCH_PROMPT, help="User message to send")
+    parser.add_argument("--stream", action="store_true", help="Request streaming responses")
+    parser.add_argument("--header", action="append", default=[], metavar="'NAME: VALUE'",
+                        help="Extra request header (repeatable)")
+    parser.add_argument("--json", action="store_true", help="Print results as JSON")
+    args = parser.parse_args(argv)
+    if args.concurrency < 1:
+        parser.error("--concurrency must be at least 1")
+    headers = parse_header_args(parser, args.header)
+
+    url = args.target.rstrip("/") + "/v1/chat/completions"
+    body = {"model": args.model, "messages": [{"role": "user", "content": args.prompt}], "stream": args.stream}
+    lock = threading.Lock()
+    latencies: List[float] = []
+    ttfbs: List[float] = []
+    statuses: Dict[str, int] = {}
+    sent = itertools.count()
+    deadline = time.perf_counter() + args.duration
+
+    def worker():
+        while time.perf_counter() < deadline:
+            if args.requests is not None and next(sent) >= args.requests:
+                return
+            started = time.perf_counter()
+            try:
+                status, _, ttfb, _ = http_call("POST", url, body, headers)
+                key = str(status)
+            except (OSError, urllib.error.URLError) as e:
+                ttfb, key = None, type(e).__name__
+            elapsed = time.perf_counter() - started
+            with lock:
+                statuses[key] = statuses.get(key, 0) + 1
+                latencies.append(elapsed)
+                if ttfb is not None:
+                    ttfbs.append(ttfb)
+
+    started = time.perf_counter()
+    threads = [threading.Thread(target=worker, daemon=True) for _ in range(args.concurrency)]
+    for thread in threads:
+        thread.start()
+    try:
+        for thread in threads:
+            thread.join()
+    except KeyboardInterrupt:
+        deadline = 0  # workers finish their current request
+    elapsed = time.perf_counter() - started
+
+    total = len(latencies)
+    report = {
+        "requests": total,
+        "seconds": round(elapsed, 3),
+        "requests_per_sec": round(total / elapsed, 2) if elapsed > 0 else 0.0,
+        "statuses": statuses,
+        "latency_ms": {f"p{p}": round(percentile(latencies, p) * 1000, 2) for p in (50, 90, 99)},
+        "ttfb_ms": {f"p{p}": round(percentile(ttfbs, p) * 1000, 2) for p in (50, 90, 99)},
+    }
+    if args.json:
+        print(json.dumps(report, indent=2))
+        return
+    print(f"{total} requests in {report['seconds']}s ({report['requests_per_sec']} req/s), "
+          f"concurrency {args.concurrency}")
+    print("statuses: " + ", ".join(f"{k}={v}" for k, v in sorted(statuses.items())))
+    print("latency:  " + ", ".join(f"{k}={v}ms" for k, v in report["latency_ms"].items()))
+    print("ttfb:     " + ", ".join(f"{k}={v}ms" for k, v in report["ttfb_ms"].items()))
+
+
+class ScenarioRequest(BaseModel):
+    """One request of a scenario test; body defaults suit /v1/chat/completions"""
+    method: str = "POST"
+    path: str = "/v1/chat/completions"
+    headers: Dict[str, str] = {}
+    body: Optional[Dict[str, Any]] = None
+
+
+class ScenarioExpect(BaseModel):
+    """Expectations on the response; unset fields are not checked"""
+    status: Optional[int] = 200
+    content: Optional[str] = None        # exact assistant text (streams: concatenated deltas)
+    contains: Optional[str] = None
+    finish_reason: Optional[str] = None
+    chunks: Optional[int] = Field(None, ge=0)  # stream chunks carrying content
+    min_chunks: Optional[int] = Field(None, ge=0)
+    max_chunks: Optional[int] = Field(None, ge=0)
+    headers: Dict[str, str] = {}         # response headers that must be present with these values
+
+
+class ScenarioStep(BaseModel):
+    name: str
+    request: ScenarioRequest = Field(default_factory=ScenarioRequest)
+    expect: ScenarioExpect = Field(default_factory=ScenarioExpect)
+
+
+class ScenarioTest(BaseModel):
+    """A scripted sequence of requests for `scenario-test`"""
+    target: Optional[str] = None
+    headers: Dict[str, str] = {}
+    steps: List[ScenarioStep]
+
+
+def parse_completion(body: bytes) -> Tuple[Optional[str], Optional[str], Optional[int]]:
+    """(assistant text, finish_reason, content chunk count or None) from a JSON or SSE response"""
+    text = body.decode("utf-8", errors="replace")
+    if not text.lstrip().startswith("data:"):
+        try:
+            choice = json.loads(text)["choices"][0]
+        except (ValueError, KeyError, IndexError, TypeError):
+            return None, None, None
+        return (choice.get("message") or {}).get("content"), choice.get("finish_reason"), None
+    content, finish_reason, chunks = "", None, 0
+    for line in text.splitlines():
+        if not line.startswith("data:") or line[5:].strip() == "[DONE]":
+            continue
+        try:
+            choices = json.loads(line[5:]).get("choices") or [{}]
+        except ValueError:
+            continue
+        piece = (choices[0].get("delta") or {}).get("content")
+        if piece:
+            content += piece
+            chunks += 1
+        finish_reason = choices[0].get("finish_reason") or finish_reason
+    return content, finish_reason, chunks
+
+
+def check_step(expect: ScenarioExpect, status: int, headers: Dict[str, str], body: bytes) -> List[str]:
+    """Mismatches between a response and a step's expectations"""
+    problems = []
+    if expect.status is not None and status != expect.status:
+        problems.append(f"expected status {expect.status}, got {status}")
+    for name, value in expect.headers.items():
+        actual = headers.get(name.lower())
+        if actual != value:
+            problems.append(f"expected header {name}: {value!r}, got {actual!r}")
+    checks_body = any(v is not None for v in (expect.content, expect.contains, expect.finish_reason,
+                                               expect.chunks, expect.min_chunks, expect.max_chunks))
+    if not checks_body:
+        return problems
+    content, finish_reason, chunks = parse_completion(body)
+    if expect.content is not None and content != expect.content:
+        problems.append(f"expected content {expect.content!r}, got {content!r}")
+    if expect.contains is not None and expect.contains not in (content or ""):
+        problems.append(f"expected content containing {expect.contains!r}, got {content!r}")
+    if expect.finish_reason is not None and finish_reason != expect.finish_reason:
+        problems.append(f"expected finish_reason {expect.finish_reason!r}, got {finish_reason!r}")
+    if any(v is not None for v in (expect.chunks, expect.min_chunks, expect.max_chunks)):
+        if chunks is None:
+            problems.append("expected a streaming response")
+        elif expect.chunks is not None and chunks != expect.chunks:
+            problems.append(f"expected {expect.chunks} content chunks, got {chunks}")
+        elif expect.min_chunks is not None and chunks < expect.min_chunks:
+            problems.append(f"expected at least {expect.min_chunks} content chunks, got {chunks}")
+        elif expect.max_chunks is not None and chunks > expect.max_chunks:
+            problems.append(f"expected at most {expect.max_chunks} content chunks, got {chunks}")
+    return problems
+
+
+def scenario_test_command(argv: List[str]):
+    """`scenario-test`: run a scripted sequence of requests and fail on any mismatch"""
+    import argparse
+    import urllib.error
+
+    parser = argparse.ArgumentParser(prog="simulator.py scenario-test",
+                                     description="Contract-test an OpenAI-compatible server with a scripted scenario")
+    parser.add_argument("--file", required=True, help="YAML/JSON scenario test file")
+    parser.add_argument("--target", help="Base URL to test (overrides the file's `target`; default: http://localhost:8000)")
+    parser.add_argument("--header", action="append", default=[], metavar="'NAME: VALUE'",
+                        help="Extra header for every request (repeatable)")
+    parser.add_argument("--fail-fast", action="store_true", help="Stop at the first failing step")
+    args = parser.parse_args(argv)
+
+    try:
+        scenario = ScenarioTest.model_validate(read_config_file(args.file))
+    except (OSError, yaml.YAMLError, ValueError) as e:
+        parser.error(f"invalid scenario test {args.file}: {e}")
+    base = (args.target or scenario.target or "http://localhost:8000").rstrip("/")
+    headers = {**scenario.headers, **parse_header_args(parser, args.header)}
+
+    passed = failed = 0
+    for step in scenario.steps:
+        started = time.perf_counter()
+        request = step.request
+        try:
+            status, body, _, response_headers = http_call(request.method.upper(), base + request.path,
+                                                          request.body, {**headers, **request.headers})
+            problems = check_step(step.expect, status, response_headers, body)
+        except (OSError, urllib.error.URLError) as e:
+            problems = [f"request failed: {e}"]
+        elapsed_ms = (time.perf_counter() - started) * 1000
+        if problems:
+            failed += 1
+            print(f"FAIL {step.name} ({elapsed_ms:.0f}ms)")
+            for problem in problems:
+                print(f"     {problem}")
+            if args.fail_fast:
+                break
+        else:
+            passed += 1
+            print(f"PASS {step.name} ({elapsed_ms:.0f}ms)")
+    print(f"{passed} passed, {failed} failed")
+    if failed:
+        sys.exit(1)
+
+
+def requests_command(argv: List[str]):
+    """`requests list`: query a request history database written with `history.path`"""
+    import argparse
+
+    parser = argparse.ArgumentParser(prog="simulator.py requests", description="Query the persistent request history")
+    actions = parser.add_subparsers(dest="action", required=True)
+    listing = actions.add_parser("list", help="List recorded requests")
+    listing.add_argument("--db", default=os.getenv("LLM_SIM_HISTORY"), required=not os.getenv("LLM_SIM_HISTORY"),
+                         help="SQLite history file (default: $LLM_SIM_HISTORY)")
+    listing.add_argument("--model", help="Only this model")
+    listing.add_argument("--status", type=int, help="Only this HTTP status")
+    listing.add_argument("--path", help="Only this endpoint, e.g. /v1/chat/completions")
+    listing.add_argument("--user", help="Only this `user` field")
+    listing.add_argument("--since", help="Start of the window: 30m, 1h, 2d, an epoch or an ISO time")
+    listing.add_argument("--until", help="End of the window, in the same formats")
+    listing.add_argument("--limit", type=int, default=100, help="Most recent N matches (default: 100, 0 for all)")
+    listing.add_argument("--json", action="store_true", help="Print full entries, with bodies, as JSON lines")
+    args = parser.parse_args(argv)
+
+    if not os.path.exists(args.db):
+        parser.error(f"no history database at {args.db}")
+    try:
+        window = [parse_since(t) if t is not None else None for t in (args.since, args.until)]
+        entries = RequestHistory(args.db).query(args.model, args.status, args.path, args.user,
+                                                window[0], window[1], args.limit or None)
+    except (ValueError, sqlite3.Error) as e:
+        parser.error(str(e))
+    for entry in entries:
+        if args.json:
+            print(json.dumps(entry, ensure_ascii=False))
+            continue
+        when = time.strftime("%Y-%m-%d %H:%M:%S", time.localtime(entry["timestamp"]))
+        print(f"{when}  {entry['status']}  {entry['method']} {entry['path']}  model={entry['model']}  "
+              f"user={entry['user']}  stream={entry['stream']}  {entry['duration_ms']:.1f}ms  id={entry['id']}")
+    if not args.json:
+        print(f"{len(entries)} requests")
+
+
+def version_command(argv: List[str]):
+    """`version`: print the simulator version"""
+    import argparse
+
+    parser = argparse.ArgumentParser(prog="simulator.py version", description="Print version and build info")
+    parser.add_argument("--json", action="store_true", help="Print build info and features as JSON")
+    args = parser.parse_args(argv)
+    if args.json:
+        print(json.dumps(build_info(), indent=2))
+    else:
+        print(version_line())
+
+
+class DrainingServer(uvicorn.Server):
+    """
+    uvicorn server that, on the first SIGTERM/SIGINT, fails /readyz but keeps serving
+    for `shutdown_delay_seconds` before shutting down, so load balancers stop routing
+    to it first. A second signal exits immediately.
+    """
+
+    def __init__(self, server_config: "uvicorn.Config", delay: float):
+        super().__init__(server_config)
+        self.delay = delay
+
+    def handle_exit(self, sig, frame):
+        import simulator as served  # the module uvicorn loaded the app from, not __main__
+        if self.delay > 0 and not served.lifecycle.draining:
+            served.lifecycle.begin_shutdown()
+            print(f"Draining: /readyz is failing, shutting down in {self.delay:g}s")
+            asyncio.get_event_loop().call_later(self.delay, super().handle_exit, sig, frame)
+            return
+        served.lifecycle.begin_shutdown()
+        super().handle_exit(sig, frame)
+
+
+async def serve_with_admin(api_config: "uvicorn.Config", admin_config: "uvicorn.Config", delay: float = 0):
+    """Run the API and admin listeners in one process, sharing state; Ctrl-C stops both"""
+    api_server = DrainingServer(api_config, delay)
+    admin_server = uvicorn.Server(admin_config)
+    admin_server.install_signal_handlers = lambda: None  # the API server owns the signals
+    admin_task = asyncio.create_task(admin_server.serve())
+    try:
+        await api_server.serve()
+    finally:
+        admin_server.should_exit = True
+        await admin_task
+
+
+def serve_h2c(host: str, port: int, resolved: SimulatorConfig):
+    """
+    Serve the API with Hypercorn, which speaks cleartext HTTP/2 (prior knowledge or
+    Upgrade: h2c) as well as HTTP/1.1. Draining on SIGTERM works as with uvicorn.
+    """
+    try:
+        from hypercorn.asyncio import serve
+        from hypercorn.config import Config as HypercornConfig
+    except ImportError:
+        sys.exit("connections.http2 needs Hypercorn: pip install hypercorn")
+    import signal
+    import simulator as served  # load the app the way uvicorn would, from the resolved config
+    server_config = HypercornConfig()
+    server_config.bind = [f"{host}:{port}"]
+    server_config.keep_alive_timeout = resolved.timeouts.keep_alive_seconds
+    delay = resolved.shutdown_delay_seconds
+
+    async def run():
+        stop = asyncio.Event()
+        loop = asyncio.get_running_loop()
+        for sig in (signal.SIGINT, signal.SIGTERM):
+            loop.add_signal_handler(sig, stop.set)
+
+        async def shutdown_trigger():
+            await stop.wait()
+            served.lifecycle.begin_shutdown()
+            if delay > 0:
+                print(f"Draining: /readyz is failing, shutting down in {delay:g}s")
+                stop.clear()
+                try:
+                    await asyncio.wait_for(stop.wait(), delay)  # a second signal exits immediately
+                except asyncio.TimeoutError:
+                    pass
+
+        await serve(served.app, server_config, shutdown_trigger=shutdown_trigger)
+
+    asyncio.run(run())
+
+
+ENV_PREFIX = "LLM_SIM_"
+
+
+def flag_env_name(action) -> Optional[str]:
+    """The variable standing in for a `serve` flag: LLM_SIM_ERROR_RATE for --error-rate"""
+    flag = next((option for option in action.option_strings if option.startswith("--")), None)
+    if flag is None or action.dest in ("help", "version", "print_config"):
+        return None
+    return ENV_PREFIX + flag[2:].upper().replace("-", "_")
+
+
+def env_flags(parser, args, argv: List[str]) -> List[str]:
+    """
+    Fill in flags missing from the command line from their LLM_SIM_<FLAG> variables.
+    Lists are comma-separated and switches take 1, true, yes or on. Returns the
+    variables used.
+    """
+    import argparse
+    given = {a.split("=")[0] for a in argv if a.startswith("--")}
+    used = []
+    for action in parser._actions:
+        name = flag_env_name(action)
+        value = os.getenv(name) if name else None
+        if value is None or given & set(action.option_strings):
+            continue
+        if action.nargs == 0:  # store_true
+            if is_enabled(value):
+                setattr(args, action.dest, action.const)
+                used.append(name)
+            continue
+        multiple = action.nargs in ("+", "*") or isinstance(action, argparse._AppendAction)
+        try:
+            if action.nargs == "?" and (value == "" or is_enabled(value)):
+                parsed = action.const
+            else:
+                items = [item.strip() for item in value.split(",")] if multiple else [value]
+                items = [action.type(item) if action.type else item for item in items]
+                for item in items:
+                    if action.choices and item not in action.choices:
+                        raise ValueError(f"invalid choice {item!r} (choose from {', '.join(map(str, action.choices))})")
+                parsed = items if multiple else items[0]
+        except (TypeError, ValueError, argparse.ArgumentTypeError) as e:
+            parser.error(f"{name}: {e}")
+        setattr(args, action.dest, parsed)
+        used.append(name)
+    return used
+
+
+def env_config(exclude: typing.Collection[str] = ()) -> Tuple[Dict[str, Any], List[str]]:
+    """
+    Config values from LLM_SIM_<FIELD> variables, as overrides for the file, and the
+    variables used. `__` separates nested fields (LLM_SIM_LATENCY__FIRST_TOKEN_MS) and
+    values are YAML, so lists and mappings work too. Names in `exclude` (the flags') are skipped.
+    """
+    data: Dict[str, Any] = {}
+    used = []
+    for name, value in sorted(os.environ.items()):
+        path = name[len(ENV_PREFIX):].lower().split("__")
+        if not name.startswith(ENV_PREFIX) or name in exclude or path[0] not in SimulatorConfig.model_fields:
+            continue
+        try:
+            parsed = yaml.safe_load(value)
+        except yaml.YAMLError as e:
+            raise ValueError(f"{name}: {e}")
+        node = data
+        for key in path[:-1]:
+            node = node.setdefault(key, {})
+            if not isinstance(node, dict):
+                raise ValueError(f"{name}: {key} is set to a value that is not a mapping")
+        node[path[-1]] = parsed
+        used.append(name)
+    return data, used
+
+
+def print_effective_config(resolved: SimulatorConfig, args, argv: List[str], env: List[str]):
+    """
+    `--print-config`: the merged config as YAML (loadable with --config), headed by
+    comments naming every source that contributed. Precedence: flags > env > file.
+    """
+    flags = list(dict.fromkeys(a.split("=")[0] for a in argv if a.startswith("--") and a != "--print-config"))
+    data = resolved.model_dump(mode="json")
+    if data["admin"]["token"]:
+        data["admin"]["token"] = "<redacted>"
+    print(f"# config file: {args.config or '(none)'}")
+    print(f"# scenarios: {', '.join(args.scenario or []) or '(none)'}")
+    print(f"# environment: {', '.join(env) or '(none)'}")
+    print(f"# flags: {', '.join(flags) or '(none)'}")
+    print(f"# server: host {args.host}, port {args.port}" + (", reload" if args.reload else ""))
+    print(yaml.safe_dump(data, sort_keys=False, allow_unicode=True), end="")
+
+
+def serve_command(argv: List[str]):
+    """Run the simulator server"""
+    import argparse
+    
+    parser = argparse.ArgumentParser(
+        prog="simulator.py serve",
+        description="LLM Behavior Simulator",
+        epilog=f"Other commands: {', '.join(sorted(set(COMMANDS) - {'serve'}))} (run 'simulator.py COMMAND --help'). "
+               f"Without a command, the server starts with these flags."
+    )
+    parser.add_argument("--version", action="version", version=version_line())
+    parser.add_argument("--host", default=os.getenv("LLM_SIM_HOST", "0.0.0.0"),
+                        help="Host to bind to (default: $LLM_SIM_HOST or 0.0.0.0)")
+    parser.add_argument("--port", type=int, default=os.getenv("LLM_SIM_PORT", "8000"),
+                        help="Port to bind to (default: $LLM_SIM_PORT or 8000)")
+    parser.add_argument("--reload", action="store_true", help="Enable auto-reload")
+    parser.add_argument("--config", default=os.getenv("LLM_SIM_CONFIG"),
+                        help="Path to a YAML/JSON simulation config (default: $LLM_SIM_CONFIG)")
+    parser.add_argument("--print-config", action="store_true",
+                        help="Print the effective configuration (file, env vars and flags merged) as YAML and exit")
+    parser.add_argument("--scenario", action="append", metavar="NAME",
+                        help=f"Start from a ready-made scenario under --config (repeatable): a file or "
+                             f"builtin:NAME, one of {', '.join(builtin_scenarios()) or '(none installed)'}")
+    parser.add_argument("--error-rate", type=float, help="Fraction (0-1) of API requests to fail")
+    parser.add_argument("--error-status", type=int, help="HTTP status for injected errors (default: 500)")
+    parser.add_argument("--error-kind", choices=sorted(ERROR_KINDS),
+                        help="Inject a provider-specific error instead of --error-status")
+    parser.add_argument("--invalid-key-rate", type=float, help="Fraction (0-1) of API requests to fail with 401")
+    parser.add_argument("--permission-denied-rate", type=float, help="Fraction (0-1) of API requests to fail with 403")
+    parser.add_argument("--restore-state", help="Start from a snapshot exported via /admin/state")
+    parser.add_argument("--corpus", nargs="+", metavar="FILE",
+                        help="Text files to train the Markov generator on (enables generator 'markov')")
+    parser.add_argument("--corpus-length", type=int, help="Approximate words per Markov response (default: 50)")
+    parser.add_argument("--fixtures", nargs="+", metavar="FILE",
+                        help="JSONL prompt/response fixtures to answer matching prompts with")
+    parser.add_argument("--fixture-match", choices=FIXTURE_MATCH_MODES,
+                        help="How prompts are matched to fixtures (default: normalized)")
+    parser.add_argument("--transcripts", nargs="?", const="", metavar="DIR",
+                        help="Serve recorded provider responses verbatim (default: the bundled transcripts/)")
+    parser.add_argument("--transcript-pacing", choices=TRANSCRIPT_PACING,
+                        help="Play transcripts at their recorded timing, scaled by --transcript-speed, "
+                             "or with a fixed chunk delay (default: fixed, no delay)")
+    parser.add_argument("--transcript-speed", type=float, help="Speed-up for --transcript-pacing scaled (e.g. 2)")
+    parser.add_argument("--interactive", action="store_true", default=None,
+                        help="Type each response in the terminal; unanswered requests get the configured one")
+    parser.add_argument("--interactive-timeout", type=float, metavar="SECONDS",
+                        help="How long --interactive waits for a reply (default: 30)")
+    parser.add_argument("--noise-rate", type=float, help="Fraction (0-1) of response words to corrupt with typos")
+    parser.add_argument("--watermark", action="store_true", default=None,
+                        help="Tag each response word with its position (w1:, w2:, ...) to check stream reassembly")
+    parser.add_argument("--strict", action="store_true", default=None,
+                        help="Reject invalid message roles and orphan tool results like the real API")
+    parser.add_argument("--self-test", action="store_true", default=None,
+                        help="Before serving, send a chat completion and a stream through the app; exit if either breaks")
+    parser.add_argument("--allow-cidr", action="append", metavar="CIDR",
+                        help="Only accept API requests from this network (repeatable)")
+    parser.add_argument("--admin-allow-cidr", action="append", metavar="CIDR",
+                        help="Only accept /admin requests from this network (repeatable)")
+    parser.add_argument("--log-bodies", type=float, nargs="?", const=1.0, metavar="RATE",
+                        help="Log redacted request/response bodies for this fraction (0-1) of API requests (default: all)")
+    parser.add_argument("--history", metavar="FILE", help="Also persist captured requests to this SQLite file")
+    parser.add_argument("--shutdown-delay", type=float, metavar="SECONDS",
+                        help="After SIGTERM, fail /readyz but keep serving this long before exiting")
+    parser.add_argument("--admin-port", type=int, help="Serve /admin endpoints on this port instead of the API port")
+    parser.add_argument("--debug-endpoints", action="store_true", default=None,
+                        help="Expose /admin/debug/* profiling and runtime diagnostics")
+    parser.add_argument("--admin-token", default=os.getenv("LLM_SIM_ADMIN_TOKEN"),
+                        help="Bearer token required on /admin endpoints (default: $LLM_SIM_ADMIN_TOKEN)")
+    parser.add_argument("--region", default=os.getenv("LLM_SIM_REGION"),
+                        help="Region this listener answers as, in x-sim-region (default: $LLM_SIM_REGION)")
+    parser.add_argument("--vendor", help=f"Answer chat completions with an OpenAI-compatible vendor's quirks "
+                                         f"(built in: {', '.join(VENDOR_QUIRKS)})")
+    parser.add_argument("--queue", metavar="URL",
+                        help="Also answer jobs from a NATS subject or Redis list, e.g. nats://localhost:4222 "
+                             "(default: $LLM_SIM_QUEUE)")
+    parser.add_argument("--sse-flush", metavar="MODE",
+                        help="Write stream events one per write (strict) or N at a time (a number), "
+                             "like a buffering proxy")
+    parser.add_argument("--http2", action="store_true", default=None,
+                        help="Also accept cleartext HTTP/2 (h2c); needs Hypercorn")
+    parser.add_argument("--max-connections", type=int,
+                        help="Answer 503 once this many connections are open")
+    parser.add_argument("--bandwidth", type=int, metavar="BYTES_PER_SECOND",
+                        help="Cap response bytes per second on each connection, like a slow network")
+    parser.add_argument("--max-requests-per-connection", type=int, metavar="N",
+                        help="Close each kept-alive connection after N requests")
+    parser.add_argument("--keep-alive-timeout", type=float, metavar="SECONDS",
+                        help="Close connections idle this long (default: 5)")
+    parser.add_argument("--no-keep-alive", action="store_true", default=None,
+                        help="Close the connection after every response")
+    
+    args = parser.parse_args(argv)
+    env = env_flags(parser, args, argv)
+    
+    # Loading here also validates the file, so a broken config fails before the server starts
+    try:
+        overrides, env_fields = env_config({flag_env_name(action) for action in parser._actions})
+        env = sorted(env + env_fields)
+        resolved = load_config(args.config, overrides, args.scenario)
+        if args.error_rate is not None:
+            resolved.errors.rate = args.error_rate
+        if args.error_status is not None:
+            resolved.errors.status = args.error_status
+        if args.error_kind is not None:
+            resolved.errors.kind = args.error_kind
+        if args.invalid_key_rate is not None:
+            resolved.errors.auth.invalid_api_key = args.invalid_key_rate
+        if args.permission_denied_rate is not None:
+            resolved.errors.auth.permission_denied = args.permission_denied_rate
+        if args.corpus:
+            resolved.markov.corpus = [os.path.abspath(path) for path in args.corpus]
+            if resolved.generator is None:
+                resolved.generator = "markov"
+        if args.corpus_length is not None:
+            resolved.markov.length = args.corpus_length
+        if args.fixtures:
+            resolved.fixtures.files = [os.path.abspath(path) for path in args.fixtures]
+        if args.fixture_match:
+            resolved.fixtures.match = args.fixture_match
+        if args.transcripts is not None:
+            resolved.transcripts.enabled = True
+            if args.transcripts:
+                resolved.transcripts.dir = os.path.abspath(args.transcripts)
+        if args.transcript_pacing:
+            resolved.transcripts.pacing = args.transcript_pacing
+        if args.transcript_speed is not None:
+            resolved.transcripts.speed = args.transcript_speed
+        if args.interactive:
+            resolved.interactive.enabled = True
+        if args.interactive_timeout is not None:
+            resolved.interactive.timeout_seconds = args.interactive_timeout
+        if args.noise_rate is not None:
+            resolved.noise.rate = args.noise_rate
+        if args.watermark:
+            resolved.watermark.enabled = True
+        if args.strict:
+            resolved.strict = True
+        if args.self_test:
+            resolved.self_test = True
+        if args.allow_cidr:
+            resolved.access.allow_cidrs = args.allow_cidr
+        if args.admin_allow_cidr:
+            resolved.access.admin_allow_cidrs = args.admin_allow_cidr
+        if args.log_bodies is not None:
+            resolved.body_logging.enabled = True
+            resolved.body_logging.sample_rate = args.log_bodies
+        if args.history:
+            resolved.history.path = os.path.abspath(args.history)
+        if args.shutdown_delay is not None:
+            resolved.shutdown_delay_seconds = args.shutdown_delay
+        if args.admin_port is not None:
+            resolved.admin.port = args.admin_port
+        if args.admin_token:
+            resolved.admin.token = args.admin_token
+        if args.debug_endpoints:
+            resolved.admin.debug = True
+        if args.region:
+            resolved.region.name = args.region
+        if args.vendor:
+            resolved.vendor = args.vendor
+        if args.queue:
+            resolved.queue.url = args.queue
+        if args.sse_flush:
+            if args.sse_flush.isdigit():
+                resolved.sse_flush = SSEFlushing(mode="batched", events=int(args.sse_flush))
+            else:
+                resolved.sse_flush.mode = args.sse_flush
+        if args.http2:
+            resolved.connections.http2 = True
+        if args.max_connections is not None:
+            resolved.connections.max_connections = args.max_connections
+        if args.no_keep_alive:
+            resolved.connections.keep_alive = False
+        if args.max_requests_per_connection is not None:
+            resolved.connections.max_requests = args.max_requests_per_connection
+        if args.keep_alive_timeout is not None:
+            resolved.timeouts.keep_alive_seconds = args.keep_alive_timeout
+        if args.bandwidth is not None:
+            resolved.connections.bytes_per_second = args.bandwidth
+        # Re-validate so out-of-range flag values are rejected like config values
+        resolved = SimulatorConfig.model_validate(resolved.model_dump())
+        MarkovChain.from_files(resolved.markov.corpus, resolved.markov.order)
+        FixtureStore.from_files(resolved.fixtures.files)
+        TranscriptStore.from_config(resolved.transcripts)
+    except (OSError, yaml.YAMLError, ValueError) as e:
+        parser.error(f"invalid configuration: {e}")
+    if args.print_config:
+        print_effective_config(resolved, args, argv, env)
+        return
+    os.environ["LLM_SIM_RESOLVED_CONFIG"] = resolved.model_dump_json()
+    if args.restore_state:
+        os.environ["LLM_SIM_RESTORE_STATE"] = args.restore_state
+    
+    admin_port = resolved.admin.port
+    if admin_port is not None and args.reload:
+        parser.error("--reload cannot be combined with a separate admin port")
+    if resolved.interactive.enabled and args.reload:
+        parser.error("--interactive needs the terminal, which --reload's worker process does not get")
+    if resolved.connections.http2 and (args.reload or admin_port is not None):
+        parser.error("HTTP/2 cannot be combined with --reload or a separate admin port")
+    
+    print(f"Starting LLM Behavior Simulator on {args.host}:{args.port}")
+    print(f"OpenAI-compatible API available at http://{args.host}:{args.port}/v1")
+    
+    if resolved.connections.http2:
+        serve_h2c(args.host, args.port, resolved)
+        return
+    if args.reload:
+        uvicorn.run(
+            "simulator:app",
+            host=args.host,
+            port=args.port,
+            reload=args.reload,
+            timeout_keep_alive=resolved.timeouts.keep_alive_seconds,
+            limit_concurrency=resolved.connections.max_connections
+        )
+        return
+    api_config = uvicorn.Config("simulator:app", host=args.host, port=args.port,
+                                timeout_keep_alive=resolved.timeouts.keep_alive_seconds,
+                                limit_concurrency=resolved.connections.max_connections)
+    if admin_port is None:
+        DrainingServer(api_config, resolved.shutdown_delay_seconds).run()
+        return
+    print(f"Admin endpoints available at http://{args.host}:{admin_port}/admin")
+    asyncio.run(serve_with_admin(
+        api_config,
+        uvicorn.Config("simulator:admin_app", host=args.host, port=admin_port),
+        resolved.shutdown_delay_seconds,
+    ))
+
+
+def start_serve(host: str, port: int, config_path: str):
+    """A `serve` subprocess of this script on the port, with the config"""
+    import subprocess
+    return subprocess.Popen([sys.executable, os.path.abspath(__file__), "serve", "--host", host,
+                             "--port", str(port), "--config", config_path])
+
+
+class ClusterNode:
+    """One listener of `cluster`: where it serves, how it differs, and its `serve` process"""
+
+    def __init__(self, name: str, port: int, latency: float, rtt_ms: float, error_rate: float):
+        self.name = name
+        self.port = port
+        self.latency = latency
+        self.rtt_ms = rtt_ms
+        self.error_rate = error_rate
+        self.process = None
+        self.config_path: Optional[str] = None
+
+    def node_config(self, base: SimulatorConfig) -> SimulatorConfig:
+        """The shared config, answering as this node's region with its own latency and error rate"""
+        data = base.model_dump()
+        data["region"]["name"] = self.name
+        data["region"]["profiles"][self.name] = {"rtt_ms": self.rtt_ms, "latency_multiplier": self.latency}
+        data["errors"]["rate"] = self.error_rate
+        data["admin"]["port"] = None  # every node serves /admin on its own port
+        return SimulatorConfig.model_validate(data)
+
+    @property
+    def running(self) -> bool:
+        return self.process is not None and self.process.poll() is None
+
+    def start(self, host: str):
+        if not self.running:
+            self.process = start_serve(host, self.port, self.config_path)
+
+    def stop(self):
+        if self.running:
+            self.process.terminate()
+            self.process.wait()
+
+    def describe(self, host: str) -> Dict[str, Any]:
+        return {"name": self.name, "url": f"http://{host}:{self.port}", "latency_multiplier": self.latency,
+                "rtt_ms": self.rtt_ms, "error_rate": self.error_rate, "running": self.running}
+
+
+def parse_cluster_node(parser, spec: str) -> Dict[str, Any]:
+    """`latency=1.5,rtt=40,error_rate=0.1,name=eu` -> ClusterNode keyword overrides"""
+    keys = {"latency": ("latency", float), "rtt": ("rtt_ms", float), "error_rate": ("error_rate", float),
+            "name": ("name", str)}
+    out = {}
+    for item in filter(None, spec.split(",")):
+        key, sep, value = item.partition("=")
+        if not sep or key.strip() not in keys:
+            parser.error(f"invalid --node '{spec}', expected comma-separated {'/'.join(keys)}=VALUE")
+        field, kind = keys[key.strip()]
+        try:
+            out[field] = kind(value.strip())
+        except ValueError:
+            parser.error(f"invalid --node '{spec}': {key.strip()} must be a number")
+    return out
+
+
+def cluster_command(argv: List[str]):
+    """`cluster`: several simulators on consecutive ports plus an endpoint listing them"""
+    import argparse
+    import tempfile
+
+    parser = argparse.ArgumentParser(prog="simulator.py cluster",
+                                     description="Run several simulator listeners that differ in latency and "
+                                                 "health, for testing client-side load balancing and failover")
+    parser.add_argument("--nodes", type=int, default=3, help="Number of listeners (default: 3)")
+    parser.add_argument("--node", action="append", default=[], metavar="SPEC",
+                        help="Settings of the next node, e.g. 'latency=1.5,rtt=40,error_rate=0.1,name=eu' "
+                             "(repeatable, in node order)")
+    parser.add_argument("--host", default="127.0.0.1", help="Host every listener binds to (default: 127.0.0.1)")
+    parser.add_argument("--port", type=int, default=8000, help="Port of the cluster endpoint listing (default: 8000)")
+    parser.add_argument("--base-port", type=int, default=8001, help="Port of the first node (default: 8001)")
+    parser.add_argument("--config", default=os.getenv("LLM_SIM_CONFIG"),
+                        help="Config every node starts from (default: $LLM_SIM_CONFIG)")
+    args = parser.parse_args(argv)
+    try:
+        base = load_config(args.config)
+    except (OSError, yaml.YAMLError, ValueError) as e:
+        parser.error(f"invalid configuration: {e}")
+    specs = [parse_cluster_node(parser, spec) for spec in args.node]
+    count = max(args.nodes, len(specs))
+    if count < 1:
+        parser.error("--nodes must be at least 1")
+    # Unless told otherwise, each node is a little slower and further away than the one before
+    nodes = [ClusterNode(**{"name": f"node-{i}", "port": args.base_port + i, "latency": 1 + 0.25 * i,
+                            "rtt_ms": 5.0 * i, "error_rate": base.errors.rate, **(specs[i] if i < len(specs) else {})})
+             for i in range(count)]
+    if len({node.name for node in nodes}) != len(nodes):
+        parser.error("node names must be unique")
+    advertised = "localhost" if args.host in ("0.0.0.0", "::") else args.host
+
+    cluster_app = FastAPI(title="LLM Behavior Simulator cluster", version=VERSION)
+    by_name = {node.name: node for node in nodes}
+
+    def find_node(name: str) -> ClusterNode:
+        if name not in by_name:
+            raise HTTPException(status_code=404, detail=f"No node '{name}', available: {list(by_name)}")
+        return by_name[name]
+
+    async def probe(node: ClusterNode) -> Dict[str, Any]:
+        entry = node.describe(advertised)
+        try:
+            status, _, seconds, _ = await asyncio.to_thread(http_call, "GET", f"{entry['url']}/readyz", timeout=1)
+            entry.update(healthy=status == 200, probe_ms=round(seconds * 1000, 3))
+        except OSError:
+            entry.update(healthy=False, probe_ms=None)
+        return entry
+
+    @cluster_app.get("/cluster/endpoints")
+    async def cluster_endpoints():
+        """Every node with its characteristics and whether its /readyz passes right now"""
+        return {"object": "list", "data": await asyncio.gather(*(probe(node) for node in nodes))}
+
+    @cluster_app.post("/cluster/endpoints/{name}/stop")
+    async def stop_node(name: str):
+        """Take a node down, as a failed provider endpoint"""
+        node = find_node(name)
+        await asyncio.to_thread(node.stop)
+        return node.describe(advertised)
+
+    @cluster_app.post("/cluster/endpoints/{name}/start")
+    async def start_node(name: str):
+        """Bring a stopped node back with its original settings"""
+        node = find_node(name)
+        node.start(args.host)
+        return node.describe(advertised)
+
+    with tempfile.TemporaryDirectory(prefix="llm-sim-cluster-") as workdir:
+        for node in nodes:
+            try:
+                node_config = node.node_config(base)
+            except ValueError as e:
+                parser.error(f"invalid settings for {node.name}: {e}")
+            node.config_path = os.path.join(workdir, f"{node.name}.json")
+            with open(node.config_path, "w", encoding="utf-8") as f:
+                f.write(node_config.model_dump_json())
+        try:
+            for node in nodes:
+                node.start(args.host)
+                print(f"{node.name}: http://{advertised}:{node.port} (latency x{node.latency:g}, "
+                      f"rtt {node.rtt_ms:g}ms, error rate {node.error_rate:g})")
+            print(f"Cluster endpoints: http://{advertised}:{args.port}/cluster/endpoints")
+            uvicorn.run(cluster_app, host=args.host, port=args.port)
+        finally:
+            for node in nodes:
+                node.stop()
+
+
+# Response fields and headers that differ between any two responses, left out of `diff` comparisons
+DIFF_IGNORED_FIELDS = ("id", "created", "system_fingerprint")
+DIFF_IGNORED_HEADERS = ("date", "server", "content-length", "x-request-id", "openai-processing-ms", "age")
+
+
+class DiffReplay(BaseModel):
+    """What POST /diff/replay sends to both profiles: a captured request (by id), or the request itself"""
+    request_id: Optional[str] = None  # an `id` from either profile's /admin/requests
+    method: str = "POST"
+    path: str = "/v1/chat/completions"
+    body: Optional[Dict[str, Any]] = None
+    headers: Dict[str, str] = {}
+
+
+def parse_replayed_body(raw: bytes, content_type: str) -> Any:
+    """A response body to compare: JSON as its value, SSE as the list of its events' data"""
+    text = raw.decode("utf-8", errors="replace")
+    if not content_type.startswith("text/event-stream"):
+        try:
+            return json.loads(text)
+        except ValueError:
+            return text
+    events = []
+    for block in re.split(r"\r?\n\r?\n", text):
+        data = "\n".join(line[5:].lstrip() for line in block.splitlines() if line.startswith("data:"))
+        if data:
+            try:
+                events.append(json.loads(data))
+            except ValueError:
+                events.append(data)
+    return events
+
+
+def json_diff(baseline: Any, candidate: Any, path: str, ignored: Tuple[str, ...]) -> List[Dict[str, Any]]:
+    """Where two JSON values differ: one entry per differing leaf, with null for a missing side"""
+    if isinstance(baseline, dict) and isinstance(candidate, dict):
+        out = []
+        for key in list(baseline) + [k for k in candidate if k not in baseline]:
+            if key not in ignored:
+                out += json_diff(baseline.get(key), candidate.get(key), f"{path}.{key}" if path else key, ignored)
+        return out
+    if isinstance(baseline, list) and isinstance(candidate, list):
+        out = []
+        for i in range(max(len(baseline), len(candidate))):
+            out += json_diff(baseline[i] if i < len(baseline) else None,
+                             candidate[i] if i < len(candidate) else None, f"{path}[{i}]", ignored)
+        return out
+    return [] if baseline == candidate else [{"path": path, "baseline": baseline, "candidate": candidate}]
+
+
+def diff_command(argv: List[str]):
+    """`diff`: two simulator profiles side by side, and an endpoint replaying a request against both"""
+    import argparse
+    import urllib.error
+
+    parser = argparse.ArgumentParser(prog="simulator.py diff",
+                                     description="Run two simulator profiles side by side and compare how they "
+                                                 "answer the same requests")
+    parser.add_argument("--baseline", required=True, help="Config of the profile compared against")
+    parser.add_argument("--candidate", required=True, help="Config of the profile being evaluated")
+    parser.add_argument("--host", default="127.0.0.1", help="Host every listener binds to (default: 127.0.0.1)")
+    parser.add_argument("--port", type=int, default=8000, help="Port of the diff endpoint (default: 8000)")
+    parser.add_argument("--base-port", type=int, default=8001,
+                        help="Port of the baseline; the candidate gets the next one (default: 8001)")
+    parser.add_argument("--ignore", action="append", default=[], metavar="FIELD",
+                        help=f"Response field left out of diffs, in addition to {', '.join(DIFF_IGNORED_FIELDS)} "
+                             "(repeatable)")
+    args = parser.parse_args(argv)
+    for path in (args.baseline, args.candidate):
+        try:
+            load_config(path)
+        except (OSError, yaml.YAMLError, ValueError) as e:
+            parser.error(f"invalid configuration {path}: {e}")
+    ignored = DIFF_IGNORED_FIELDS + tuple(args.ignore)
+    advertised = "localhost" if args.host in ("0.0.0.0", "::") else args.host
+    profiles = {"baseline": (args.baseline, args.base_port), "candidate": (args.candidate, args.base_port + 1)}
+    urls = {name: f"http://{advertised}:{port}" for name, (_, port) in profiles.items()}
+
+    diff_app = FastAPI(title="LLM Behavior Simulator diff", version=VERSION)
+
+    async def captured(request_id: str) -> Dict[str, Any]:
+        for url in urls.values():
+            try:
+                status, raw, _, _ = await asyncio.to_thread(http_call, "GET", f"{url}/admin/requests", timeout=5)
+            except (OSError, urllib.error.URLError):
+                continue
+            if status == 200:
+                for entry in json.loads(raw).get("data", []):
+                    if entry.get("id") == request_id:
+                        return entry
+        raise HTTPException(status_code=404, detail=f"No captured request '{request_id}' in either profile")
+
+    async def send(name: str, replay: DiffReplay) -> Dict[str, Any]:
+        try:
+            status, raw, _, headers = await asyncio.to_thread(
+                http_call, replay.method, urls[name] + replay.path, replay.body, replay.headers)
+        except (OSError, urllib.error.URLError) as e:
+            raise HTTPException(status_code=502, detail=f"{name} did not answer: {e}")
+        return {"url": urls[name], "status": status,
+                "headers": {k: v for k, v in headers.items() if k not in DIFF_IGNORED_HEADERS},
+                "body": parse_replayed_body(raw, headers.get("content-type", ""))}
+
+    @diff_app.get("/diff/profiles")
+    async def diff_profiles():
+        """Both profiles, their configs and where they serve"""
+        return {name: {"config": os.path.abspath(path), "url": urls[name]} for name, (path, _) in profiles.items()}
+
+    @diff_app.post("/diff/replay")
+    async def diff_replay(replay: DiffReplay):
+        """Send one request to both profiles and report every status, header and body field that differs"""
+        if replay.request_id is not None:
+            entry = await captured(replay.request_id)
+            replay = replay.model_copy(update={"method": entry.get("method", "POST"), "path": entry["path"],
+                                               "body": entry.get("body")})
+        baseline, candidate = await asyncio.gather(send("baseline", replay), send("candidate", replay))
+        diff = json_diff({"status": baseline["status"], "headers": baseline["headers"], "body": baseline["body"]},
+                         {"status": candidate["status"], "headers": candidate["headers"], "body": candidate["body"]},
+                         "", ignored)
+        return {"request": {"method": replay.method, "path": replay.path, "body": replay.body},
+                "baseline": baseline, "candidate": candidate, "identical": not diff, "diff": diff}
+
+    processes = []
+    try:
+        for name, (path, port) in profiles.items():
+            processes.append(start_serve(args.host, port, path))
+            print(f"{name}: {urls[name]} ({path})")
+        print(f"Diff endpoint: http://{advertised}:{args.port}/diff/replay")
+        uvicorn.run(diff_app, host=args.host, port=args.port)
+    finally:
+        for process in processes:
+            if process.poll() is None:
+                process.terminate()
+                process.wait()
+
+
+# Subcommands, each with its own flags. A bare invocation (`simulator.py --port 8080`)
+# is `serve`, so existing scripts keep working.
+COMMANDS = {
+    "serve": serve_command,
+    "record": record_command,
+    "replay": replay_command,
+    "validate": validate_command,
+    "loadgen": loadgen_command,
+    "scenario-test": scenario_test_command,
+    "requests": requests_command,
+    "export": export_command,
+    "bench": bench_command,
+    "cluster": cluster_command,
+    "diff": diff_command,
+    "version": version_command,
+}
+
+
+def main(argv: Optional[List[str]] = None):
+    argv = sys.argv[1:] if argv is None else argv
+    if argv and argv[0] in COMMANDS:
+        COMMANDS[argv[0]](argv[1:])
+    elif argv and not argv[0].startswith("-"):
+        sys.exit(f"simulator.py: unknown command '{argv[0]}', available: {', '.join(COMMANDS)}")
+    else:
+        serve_command(argv)
 
 
 if __name__ == "__main__":
@@ -0,0 +1,272 @@
+#!/usr/bin/env python3
+"""
+SDK compatibility tests for the LLM Behavior Simulator
+
+Runs the official client libraries against a running simulator and checks what
+applications actually see: chat, streaming, tool calls, embeddings and errors.
+Needs the SDKs, which the simulator itself does not:
+
+    pip install openai anthropic
+    python test_sdk_compat.py [BASE_URL]
+
+Anthropic tests are skipped when the anthropic package is missing.
+"""
+
+import json
+import sys
+import time
+
+try:
+    import openai
+except ImportError:
+    print("The openai package is required: pip install openai")
+    sys.exit(2)
+
+try:
+    import anthropic
+except ImportError:
+    anthropic = None
+
+
+WEATHER_TOOL = {
+    "type": "function",
+    "function": {
+        "name": "get_weather",
+        "description": "Current weather for a city",
+        "parameters": {
+            "type": "object",
+            "properties": {
+                "city": {"type": "string", "minLength": 1},
+                "unit": {"type": "string", "enum": ["celsius", "fahrenheit"]},
+                "days": {"type": "integer", "minimum": 1, "maximum": 7},
+            },
+            "required": ["city", "unit", "days"],
+        },
+    },
+}
+
+
+def openai_client(base_url):
+    return openai.OpenAI(api_key="sk-sdk-compat", base_url=f"{base_url}/v1", max_retries=0)
+
+
+def test_chat(base_url):
+    """Test a plain chat completion through the OpenAI SDK"""
+    print("Testing OpenAI SDK chat completion...")
+    completion = openai_client(base_url).chat.completions.create(
+        model="gpt-4",
+        messages=[{"role": "user", "content": "Hello from the SDK"}],
+    )
+    assert completion.object == "chat.completion", f"Unexpected object: {completion.object}"
+    choice = completion.choices[0]
+    assert choice.message.role == "assistant", f"Unexpected role: {choice.message.role}"
+    assert choice.message.content, "Empty content"
+    assert choice.finish_reason == "stop", f"Unexpected finish_reason: {choice.finish_reason}"
+    usage = completion.usage
+    assert usage.total_tokens == usage.prompt_tokens + usage.completion_tokens, f"Inconsistent usage: {usage}"
+    print("✓ Chat completion parsed by the SDK")
+    return True
+
+
+def test_chat_raw_headers(base_url):
+    """Test that the SDK exposes the simulator's processing headers"""
+    print("\nTesting OpenAI SDK raw response headers...")
+    raw = openai_client(base_url).chat.completions.with_raw_response.create(
+        model="gpt-4",
+        messages=[{"role": "user", "content": "Headers please"}],
+    )
+    assert raw.headers.get("x-request-id", "").startswith("req_"), f"Missing x-request-id: {dict(raw.headers)}"
+    assert raw.parse().choices, "Raw response did not parse"
+    print("✓ Processing headers visible through the SDK")
+    return True
+
+
+def test_streaming(base_url):
+    """Test that SDK stream iteration reassembles the simulator's chunks"""
+    print("\nTesting OpenAI SDK streaming...")
+    stream = openai_client(base_url).chat.completions.create(
+        model="gpt-4",
+        messages=[{"role": "user", "content": "Stream to the SDK"}],
+        stream=True,
+    )
+    content, finish_reason, ids = "", None, set()
+    for chunk in stream:
+        ids.add(chunk.id)
+        for choice in chunk.choices:
+            content += choice.delta.content or ""
+            finish_reason = choice.finish_reason or finish_reason
+    assert content, "No streamed content"
+    assert finish_reason == "stop", f"Unexpected finish_reason: {finish_reason}"
+    assert len(ids) == 1, f"Chunks carry different ids: {ids}"
+    print(f"✓ Stream reassembled ({len(content)} characters)")
+    return True
+
+
+def test_max_tokens(base_url):
+    """Test that max_tokens truncation reports length and exact usage"""
+    print("\nTesting OpenAI SDK max_tokens truncation...")
+    completion = openai_client(base_url).chat.completions.create(
+        model="gpt-4",
+        messages=[{"role": "user", "content": "Please write a long answer about anything at all"}],
+        max_tokens=3,
+    )
+    assert completion.choices[0].finish_reason == "length", f"Unexpected finish_reason: {completion.choices[0].finish_reason}"
+    assert completion.usage.completion_tokens == 3, f"Unexpected completion_tokens: {completion.usage.completion_tokens}"
+    print("✓ Truncated at max_tokens")
+    return True
+
+
+def test_tool_call(base_url):
+    """Test that tool calls parse and their arguments satisfy the declared schema"""
+    print("\nTesting OpenAI SDK tool calls...")
+    completion = openai_client(base_url).chat.completions.create(
+        model="gpt-4",
+        messages=[{"role": "user", "content": "Weather in Paris?"}],
+        tools=[WEATHER_TOOL],
+        tool_choice="required",
+    )
+    choice = completion.choices[0]
+    assert choice.finish_reason == "tool_calls", f"Unexpected finish_reason: {choice.finish_reason}"
+    call = choice.message.tool_calls[0]
+    assert call.function.name == "get_weather", f"Unexpected function: {call.function.name}"
+    arguments = json.loads(call.function.arguments)
+    assert arguments["city"], f"Empty city: {arguments}"
+    assert arguments["unit"] in ("celsius", "fahrenheit"), f"Unit outside enum: {arguments}"
+    assert 1 <= arguments["days"] <= 7, f"Days out of range: {arguments}"
+    print(f"✓ Tool call arguments valid: {arguments}")
+    return True
+
+
+def test_streamed_tool_call(base_url):
+    """Test that streamed tool call deltas accumulate into valid JSON"""
+    print("\nTesting OpenAI SDK streamed tool calls...")
+    stream = openai_client(base_url).chat.completions.create(
+        model="gpt-4",
+        messages=[{"role": "user", "content": "Weather in Oslo?"}],
+        tools=[WEATHER_TOOL],
+        tool_choice="required",
+        stream=True,
+    )
+    name, arguments = None, ""
+    for chunk in stream:
+        for choice in chunk.choices:
+            for delta in choice.delta.tool_calls or []:
+                if delta.function is not None:
+                    name = delta.function.name or name
+                    arguments += delta.function.arguments or ""
+    assert name == "get_weather", f"Unexpected function: {name}"
+    assert set(json.loads(arguments)) >= {"city", "unit", "days"}, f"Missing required arguments: {arguments}"
+    print("✓ Streamed tool call reassembled")
+    return True
+
+
+def test_embeddings(base_url):
+    """Test embeddings, including shortened dimensions"""
+    print("\nTesting OpenAI SDK embeddings...")
+    client = openai_client(base_url)
+    response = client.embeddings.create(model="text-embedding-3-small", input=["alpha", "beta"], dimensions=256)
+    assert len(response.data) == 2, f"Unexpected data length: {len(response.data)}"
+    assert all(len(item.embedding) == 256 for item in response.data), "Wrong embedding size"
+    again = client.embeddings.create(model="text-embedding-3-small", input="alpha", dimensions=256)
+    assert again.data[0].embedding == response.data[0].embedding, "Embeddings are not deterministic"
+    print("✓ Embeddings sized and deterministic")
+    return True
+
+
+def test_errors(base_url):
+    """Test that error responses map to the SDK's exception classes"""
+    print("\nTesting OpenAI SDK error mapping...")
+    client = openai_client(base_url)
+    try:
+        client.chat.completions.create(model="no-such-model", messages=[{"role": "user", "content": "Hi"}])
+        raise AssertionError("Unknown model was accepted")
+    except openai.BadRequestError as e:
+        assert e.status_code == 400, f"Unexpected status: {e.status_code}"
+    try:
+        client.embeddings.create(model="text-embedding-ada-002", input="Hi", dimensions=64)
+        raise AssertionError("dimensions was accepted for ada-002")
+    except openai.BadRequestError as e:
+        assert e.param == "dimensions", f"Unexpected param: {e.param}"
+    try:
+        client.embeddings.create(model="no-such-embedding", input="Hi")
+        raise AssertionError("Unknown embedding model was accepted")
+    except openai.NotFoundError as e:
+        assert e.code == "model_not_found", f"Unexpected code: {e.code}"
+    print("✓ Errors raised as BadRequestError / NotFoundError")
+    return True
+
+
+def test_anthropic_messages(base_url):
+    """Test Messages API calls and streams through the Anthropic SDK"""
+    print("\nTesting Anthropic SDK messages...")
+    if anthropic is None:
+        print("- Skipped: the anthropic package is not installed")
+        return True
+    client = anthropic.Anthropic(api_key="sk-ant-sdk-compat", base_url=base_url, max_retries=0)
+    message = client.messages.create(
+        model="claude-3-5-sonnet-20241022",
+        max_tokens=256,
+        messages=[{"role": "user", "content": "Hello from the Anthropic SDK"}],
+    )
+    assert message.type == "message", f"Unexpected type: {message.type}"
+    assert message.content[0].text, "Empty text block"
+    assert message.stop_reason == "end_turn", f"Unexpected stop_reason: {message.stop_reason}"
+    with client.messages.stream(
+        model="claude-3-5-sonnet-20241022",
+        max_tokens=256,
+        messages=[{"role": "user", "content": "Stream from the Anthropic SDK"}],
+    ) as stream:
+        text = "".join(stream.text_stream)
+        final = stream.get_final_message()
+    assert text == final.content[0].text, "Streamed text differs from the final message"
+    print("✓ Anthropic messages and streams parsed")
+    return True
+
+
+def main():
+    """Run all SDK tests"""
+    import os
+    base_url = sys.argv[1] if len(sys.argv) > 1 else os.getenv('SIMULATOR_URL', 'http://localhost:8000')
+
+    print(f"Testing SDK compatibility of the LLM Behavior Simulator at {base_url}")
+    print(f"openai {openai.__version__}" + (f", anthropic {anthropic.__version__}" if anthropic else ""))
+    print("=" * 60)
+
+    # Give server a moment to be ready
+    time.sleep(1)
+
+    tests = [
+        test_chat,
+        test_chat_raw_headers,
+        test_streaming,
+        test_max_tokens,
+        test_tool_call,
+        test_streamed_tool_call,
+        test_embeddings,
+        test_errors,
+        test_anthropic_messages,
+    ]
+
+    passed = 0
+    failed = 0
+
+    for test in tests:
+        try:
+            if test(base_url):
+                passed += 1
+        except Exception as e:
+            print(f"✗ Test failed: {e}")
+            failed += 1
+
+    print("\n" + "=" * 60)
+    print(f"Tests completed: {passed} passed, {failed} failed")
+
+    if failed > 0:
+        sys.exit(1)
+    else:
+        print("\n✓ All SDK tests passed!")
+        sys.exit(0)
+
+
+if __name__ == "__main__":
+    main()